@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/myzhan/goreplay-udp/pipeline"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Plugins which buffer writes, like file output
+type flusher interface {
+	Flush() error
+}
+
+// Plugins which write chunks, like file output
+type rotator interface {
+	Rotate() error
+}
+
+type pluginInfo struct {
+	ID      int              `json:"id"`
+	Name    string           `json:"name"`
+	Kind    string           `json:"kind"`
+	State   string           `json:"state"`
+	Speed   float64          `json:"speed,omitempty"`
+	Limit   string           `json:"limit,omitempty"`
+	Read    *pipeline.Counts `json:"read,omitempty"`
+	Written *pipeline.Counts `json:"written,omitempty"`
+}
+
+// adminServer controls running plugins over HTTP:
+//
+//	GET  /healthz                       process is alive
+//	GET  /readyz                        plugins are running
+//	GET  /plugins                       plugins with their state and counters
+//	POST /plugins/<id>/pause            stop reading from input
+//	POST /plugins/<id>/resume           continue reading from input
+//	POST /plugins/<id>/speed?value=2    change replay speed of file input
+//	POST /plugins/<id>/limit?value=10%  change limit of plugin started with "|" limit
+//	POST /plugins/<id>/flush            flush file output
+//	POST /plugins/<id>/rotate           continue file output in the next chunk
+type adminServer struct {
+	pipeline *pipeline.Pipeline
+}
+
+// serveAdmin starts admin API of pipeline on given address
+func serveAdmin(address string, p *pipeline.Pipeline) error {
+	a := &adminServer{pipeline: p}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("admin listener failure: %v", err)
+	}
+
+	go func() {
+		log.Println("Serving admin API on", address)
+		if err := http.Serve(listener, a.handler()); err != nil {
+			log.Println("Admin listener failure:", err)
+		}
+	}()
+
+	return nil
+}
+
+func (a *adminServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", a.healthz)
+	mux.HandleFunc("/readyz", a.readyz)
+	mux.HandleFunc("/plugins", a.plugins)
+	mux.HandleFunc("/plugins/", a.control)
+
+	return mux
+}
+
+func (a *adminServer) healthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+func (a *adminServer) readyz(w http.ResponseWriter, r *http.Request) {
+	if !a.pipeline.Running() {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+func (a *adminServer) plugins(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	list := a.pipeline.Stats()
+	infos := make([]pluginInfo, 0, len(list))
+	for id, s := range list {
+		infos = append(infos, a.info(id, s))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(infos)
+}
+
+func (a *adminServer) info(id int, s pipeline.PluginStats) pluginInfo {
+	plugin := s.Plugin
+	info := pluginInfo{ID: id, Name: s.Name, Kind: pluginKind(plugin), State: "running", Read: s.Read, Written: s.Written}
+
+	if !a.pipeline.Running() {
+		info.State = "stopped"
+	} else if a.pipeline.Paused(plugin) {
+		info.State = "paused"
+	} else if a.pipeline.Disabled(plugin) {
+		info.State = "disabled"
+	}
+
+	if sc, ok := unwrapLimiter(plugin).(pipeline.SpeedController); ok {
+		info.Speed = sc.Speed()
+	}
+	if l, ok := plugin.(*pipeline.Limiter); ok {
+		info.Limit = l.Limit()
+	}
+
+	return info
+}
+
+// control runs action on plugin, path is /plugins/<id>/<action>
+func (a *adminServer) control(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/plugins/"), "/"), "/")
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+
+	list := a.pipeline.Stats()
+	id, err := strconv.Atoi(parts[0])
+	if err != nil || id < 0 || id >= len(list) {
+		http.Error(w, "unknown plugin "+parts[0], http.StatusNotFound)
+		return
+	}
+
+	if err := a.runAction(list[id].Plugin, parts[1], r.URL.Query().Get("value")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Counters are read again, so the response shows plugin after the action
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.info(id, a.pipeline.Stats()[id]))
+}
+
+var errUnsupported = errors.New("action is not supported by plugin")
+
+func (a *adminServer) runAction(plugin interface{}, action, value string) error {
+	target := unwrapLimiter(plugin)
+
+	switch action {
+	case "pause":
+		return a.pipeline.Pause(plugin)
+	case "resume":
+		return a.pipeline.Resume(plugin)
+	case "speed":
+		s, ok := target.(pipeline.SpeedController)
+		if !ok {
+			return errUnsupported
+		}
+		speed, err := strconv.ParseFloat(value, 64)
+		if err != nil || speed <= 0 {
+			return fmt.Errorf("speed should be positive number, got %q", value)
+		}
+		s.SetSpeed(speed)
+	case "limit":
+		l, ok := plugin.(*pipeline.Limiter)
+		if !ok {
+			return errors.New("plugin has no limit, add it to plugin address after |")
+		}
+		return l.SetLimit(value)
+	case "flush":
+		f, ok := target.(flusher)
+		if !ok {
+			return errUnsupported
+		}
+		return f.Flush()
+	case "rotate":
+		r, ok := target.(rotator)
+		if !ok {
+			return errUnsupported
+		}
+		return r.Rotate()
+	default:
+		return fmt.Errorf("unknown action %q", action)
+	}
+
+	return nil
+}
+
+// unwrapLimiter returns plugin wrapped by limiter
+func unwrapLimiter(plugin interface{}) interface{} {
+	if l, ok := plugin.(*pipeline.Limiter); ok {
+		return l.Plugin()
+	}
+	return plugin
+}
+
+func pluginKind(plugin interface{}) string {
+	if _, ok := plugin.(*pipeline.Middleware); ok {
+		return "middleware"
+	}
+	if _, ok := unwrapLimiter(plugin).(pipeline.PluginWriter); ok {
+		return "output"
+	}
+	return "input"
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/myzhan/goreplay-udp/output"
+	"github.com/myzhan/goreplay-udp/pipeline"
+	"github.com/myzhan/goreplay-udp/proto"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// speedInput emits one message, then waits until closed
+type speedInput struct {
+	speed float64
+	sent  bool
+	stop  chan struct{}
+}
+
+func (i *speedInput) PluginRead() (*proto.Message, error) {
+	if !i.sent {
+		i.sent = true
+		return &proto.Message{Meta: proto.PayloadHeader(proto.RequestPayload, []byte("uuid"), 1, nil), Data: []byte("data")}, nil
+	}
+	<-i.stop
+	return nil, output.ErrorStopped
+}
+
+func (i *speedInput) Close() error {
+	close(i.stop)
+	return nil
+}
+
+func (i *speedInput) Speed() float64         { return i.speed }
+func (i *speedInput) SetSpeed(speed float64) { i.speed = speed }
+
+func TestAdminServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "admin")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	in := &speedInput{speed: 1, stop: make(chan struct{})}
+	limited, err := pipeline.NewLimiter(in, "100")
+	assert.Nil(t, err)
+	file, err := output.NewFileOutput(filepath.Join(dir, "requests.gor"), &output.FileOutputConfig{FlushInterval: time.Minute, SizeLimit: 1 << 20, QueueLimit: 1000, Format: output.FormatText})
+	assert.Nil(t, err)
+
+	p := pipeline.New(pipeline.Config{})
+	assert.Nil(t, p.AddInput(limited))
+	assert.Nil(t, p.AddOutput(file, nil))
+	assert.Nil(t, p.AddOutput(output.NewNullOutput(), nil))
+
+	server := httptest.NewServer((&adminServer{pipeline: p}).handler())
+	defer server.Close()
+
+	request := func(method, path string) (int, pluginInfo) {
+		req, err := http.NewRequest(method, server.URL+path, nil)
+		assert.Nil(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+
+		var info pluginInfo
+		if resp.Header.Get("Content-Type") == "application/json" {
+			assert.Nil(t, json.NewDecoder(resp.Body).Decode(&info))
+		}
+		return resp.StatusCode, info
+	}
+
+	code, _ := request(http.MethodGet, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- p.Run(ctx)
+	}()
+	assert.Eventually(t, p.Running, time.Second, time.Millisecond)
+
+	code, _ = request(http.MethodGet, "/readyz")
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = request(http.MethodGet, "/healthz")
+	assert.Equal(t, http.StatusOK, code)
+
+	for _, c := range []struct {
+		method string
+		path   string
+		code   int
+		state  string
+	}{
+		{http.MethodPost, "/plugins/0/pause", http.StatusOK, "paused"},
+		{http.MethodPost, "/plugins/0/resume", http.StatusOK, "running"},
+		{http.MethodPost, "/plugins/0/speed?value=2", http.StatusOK, "running"},
+		{http.MethodPost, "/plugins/0/limit?value=10%25", http.StatusOK, "running"},
+		{http.MethodPost, "/plugins/1/flush", http.StatusOK, "running"},
+		{http.MethodPost, "/plugins/1/rotate", http.StatusOK, "running"},
+
+		{http.MethodGet, "/plugins/0/pause", http.StatusMethodNotAllowed, ""},
+		{http.MethodPost, "/plugins", http.StatusMethodNotAllowed, ""},
+		{http.MethodPost, "/plugins/0/speed?value=fast", http.StatusBadRequest, ""},
+		{http.MethodPost, "/plugins/0/speed?value=-1", http.StatusBadRequest, ""},
+		{http.MethodPost, "/plugins/0/limit?value=many", http.StatusBadRequest, ""},
+		{http.MethodPost, "/plugins/1/limit?value=10", http.StatusBadRequest, ""},
+		{http.MethodPost, "/plugins/1/pause", http.StatusBadRequest, ""},
+		{http.MethodPost, "/plugins/2/flush", http.StatusBadRequest, ""},
+		{http.MethodPost, "/plugins/2/rotate", http.StatusBadRequest, ""},
+		{http.MethodPost, "/plugins/1/speed?value=2", http.StatusBadRequest, ""},
+		{http.MethodPost, "/plugins/0/jump", http.StatusBadRequest, ""},
+		{http.MethodPost, "/plugins/3/pause", http.StatusNotFound, ""},
+		{http.MethodPost, "/plugins/x/pause", http.StatusNotFound, ""},
+		{http.MethodPost, "/plugins/0", http.StatusNotFound, ""},
+	} {
+		code, info := request(c.method, c.path)
+		assert.Equal(t, c.code, code, c.path)
+		assert.Equal(t, c.state, info.State, c.path)
+	}
+
+	// Speed of file input changes both directly and through percent limit
+	_, info := request(http.MethodPost, "/plugins/0/speed?value=3")
+	assert.Equal(t, 3.0, info.Speed)
+	assert.Equal(t, "10%", info.Limit)
+	assert.Equal(t, "input", info.Kind)
+
+	_, info = request(http.MethodPost, "/plugins/1/flush")
+	assert.Equal(t, "output", info.Kind)
+	assert.Equal(t, uint64(1), info.Written.Messages)
+
+	list := func() (infos []pluginInfo) {
+		resp, err := http.Get(server.URL + "/plugins")
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&infos))
+		return
+	}
+	assert.Equal(t, 3, len(list()))
+
+	cancel()
+	assert.Nil(t, <-done)
+
+	code, _ = request(http.MethodGet, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	for _, info := range list() {
+		assert.Equal(t, "stopped", info.State)
+	}
+}
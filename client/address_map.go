@@ -0,0 +1,124 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+type addressRule struct {
+	from     *net.IPNet
+	to       *net.IPNet
+	fromPort uint16
+	toPort   uint16
+}
+
+// AddressMap translates addresses using list of "from=to" rules. Each side is IP, IP:port or
+// CIDR network, e.g. 10.0.0.5:53=10.1.0.5:5353 or 10.0.0.0/16=192.168.0.0/16. Network rules keep host bits.
+// The first matching rule wins, addresses which match no rule are left as is.
+type AddressMap struct {
+	rules []addressRule
+}
+
+// NewAddressMap parses translation rules
+func NewAddressMap(rules []string) (*AddressMap, error) {
+	m := new(AddressMap)
+
+	for _, r := range rules {
+		sides := strings.SplitN(r, "=", 2)
+		if len(sides) != 2 {
+			return nil, fmt.Errorf("invalid address rule %q, expected from=to", r)
+		}
+
+		var rule addressRule
+		var err error
+
+		if rule.from, rule.fromPort, err = parseAddress(sides[0]); err != nil {
+			return nil, fmt.Errorf("invalid address rule %q: %v", r, err)
+		}
+		if rule.to, rule.toPort, err = parseAddress(sides[1]); err != nil {
+			return nil, fmt.Errorf("invalid address rule %q: %v", r, err)
+		}
+
+		fromOnes, fromBits := rule.from.Mask.Size()
+		toOnes, toBits := rule.to.Mask.Size()
+		if fromOnes != toOnes || fromBits != toBits {
+			return nil, fmt.Errorf("invalid address rule %q: networks have different size", r)
+		}
+
+		m.rules = append(m.rules, rule)
+	}
+
+	return m, nil
+}
+
+// parseAddress accepts IP, IP:port, [IPv6]:port or CIDR network
+func parseAddress(s string) (network *net.IPNet, port uint16, err error) {
+	s = strings.TrimSpace(s)
+
+	if _, network, err = net.ParseCIDR(s); err == nil {
+		return network, 0, nil
+	}
+
+	host := s
+	if h, p, err := net.SplitHostPort(s); err == nil {
+		host = h
+		intPort, err := strconv.ParseUint(p, 10, 16)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid port %q", p)
+		}
+		port = uint16(intPort)
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, 0, fmt.Errorf("invalid IP %q", host)
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, port, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, port, nil
+}
+
+// Translate returns address for the first matching rule. Rule without port keeps the original one.
+func (m *AddressMap) Translate(ip net.IP, port uint16) (net.IP, uint16) {
+	if m == nil {
+		return ip, port
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	for _, r := range m.rules {
+		if r.fromPort != 0 && r.fromPort != port {
+			continue
+		}
+		if len(ip) != len(r.from.IP) || !r.from.Contains(ip) {
+			continue
+		}
+
+		translated := make(net.IP, len(ip))
+		for i := range ip {
+			translated[i] = r.to.IP[i] | (ip[i] &^ r.from.Mask[i])
+		}
+
+		if r.toPort != 0 {
+			port = r.toPort
+		}
+
+		return translated, port
+	}
+
+	return ip, port
+}
+
+// Len returns number of rules
+func (m *AddressMap) Len() int {
+	if m == nil {
+		return 0
+	}
+	return len(m.rules)
+}
@@ -0,0 +1,39 @@
+package client
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+)
+
+func TestAddressMap(t *testing.T) {
+	m, err := NewAddressMap([]string{
+		"10.0.0.5:53=10.1.0.5:5353",
+		"10.0.0.0/16=172.16.0.0/16",
+		"[fe80::1]:53=[2001:db8::1]:53",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, m.Len())
+
+	ip, port := m.Translate(net.ParseIP("10.0.0.5"), 53)
+	assert.Equal(t, "10.1.0.5", ip.String())
+	assert.Equal(t, uint16(5353), port)
+
+	ip, port = m.Translate(net.ParseIP("10.0.3.7"), 4000)
+	assert.Equal(t, "172.16.3.7", ip.String())
+	assert.Equal(t, uint16(4000), port)
+
+	ip, port = m.Translate(net.ParseIP("fe80::1"), 53)
+	assert.Equal(t, "2001:db8::1", ip.String())
+	assert.Equal(t, uint16(53), port)
+
+	ip, port = m.Translate(net.ParseIP("192.168.1.1"), 53)
+	assert.Equal(t, "192.168.1.1", ip.String())
+	assert.Equal(t, uint16(53), port)
+
+	_, err = NewAddressMap([]string{"10.0.0.0/16=172.16.0.0/24"})
+	assert.NotNil(t, err)
+
+	_, err = NewAddressMap([]string{"10.0.0.1"})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,104 @@
+package client
+
+import (
+	"errors"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"net"
+)
+
+// RawClient sends datagrams with the given source address, building IP and UDP headers itself.
+// Responses go to the original source, so they can't be read back.
+type RawClient struct {
+	address    string
+	dst        *net.UDPAddr
+	addressMap *AddressMap
+
+	conn rawConn
+}
+
+// rawConn sends IP packets with custom headers, implemented per platform
+type rawConn interface {
+	WritePacket(packet []byte, dst net.IP) error
+	Close() error
+}
+
+// NewRawClient constructor for RawClient, accepts target address and optional translation of source addresses
+func NewRawClient(address string, addressMap *AddressMap) (c *RawClient, err error) {
+	c = new(RawClient)
+	c.address = address
+	c.addressMap = addressMap
+
+	if c.dst, err = net.ResolveUDPAddr("udp", address); err != nil {
+		return nil, err
+	}
+
+	if c.conn, err = newRawConn(c.dst.IP.To4() == nil); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Send writes datagram to target address on behalf of srcIP:srcPort
+func (c *RawClient) Send(data []byte, srcIP net.IP, srcPort uint16) error {
+	srcIP, srcPort = c.addressMap.Translate(srcIP, srcPort)
+
+	packet, err := c.buildPacket(data, srcIP, srcPort)
+	if err != nil {
+		return err
+	}
+
+	return c.conn.WritePacket(packet, c.dst.IP)
+}
+
+func (c *RawClient) buildPacket(data []byte, srcIP net.IP, srcPort uint16) ([]byte, error) {
+	var network gopacket.NetworkLayer
+
+	udp := &layers.UDP{
+		SrcPort: layers.UDPPort(srcPort),
+		DstPort: layers.UDPPort(c.dst.Port),
+	}
+
+	if dst4 := c.dst.IP.To4(); dst4 != nil {
+		src4 := srcIP.To4()
+		if src4 == nil {
+			return nil, errors.New("can't send IPv6 source address to IPv4 target")
+		}
+
+		network = &layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			Protocol: layers.IPProtocolUDP,
+			SrcIP:    src4,
+			DstIP:    dst4,
+		}
+	} else {
+		if srcIP.To4() != nil {
+			return nil, errors.New("can't send IPv4 source address to IPv6 target")
+		}
+
+		network = &layers.IPv6{
+			Version:    6,
+			HopLimit:   64,
+			NextHeader: layers.IPProtocolUDP,
+			SrcIP:      srcIP,
+			DstIP:      c.dst.IP,
+		}
+	}
+
+	if err := udp.SetNetworkLayerForChecksum(network); err != nil {
+		return nil, err
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	err := gopacket.SerializeLayers(buf, opts, network.(gopacket.SerializableLayer), udp, gopacket.Payload(data))
+
+	return buf.Bytes(), err
+}
+
+// Close closes raw socket
+func (c *RawClient) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,46 @@
+package client
+
+import (
+	"net"
+	"syscall"
+)
+
+type linuxRawConn struct {
+	fd   int
+	ipv6 bool
+}
+
+// newRawConn opens IPPROTO_RAW socket, which implies that IP header is included into the packet
+func newRawConn(ipv6 bool) (rawConn, error) {
+	domain := syscall.AF_INET
+	if ipv6 {
+		domain = syscall.AF_INET6
+	}
+
+	fd, err := syscall.Socket(domain, syscall.SOCK_RAW, syscall.IPPROTO_RAW)
+	if err != nil {
+		return nil, err
+	}
+
+	return &linuxRawConn{fd: fd, ipv6: ipv6}, nil
+}
+
+func (c *linuxRawConn) WritePacket(packet []byte, dst net.IP) error {
+	var addr syscall.Sockaddr
+
+	if c.ipv6 {
+		sa := &syscall.SockaddrInet6{}
+		copy(sa.Addr[:], dst.To16())
+		addr = sa
+	} else {
+		sa := &syscall.SockaddrInet4{}
+		copy(sa.Addr[:], dst.To4())
+		addr = sa
+	}
+
+	return syscall.Sendto(c.fd, packet, 0, addr)
+}
+
+func (c *linuxRawConn) Close() error {
+	return syscall.Close(c.fd)
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package client
+
+import "errors"
+
+func newRawConn(ipv6 bool) (rawConn, error) {
+	return nil, errors.New("raw sockets are supported on linux only")
+}
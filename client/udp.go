@@ -1,6 +1,7 @@
 package client
 
 import (
+	"fmt"
 	"log"
 	"net"
 	"time"
@@ -14,7 +15,7 @@ type UDPClient struct {
 	conn *net.UDPConn
 }
 
-func NewUDPClient(address string, timeout time.Duration, ignoreResponse bool) (c *UDPClient) {
+func NewUDPClient(address string, timeout time.Duration, ignoreResponse bool) (c *UDPClient, err error) {
 	c = new(UDPClient)
 	c.address = address
 	c.timeout = timeout
@@ -22,12 +23,12 @@ func NewUDPClient(address string, timeout time.Duration, ignoreResponse bool) (c
 
 	addr, err := net.ResolveUDPAddr("udp", address)
 	if err != nil {
-		log.Fatalf("Error initialize UDP Client %s\n", address)
+		return nil, fmt.Errorf("error initialize UDP client %s: %v", address, err)
 	}
 
 	conn, err := net.DialUDP("udp", nil, addr)
 	if err != nil {
-		log.Fatalf("Error dialing %s\n", address)
+		return nil, fmt.Errorf("error dialing %s: %v", address, err)
 	}
 
 	c.conn = conn
@@ -38,6 +39,7 @@ func (c *UDPClient) Send(data []byte) (resp []byte, err error) {
 	_, err = c.conn.Write(data)
 	if err != nil {
 		log.Printf("UDP Write Error: %v\n", err)
+		return nil, err
 	}
 
 	if c.ignoreResponse {
@@ -49,10 +51,16 @@ func (c *UDPClient) Send(data []byte) (resp []byte, err error) {
 	respLength, err := c.conn.Read(resp)
 	if err != nil {
 		log.Printf("UDP Read Error: %v\n", err)
+		return nil, err
 	}
 	if len(resp) <= respLength {
 		log.Printf("UDP Response may be truncated, length of response is %d\n", respLength)
 	}
 
-	return resp, err
+	return resp[:respLength], nil
+}
+
+// Close closes client socket
+func (c *UDPClient) Close() error {
+	return c.conn.Close()
 }
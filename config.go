@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/myzhan/goreplay-udp/dns"
+	"github.com/myzhan/goreplay-udp/listener"
+	"github.com/myzhan/goreplay-udp/modifier"
+	"github.com/myzhan/goreplay-udp/output"
+	"github.com/myzhan/goreplay-udp/pipeline"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// settingsErrors collects all problems of configuration, so they are reported at once
+type settingsErrors []string
+
+func (e settingsErrors) Error() string {
+	return "invalid configuration:\n\t" + strings.Join(e, "\n\t")
+}
+
+// loadConfig sets flags not given on command line from yaml or json file. Keys are flag names,
+// the same as json tags of plugin configs, and lists are used for flags which can be repeated:
+//
+//	input-udp: [":53"]
+//	output-udp: ["staging:53|100,burst=200"]
+//	output-udp-workers: 10
+//	output-udp-timeout: 2s
+func loadConfig(path string) (errs settingsErrors) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return settingsErrors{err.Error()}
+	}
+
+	values := make(map[string]interface{})
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		d := json.NewDecoder(bytes.NewReader(data))
+		// Keeps large integers as they are written
+		d.UseNumber()
+		err = d.Decode(&values)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &values)
+	default:
+		return settingsErrors{fmt.Sprintf("unknown format of config %s, use .yaml, .yml or .json", path)}
+	}
+	if err != nil {
+		return settingsErrors{fmt.Sprintf("config %s: %v", path, err)}
+	}
+
+	// Flags given on command line override file values
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		f := flag.Lookup(name)
+		if f == nil || name == "config" {
+			errs = append(errs, fmt.Sprintf("config %s: unknown option %q", path, name))
+			continue
+		}
+		if set[name] {
+			continue
+		}
+
+		list, err := configValues(values[name])
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("config %s: %s %v", path, name, err))
+			continue
+		}
+		if _, multi := f.Value.(*MultiOption); len(list) > 1 && !multi {
+			errs = append(errs, fmt.Sprintf("config %s: %s can't be a list", path, name))
+			continue
+		}
+
+		for _, v := range list {
+			if err := flag.Set(name, v); err != nil {
+				errs = append(errs, fmt.Sprintf("config %s: invalid value %q for %s: %v", path, v, name, err))
+			}
+		}
+	}
+
+	return errs
+}
+
+// configValues converts value of config key to flag values
+func configValues(value interface{}) ([]string, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case []interface{}:
+		list := make([]string, 0, len(v))
+		for _, item := range v {
+			switch item.(type) {
+			case []interface{}, map[string]interface{}, map[interface{}]interface{}:
+				return nil, fmt.Errorf("should be a list of values")
+			}
+			list = append(list, fmt.Sprint(item))
+		}
+		return list, nil
+	case map[string]interface{}, map[interface{}]interface{}:
+		return nil, fmt.Errorf("can't be a map")
+	default:
+		return []string{fmt.Sprint(v)}, nil
+	}
+}
+
+// validateSettings checks values which flags can't check by themselves
+func validateSettings() (errs settingsErrors) {
+	check := func(err error) {
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if Settings.splitOutputMode != pipeline.SplitRoundRobin && Settings.splitOutputMode != pipeline.SplitFlowHash {
+		errs = append(errs, fmt.Sprintf("unknown split output mode %q, available: %s, %s", Settings.splitOutputMode, pipeline.SplitRoundRobin, pipeline.SplitFlowHash))
+	}
+
+	if f := Settings.outputStdoutFormat; Settings.outputStdout && f != output.FormatText && f != output.FormatDNS {
+		errs = append(errs, fmt.Sprintf("unknown output stdout format %q, available: %s, %s", f, output.FormatText, output.FormatDNS))
+	}
+
+	if f := Settings.outputFileConfig.Format; len(Settings.outputFile) > 0 && f != output.FormatText && f != output.FormatBinary {
+		errs = append(errs, fmt.Sprintf("unknown output file format %q, available: %s, %s", f, output.FormatText, output.FormatBinary))
+	}
+
+	if p := Settings.outputDiffConfig.Protocol; len(Settings.outputDiff) > 0 && p != output.DiffBytes && p != output.DiffDNS {
+		errs = append(errs, fmt.Sprintf("unknown output diff protocol %q, available: %s, %s", p, output.DiffBytes, output.DiffDNS))
+	}
+
+	if e := Settings.middlewareEncoding; Settings.middleware != "" && e != pipeline.MiddlewareHex && e != pipeline.MiddlewareBase64 {
+		errs = append(errs, fmt.Sprintf("unknown middleware encoding %q, available: %s, %s", e, pipeline.MiddlewareHex, pipeline.MiddlewareBase64))
+	}
+
+	if len(Settings.outputUDP) > 0 {
+		if err := output.ValidateUDPOutputConfig(&Settings.outputUDPConfig); err != nil {
+			errs = append(errs, fmt.Sprintf("output udp: %v", err))
+		}
+	}
+
+	if len(Settings.inputUDP) > 0 && Settings.inputUDPConfig.TrackResponse || len(Settings.inputPcap) > 0 && Settings.inputPcapTrackResponse {
+		if _, ok := listener.NewCorrelator(Settings.inputUDPConfig.ResponseMatch, 0); !ok {
+			errs = append(errs, fmt.Sprintf("unknown response match %q, available: %s", Settings.inputUDPConfig.ResponseMatch, strings.Join(listener.CorrelationKeys(), ", ")))
+		}
+	}
+
+	addresses := append([]string(nil), Settings.inputUDP...)
+	if len(Settings.inputPcap) > 0 {
+		addresses = append(addresses, Settings.inputPcapAddr)
+	}
+	for _, options := range addresses {
+		address, _ := extractLimitOptions(options)
+		if _, ports, err := net.SplitHostPort(address); err != nil {
+			errs = append(errs, fmt.Sprintf("invalid input address %q: %v", address, err))
+		} else {
+			_, err = listener.ParsePorts(ports)
+			check(err)
+		}
+	}
+
+	_, err := parseErrorPolicies(Settings.outputErrorPolicy)
+	check(err)
+	_, err = modifier.NewModifier(&Settings.modifierConfig)
+	check(err)
+	_, err = dns.NewModifier(&Settings.dnsConfig)
+	check(err)
+
+	inputs := [][]string{Settings.inputUDP, Settings.inputPcap, Settings.inputFile, Settings.inputHttp}
+	outputs := [][]string{Settings.outputFile, Settings.outputUDP, Settings.outputDiff, Settings.outputHttp}
+
+	var inputsCount, outputsCount int
+	for _, list := range inputs {
+		inputsCount += len(list)
+	}
+	for _, list := range outputs {
+		outputsCount += len(list)
+	}
+	if Settings.outputStdout {
+		outputsCount++
+	}
+	if Settings.outputNull {
+		outputsCount++
+	}
+	if inputsCount == 0 || outputsCount == 0 {
+		errs = append(errs, "required at least 1 input and 1 output")
+	}
+
+	for _, list := range append(inputs, outputs...) {
+		for _, options := range list {
+			if _, limit := extractLimitOptions(options); limit != "" {
+				check(pipeline.ValidateLimit(limit))
+			}
+		}
+	}
+
+	return errs
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"flag"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// resetSettings brings flags and settings back to defaults, as if nothing was given on command line
+func resetSettings() {
+	Settings = AppSettings{}
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	registerFlags()
+}
+
+func writeConfig(t *testing.T, name, content string) string {
+	dir, err := ioutil.TempDir("", "config")
+	assert.Nil(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, name)
+	assert.Nil(t, ioutil.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	for name, content := range map[string]string{
+		"replay.yaml": "input-udp: [\":53\", \":5353\"]\noutput-udp: staging:53|100\noutput-udp-workers: 10\noutput-udp-timeout: 2s\noutput-udp-flow-affinity: true\n",
+		"replay.json": `{"input-udp": [":53", ":5353"], "output-udp": "staging:53|100", "output-udp-workers": 10, "output-udp-timeout": "2s", "output-udp-flow-affinity": true}`,
+	} {
+		resetSettings()
+
+		// Given on command line
+		assert.Nil(t, flag.CommandLine.Parse([]string{"--output-udp-workers", "20"}))
+
+		assert.Nil(t, loadConfig(writeConfig(t, name, content)), name)
+		assert.Equal(t, MultiOption{":53", ":5353"}, Settings.inputUDP, name)
+		assert.Equal(t, MultiOption{"staging:53|100"}, Settings.outputUDP, name)
+		assert.Equal(t, 20, Settings.outputUDPConfig.Workers, name)
+		assert.Equal(t, 2*time.Second, Settings.outputUDPConfig.Timeout, name)
+		assert.True(t, Settings.outputUDPConfig.FlowAffinity, name)
+		assert.Nil(t, validateSettings(), name)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	resetSettings()
+
+	path := writeConfig(t, "replay.yml", `
+input-udp: ":53"
+input-udp-typo: 1
+config: other.yaml
+output-udp-workers: [1, 2]
+output-udp-timeout: soon
+output-udp: {staging: 53}
+input-file: [[a, b]]
+`)
+
+	// All problems are reported at once
+	errs := loadConfig(path)
+	assert.Equal(t, 6, len(errs), errs)
+	assert.Contains(t, errs.Error(), `unknown option "input-udp-typo"`)
+	assert.Contains(t, errs.Error(), `unknown option "config"`)
+	assert.Contains(t, errs.Error(), "output-udp-workers can't be a list")
+	assert.Contains(t, errs.Error(), `invalid value "soon" for output-udp-timeout`)
+	assert.Contains(t, errs.Error(), "output-udp can't be a map")
+	assert.Contains(t, errs.Error(), "input-file should be a list of values")
+	assert.Equal(t, MultiOption{":53"}, Settings.inputUDP)
+
+	assert.NotNil(t, loadConfig(writeConfig(t, "replay.toml", "")))
+	assert.NotNil(t, loadConfig(writeConfig(t, "replay.json", "{")))
+	assert.NotNil(t, loadConfig(filepath.Join(os.TempDir(), "missing.yaml")))
+}
+
+func TestValidateSettings(t *testing.T) {
+	resetSettings()
+
+	assert.Nil(t, flag.CommandLine.Parse([]string{
+		"--split-output-mode", "random",
+		"--middleware", "cat", "--middleware-encoding", "utf8",
+		"--output-error-policy", "tcp=abort",
+		"--input-udp", ":dns",
+		"--input-file", "dns.req|fast",
+	}))
+
+	errs := validateSettings()
+	assert.Equal(t, 6, len(errs), errs)
+	assert.Contains(t, errs.Error(), `unknown split output mode "random"`)
+	assert.Contains(t, errs.Error(), `unknown middleware encoding "utf8"`)
+	assert.Contains(t, errs.Error(), `unknown output "tcp" in error policy`)
+	assert.Contains(t, errs.Error(), `invalid port "dns"`)
+	assert.Contains(t, errs.Error(), `invalid limit "fast"`)
+	assert.Contains(t, errs.Error(), "required at least 1 input and 1 output")
+}
+
+func TestAmplifyOption(t *testing.T) {
+	resetSettings()
+	assert.Equal(t, 1, Settings.outputUDPConfig.Amplify)
+
+	assert.Nil(t, flag.CommandLine.Parse([]string{"--output-udp-amplify", "x5"}))
+	assert.Equal(t, 5, Settings.outputUDPConfig.Amplify)
+	assert.Nil(t, flag.Set("output-udp-amplify", "3"))
+	assert.Equal(t, 3, Settings.outputUDPConfig.Amplify)
+
+	assert.NotNil(t, flag.Set("output-udp-amplify", "x"))
+	assert.NotNil(t, flag.Set("output-udp-amplify", "0"))
+}
+
+func TestValidateUDPOutputSettings(t *testing.T) {
+	for _, c := range []struct {
+		args []string
+		err  string
+	}{
+		{[]string{"--output-udp-amplify", "2", "--output-udp-amplify-mutate", "sport,ttl"}, `unknown amplify mutation "ttl"`},
+		{[]string{"--output-udp-ramp", "exponential"}, `unknown ramp profile "exponential"`},
+		{[]string{"--output-udp-ramp", "step", "--output-udp-ramp-steps", "0"}, "ramp steps should be positive"},
+		{[]string{"--output-udp-original-destination", "--output-udp-destination-map", "10.0.0.1:53"}, `invalid address rule "10.0.0.1:53"`},
+		{[]string{"--output-udp-raw", "--output-udp-source-map", "10.0.0.1=>10.0.0.2"}, `invalid address rule "10.0.0.1=>10.0.0.2"`},
+		{[]string{"--output-udp-raw", "--output-udp-original-destination"}, "original destination can't be used with raw socket"},
+		{[]string{"--output-udp-timing", "--output-udp-timing-speed", "0"}, "timing speed should be positive"},
+	} {
+		resetSettings()
+
+		args := append([]string{"--input-udp", ":53", "--output-udp", "staging:53"}, c.args...)
+		assert.Nil(t, flag.CommandLine.Parse(args))
+
+		errs := validateSettings()
+		assert.Equal(t, 1, len(errs), errs)
+		assert.Contains(t, errs.Error(), c.err)
+	}
+}
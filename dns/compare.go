@@ -0,0 +1,97 @@
+package dns
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/google/gopacket/layers"
+	"sort"
+	"strings"
+)
+
+// Compare reports differences of two DNS responses, ignoring transaction ID, TTLs and order of records.
+// Returns error if any of them is not a DNS message.
+func Compare(original, replayed []byte) ([]string, error) {
+	a, err := Decode(original)
+	if err != nil {
+		return nil, fmt.Errorf("original: %v", err)
+	}
+	b, err := Decode(replayed)
+	if err != nil {
+		return nil, fmt.Errorf("replayed: %v", err)
+	}
+
+	var diffs []string
+	if a.ResponseCode != b.ResponseCode {
+		diffs = append(diffs, fmt.Sprintf("rcode %s != %s", responseCode(a.ResponseCode), responseCode(b.ResponseCode)))
+	}
+	if a.AA != b.AA {
+		diffs = append(diffs, fmt.Sprintf("aa %t != %t", a.AA, b.AA))
+	}
+	if a.TC != b.TC {
+		diffs = append(diffs, fmt.Sprintf("tc %t != %t", a.TC, b.TC))
+	}
+
+	diffs = append(diffs, compareRecords("answer", a.Answers, b.Answers)...)
+	diffs = append(diffs, compareRecords("authority", a.Authorities, b.Authorities)...)
+
+	return diffs, nil
+}
+
+// compareRecords reports records present only in one of sections
+func compareRecords(section string, a, b []layers.DNSResourceRecord) (diffs []string) {
+	count := make(map[string]int)
+	for i := range a {
+		count[recordString(&a[i])]++
+	}
+	for i := range b {
+		count[recordString(&b[i])]--
+	}
+
+	keys := make([]string, 0, len(count))
+	for k := range count {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if n := count[k]; n > 0 {
+			diffs = append(diffs, fmt.Sprintf("%s missing %q", section, k))
+		} else if n < 0 {
+			diffs = append(diffs, fmt.Sprintf("%s extra %q", section, k))
+		}
+	}
+
+	return diffs
+}
+
+// recordString renders record without TTL
+func recordString(rr *layers.DNSResourceRecord) string {
+	var data string
+
+	switch rr.Type {
+	case layers.DNSTypeA, layers.DNSTypeAAAA:
+		data = rr.IP.String()
+	case layers.DNSTypeNS:
+		data = FQDN(string(rr.NS))
+	case layers.DNSTypeCNAME:
+		data = FQDN(string(rr.CNAME))
+	case layers.DNSTypePTR:
+		data = FQDN(string(rr.PTR))
+	case layers.DNSTypeMX:
+		data = fmt.Sprintf("%d %s", rr.MX.Preference, FQDN(string(rr.MX.Name)))
+	case layers.DNSTypeSRV:
+		data = fmt.Sprintf("%d %d %d %s", rr.SRV.Priority, rr.SRV.Weight, rr.SRV.Port, FQDN(string(rr.SRV.Name)))
+	case layers.DNSTypeSOA:
+		data = fmt.Sprintf("%s %s %d", FQDN(string(rr.SOA.MName)), FQDN(string(rr.SOA.RName)), rr.SOA.Serial)
+	case layers.DNSTypeTXT:
+		txts := make([]string, len(rr.TXTs))
+		for i, txt := range rr.TXTs {
+			txts[i] = fmt.Sprintf("%q", txt)
+		}
+		data = strings.Join(txts, " ")
+	default:
+		data = hex.EncodeToString(rr.Data)
+	}
+
+	return fmt.Sprintf("%s %s %s", FQDN(string(rr.Name)), TypeName(rr.Type), data)
+}
@@ -0,0 +1,147 @@
+package dns
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"strconv"
+	"strings"
+)
+
+// Decode parses DNS message from UDP payload
+func Decode(payload []byte) (*layers.DNS, error) {
+	msg := new(layers.DNS)
+	if err := msg.DecodeFromBytes(payload, gopacket.NilDecodeFeedback); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// Encode serializes DNS message, names are written without compression
+func Encode(msg *layers.DNS) ([]byte, error) {
+	// Decoder merges extended RCODE from OPT record, header keeps only lower bits
+	msg.ResponseCode &= 0x0F
+
+	buf := gopacket.NewSerializeBuffer()
+	if err := msg.SerializeTo(buf, gopacket.SerializeOptions{FixLengths: true}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// edns returns OPT pseudo record of the message
+func edns(msg *layers.DNS) *layers.DNSResourceRecord {
+	for i := range msg.Additionals {
+		if msg.Additionals[i].Type == layers.DNSTypeOPT {
+			return &msg.Additionals[i]
+		}
+	}
+	return nil
+}
+
+// Summary renders message in one line, e.g.
+// id=4660 query A example.com. edns=1232 do
+// id=4660 response NOERROR A example.com. answers=2
+func Summary(payload []byte) (string, error) {
+	msg, err := Decode(payload)
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "id=%d", msg.ID)
+
+	if msg.QR {
+		sb.WriteString(" response " + responseCode(msg.ResponseCode))
+	} else {
+		sb.WriteString(" query")
+	}
+	if msg.OpCode != layers.DNSOpCodeQuery {
+		sb.WriteString(" opcode=" + strconv.Itoa(int(msg.OpCode)))
+	}
+
+	for _, q := range msg.Questions {
+		fmt.Fprintf(&sb, " %s %s", TypeName(q.Type), FQDN(string(q.Name)))
+	}
+
+	if msg.QR {
+		fmt.Fprintf(&sb, " answers=%d", len(msg.Answers))
+	}
+	if msg.TC {
+		sb.WriteString(" tc")
+	}
+	if opt := edns(msg); opt != nil {
+		// UDP payload size is stored in the class field
+		fmt.Fprintf(&sb, " edns=%d", uint16(opt.Class))
+		if opt.TTL&0x8000 != 0 {
+			sb.WriteString(" do")
+		}
+	}
+
+	return sb.String(), nil
+}
+
+func responseCode(code layers.DNSResponseCode) string {
+	switch code {
+	case layers.DNSResponseCodeNoErr:
+		return "NOERROR"
+	case layers.DNSResponseCodeFormErr:
+		return "FORMERR"
+	case layers.DNSResponseCodeServFail:
+		return "SERVFAIL"
+	case layers.DNSResponseCodeNXDomain:
+		return "NXDOMAIN"
+	case layers.DNSResponseCodeNotImp:
+		return "NOTIMP"
+	case layers.DNSResponseCodeRefused:
+		return "REFUSED"
+	}
+	return "RCODE" + strconv.Itoa(int(code))
+}
+
+// TypeName returns mnemonic of query type, or TYPE<n> for unknown ones
+func TypeName(t layers.DNSType) string {
+	if name := t.String(); name != "Unknown" {
+		return name
+	}
+	return "TYPE" + strconv.Itoa(int(t))
+}
+
+// ParseType accepts type mnemonic like AAAA or TYPE<n>
+func ParseType(s string) (layers.DNSType, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+
+	if strings.HasPrefix(s, "TYPE") {
+		n, err := strconv.ParseUint(s[4:], 10, 16)
+		if err != nil {
+			return 0, fmt.Errorf("invalid DNS type %q", s)
+		}
+		return layers.DNSType(n), nil
+	}
+
+	// All mnemonics known to gopacket are below 256
+	for t := 0; t < 256; t++ {
+		if layers.DNSType(t).String() == s {
+			return layers.DNSType(t), nil
+		}
+	}
+	if s == layers.DNSTypeURI.String() {
+		return layers.DNSTypeURI, nil
+	}
+
+	return 0, fmt.Errorf("unknown DNS type %q", s)
+}
+
+// FQDN returns lower case name with trailing dot
+func FQDN(name string) string {
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	return name
+}
+
+// InZone reports whether name equals zone or is below it, both given as FQDN
+func InZone(name, zone string) bool {
+	return zone == "." || name == zone || strings.HasSuffix(name, "."+zone)
+}
@@ -0,0 +1,164 @@
+package dns
+
+import (
+	"encoding/binary"
+	"github.com/google/gopacket/layers"
+	"github.com/myzhan/goreplay-udp/proto"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+)
+
+func query(id uint16, name string, qtype layers.DNSType) []byte {
+	msg := &layers.DNS{
+		ID:        id,
+		RD:        true,
+		Questions: []layers.DNSQuestion{{Name: []byte(name), Type: qtype, Class: layers.DNSClassIN}},
+		Additionals: []layers.DNSResourceRecord{
+			{Type: layers.DNSTypeOPT, Class: 1232, TTL: 0x8000},
+		},
+	}
+
+	payload, err := Encode(msg)
+	if err != nil {
+		panic(err)
+	}
+	return payload
+}
+
+func meta(payloadType byte, uuid string) []byte {
+	return proto.PayloadHeader(payloadType, []byte(uuid), 1, nil)
+}
+
+func TestSummary(t *testing.T) {
+	summary, err := Summary(query(4660, "www.Example.com", layers.DNSTypeAAAA))
+	assert.Nil(t, err)
+	assert.Equal(t, "id=4660 query AAAA www.example.com. edns=1232 do", summary)
+
+	_, err = Summary([]byte("hello"))
+	assert.NotNil(t, err)
+}
+
+func TestParseType(t *testing.T) {
+	for s, expected := range map[string]layers.DNSType{"a": layers.DNSTypeA, "AAAA": layers.DNSTypeAAAA, "TYPE65": 65, "URI": layers.DNSTypeURI} {
+		qtype, err := ParseType(s)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, qtype)
+	}
+
+	_, err := ParseType("BOGUS")
+	assert.NotNil(t, err)
+}
+
+func TestModifierFilter(t *testing.T) {
+	m, err := NewModifier(&Config{
+		AllowName: []string{"example.com"},
+		DenyName:  []string{"internal.example.com."},
+		DenyType:  []string{"TXT,TYPE255"},
+	})
+	assert.Nil(t, err)
+
+	tests := []struct {
+		name    string
+		qtype   layers.DNSType
+		allowed bool
+	}{
+		{"example.com", layers.DNSTypeA, true},
+		{"WWW.EXAMPLE.COM", layers.DNSTypeA, true},
+		{"badexample.com", layers.DNSTypeA, false},
+		{"db.internal.example.com", layers.DNSTypeA, false},
+		{"www.example.com", layers.DNSTypeTXT, false},
+		{"www.example.com", 255, false},
+	}
+
+	for _, tt := range tests {
+		_, ok := m.Rewrite(meta(proto.RequestPayload, "1"), query(1, tt.name, tt.qtype))
+		assert.Equal(t, tt.allowed, ok, tt)
+	}
+
+	// Not a DNS message, so it can't match allowed names
+	_, ok := m.Rewrite(meta(proto.RequestPayload, "1"), []byte("hello"))
+	assert.False(t, ok)
+}
+
+func TestModifierRewrite(t *testing.T) {
+	m, err := NewModifier(&Config{
+		RewriteZone: []string{"example.com:staging.example.net"},
+		RandomizeID: true,
+	})
+	assert.Nil(t, err)
+
+	original := query(4660, "WWW.example.com", layers.DNSTypeA)
+	payload, ok := m.Rewrite(meta(proto.RequestPayload, "uuid"), original)
+	assert.True(t, ok)
+
+	msg, err := Decode(payload)
+	assert.Nil(t, err)
+	assert.Equal(t, "WWW.staging.example.net", string(msg.Questions[0].Name))
+	assert.Equal(t, layers.DNSTypeOPT, msg.Additionals[0].Type)
+	assert.Equal(t, uint16(4660), binary.BigEndian.Uint16(original))
+
+	// Replayed response gets the original ID back
+	response := append([]byte(nil), payload...)
+	response = m.RestoreID(meta(proto.ReplayedResponsePayload, "uuid"), response)
+	assert.Equal(t, uint16(4660), binary.BigEndian.Uint16(response))
+
+	unknown := m.RestoreID(meta(proto.ReplayedResponsePayload, "other"), payload)
+	assert.Equal(t, payload, unknown)
+
+	_, err = NewModifier(&Config{RewriteZone: []string{"example.com"}})
+	assert.NotNil(t, err)
+}
+
+func TestModifierRewriteNotEncoded(t *testing.T) {
+	m, err := NewModifier(&Config{
+		RewriteZone: []string{"example.com:staging.example.net"},
+		RandomizeID: true,
+	})
+	assert.Nil(t, err)
+
+	// Query with HINFO record, which gopacket can't write
+	original := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 1}
+	original = append(original, 3, 'w', 'w', 'w', 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0, 0, 1, 0, 1)
+	original = append(original, 0, 0, 13, 0, 1, 0, 0, 0, 0, 0, 2, 0, 0)
+	unchanged := append([]byte(nil), original...)
+
+	payload, ok := m.Rewrite(meta(proto.RequestPayload, "uuid"), original)
+	assert.True(t, ok)
+
+	// Query is replayed with the original name, ID is randomized in its copy
+	assert.Equal(t, unchanged, original)
+	assert.Equal(t, unchanged[2:], payload[2:])
+	assert.Equal(t, uint16(0x1234), binary.BigEndian.Uint16(m.RestoreID(meta(proto.ReplayedResponsePayload, "uuid"), payload)))
+}
+
+func TestCompare(t *testing.T) {
+	response := func(id uint16, ttl uint32, ips ...string) []byte {
+		msg := &layers.DNS{
+			ID:        id,
+			QR:        true,
+			Questions: []layers.DNSQuestion{{Name: []byte("example.com"), Type: layers.DNSTypeA, Class: layers.DNSClassIN}},
+		}
+		for _, ip := range ips {
+			msg.Answers = append(msg.Answers, layers.DNSResourceRecord{
+				Name: []byte("example.com"), Type: layers.DNSTypeA, Class: layers.DNSClassIN, TTL: ttl, IP: net.ParseIP(ip).To4(),
+			})
+		}
+		payload, err := Encode(msg)
+		if err != nil {
+			panic(err)
+		}
+		return payload
+	}
+
+	diffs, err := Compare(response(1, 300, "10.0.0.1", "10.0.0.2"), response(2, 60, "10.0.0.2", "10.0.0.1"))
+	assert.Nil(t, err)
+	assert.Empty(t, diffs)
+
+	diffs, err = Compare(response(1, 300, "10.0.0.1"), response(1, 300, "10.0.0.3"))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{`answer missing "example.com. A 10.0.0.1"`, `answer extra "example.com. A 10.0.0.3"`}, diffs)
+
+	_, err = Compare(response(1, 300), []byte("hello"))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,261 @@
+package dns
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/google/gopacket/layers"
+	"github.com/myzhan/goreplay-udp/proto"
+	"github.com/myzhan/goreplay-udp/stats"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Randomized IDs are kept this long waiting for replayed responses
+const idTTL = time.Minute
+
+// Config holds DNS filter and rewrite rules as given on command line
+type Config struct {
+	// Zones, query passes if its name equals zone or is below it
+	AllowName []string
+	DenyName  []string
+	// Query types like A, AAAA or TYPE65
+	AllowType []string
+	DenyType  []string
+	// Zone renames as from:to, e.g. example.com:staging.example.com
+	RewriteZone []string
+	// Replace transaction ID of replayed queries, replayed responses get the original one back
+	RandomizeID bool
+}
+
+type zoneRule struct {
+	from string
+	to   string
+}
+
+type originalID struct {
+	id      uint16
+	expires time.Time
+}
+
+// Modifier filters and rewrites DNS queries between inputs and outputs
+type Modifier struct {
+	allowName   []string
+	denyName    []string
+	allowType   map[layers.DNSType]bool
+	denyType    map[layers.DNSType]bool
+	rewriteZone []zoneRule
+	randomizeID bool
+
+	mu        sync.Mutex
+	ids       map[string]originalID
+	lastSweep time.Time
+
+	filtered *stats.Counter
+	errors   *stats.Counter
+}
+
+// NewModifier parses rules of the config
+func NewModifier(config *Config) (m *Modifier, err error) {
+	m = new(Modifier)
+	m.allowName = parseZones(config.AllowName)
+	m.denyName = parseZones(config.DenyName)
+	m.randomizeID = config.RandomizeID
+	m.ids = make(map[string]originalID)
+
+	if m.allowType, err = parseTypes(config.AllowType); err != nil {
+		return nil, err
+	}
+	if m.denyType, err = parseTypes(config.DenyType); err != nil {
+		return nil, err
+	}
+
+	for _, r := range config.RewriteZone {
+		sides := strings.SplitN(r, ":", 2)
+		if len(sides) != 2 || sides[0] == "" || sides[1] == "" {
+			return nil, fmt.Errorf("invalid zone rewrite %q, expected from:to", r)
+		}
+		rule := zoneRule{from: FQDN(sides[0]), to: FQDN(sides[1])}
+		if rule.from == "." {
+			return nil, fmt.Errorf("invalid zone rewrite %q, root zone can't be renamed", r)
+		}
+		m.rewriteZone = append(m.rewriteZone, rule)
+	}
+
+	m.filtered = new(stats.Counter)
+	m.errors = new(stats.Counter)
+
+	return m, nil
+}
+
+func parseZones(zones []string) (parsed []string) {
+	for _, z := range zones {
+		parsed = append(parsed, FQDN(strings.TrimSpace(z)))
+	}
+	return parsed
+}
+
+func parseTypes(types []string) (map[layers.DNSType]bool, error) {
+	parsed := make(map[layers.DNSType]bool)
+
+	for _, list := range types {
+		for _, s := range strings.Split(list, ",") {
+			t, err := ParseType(s)
+			if err != nil {
+				return nil, err
+			}
+			parsed[t] = true
+		}
+	}
+
+	return parsed, nil
+}
+
+func (m *Modifier) hasRules() bool {
+	return len(m.allowName) > 0 || len(m.denyName) > 0 || len(m.allowType) > 0 || len(m.denyType) > 0 ||
+		len(m.rewriteZone) > 0 || m.randomizeID
+}
+
+// RegisterMetrics registers counters of filtered queries and DNS errors
+func (m *Modifier) RegisterMetrics(r *stats.Registry) {
+	if m == nil {
+		return
+	}
+	m.filtered = r.Counter("goreplay_udp_dns_filtered_total", "Number of DNS queries dropped by filter rules")
+	m.errors = r.Counter("goreplay_udp_dns_errors_total", "Number of payloads failed to decode or encode as DNS")
+}
+
+// Rewrite applies rules to DNS query. Returns false if it should be dropped.
+// Payloads which are not DNS only pass if there are no allow rules.
+func (m *Modifier) Rewrite(meta, payload []byte) ([]byte, bool) {
+	if m == nil || !m.hasRules() {
+		return payload, true
+	}
+
+	msg, err := Decode(payload)
+	if err != nil || len(msg.Questions) == 0 {
+		m.errors.Inc()
+		if len(m.allowName) > 0 || len(m.allowType) > 0 {
+			m.filtered.Inc()
+			return nil, false
+		}
+		return payload, true
+	}
+
+	if !m.allowed(msg) {
+		m.filtered.Inc()
+		return nil, false
+	}
+
+	encoded := false
+	if m.rename(msg) {
+		if buf, err := Encode(msg); err != nil {
+			// Record types gopacket can't write are left as is
+			m.errors.Inc()
+		} else {
+			payload, encoded = buf, true
+		}
+	}
+
+	if m.randomizeID {
+		// Payload which is not encoded again is copied, so the original one is never modified
+		if !encoded {
+			payload = append([]byte(nil), payload...)
+		}
+		m.storeID(proto.ParseMeta(meta).UUID, msg.ID)
+		binary.BigEndian.PutUint16(payload, uint16(rand.Intn(1<<16)))
+	}
+
+	return payload, true
+}
+
+func (m *Modifier) allowed(msg *layers.DNS) bool {
+	for _, q := range msg.Questions {
+		name := FQDN(string(q.Name))
+
+		if len(m.allowName) > 0 && !matchZone(m.allowName, name) {
+			return false
+		}
+		if matchZone(m.denyName, name) {
+			return false
+		}
+		if len(m.allowType) > 0 && !m.allowType[q.Type] {
+			return false
+		}
+		if m.denyType[q.Type] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func matchZone(zones []string, name string) bool {
+	for _, z := range zones {
+		if InZone(name, z) {
+			return true
+		}
+	}
+	return false
+}
+
+// rename applies the first matching zone rewrite to question names
+func (m *Modifier) rename(msg *layers.DNS) (changed bool) {
+	for i := range msg.Questions {
+		name := FQDN(string(msg.Questions[i].Name))
+
+		for _, r := range m.rewriteZone {
+			if !InZone(name, r.from) {
+				continue
+			}
+
+			// Keep case of the labels below the zone
+			original := string(msg.Questions[i].Name)
+			prefix := original[:len(name)-len(r.from)]
+			renamed := strings.TrimSuffix(prefix+r.to, ".")
+
+			msg.Questions[i].Name = []byte(renamed)
+			changed = true
+			break
+		}
+	}
+
+	return changed
+}
+
+func (m *Modifier) storeID(uuid []byte, id uint16) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	m.ids[string(uuid)] = originalID{id: id, expires: now.Add(idTTL)}
+
+	if now.Sub(m.lastSweep) > time.Second {
+		for k, v := range m.ids {
+			if now.After(v.expires) {
+				delete(m.ids, k)
+			}
+		}
+		m.lastSweep = now
+	}
+}
+
+// RestoreID puts the original transaction ID back into replayed response
+func (m *Modifier) RestoreID(meta, payload []byte) []byte {
+	if m == nil || !m.randomizeID || len(payload) < 2 {
+		return payload
+	}
+
+	m.mu.Lock()
+	original, ok := m.ids[string(proto.ParseMeta(meta).UUID)]
+	m.mu.Unlock()
+
+	if !ok {
+		return payload
+	}
+
+	restored := append([]byte(nil), payload...)
+	binary.BigEndian.PutUint16(restored, original.id)
+	return restored
+}
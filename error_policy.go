@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"github.com/myzhan/goreplay-udp/pipeline"
+	"strings"
+)
+
+// Outputs which can be given their own error policy
+var errorPolicyOutputs = []string{"stdout", "null", "file", "diff", "udp", "http"}
+
+// parseErrorPolicies parses list of [<output>=]<policy>, policy without output is used for the rest of them
+func parseErrorPolicies(options []string) (map[string]string, error) {
+	policies := map[string]string{"": pipeline.ErrorPolicySkip}
+
+	for _, option := range options {
+		name, mode := "", option
+		if i := strings.Index(option, "="); i != -1 {
+			name, mode = option[:i], option[i+1:]
+		}
+
+		if err := pipeline.ValidateErrorPolicy(mode); err != nil {
+			return nil, err
+		}
+
+		known := name == ""
+		for _, o := range errorPolicyOutputs {
+			known = known || name == o
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown output %q in error policy, available: %s", name, strings.Join(errorPolicyOutputs, ", "))
+		}
+
+		policies[name] = mode
+	}
+
+	return policies, nil
+}
+
+func newErrorPolicy(policies map[string]string, name string) *pipeline.ErrorPolicy {
+	mode, ok := policies[name]
+	if !ok {
+		mode = policies[""]
+	}
+
+	return &pipeline.ErrorPolicy{Mode: mode, Retries: Settings.outputErrorRetries, Delay: Settings.outputErrorRetryDelay}
+}
@@ -1,17 +1,19 @@
 package main
 
 import (
+	"context"
 	"flag"
-	"io"
+	"fmt"
+	"github.com/myzhan/goreplay-udp/stats"
 	"log"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 )
 
-var closeCh chan int
-
 func main() {
 
 	// add line number to log
@@ -21,38 +23,75 @@ func main() {
 		flag.Parse()
 	}
 
-	InitPlugins()
+	var errs settingsErrors
+	if Settings.config != "" {
+		errs = append(errs, loadConfig(Settings.config)...)
+	}
+	if errs = append(errs, validateSettings()...); len(errs) > 0 {
+		log.Fatal(errs)
+	}
 
-	if len(Plugins.Inputs) == 0 || len(Plugins.Outputs) == 0 {
-		log.Fatal("Required at least 1 input and 1 output")
+	if Settings.metricsAddress != "" {
+		if err := serveMetrics(Settings.metricsAddress); err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	go func() {
-		<-c
-		finalize()
-		os.Exit(1)
-	}()
+	p, err := InitPlugins()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if Settings.adminAddress != "" {
+		if err = serveAdmin(Settings.adminAddress, p); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
 	if Settings.exitAfter > 0 {
 		log.Println("Running gor for a duration of", Settings.exitAfter)
-		closeCh = make(chan int)
 
 		time.AfterFunc(Settings.exitAfter, func() {
 			log.Println("Stopping gor after", Settings.exitAfter)
-			close(closeCh)
+			cancel()
 		})
 	}
 
-	Start(closeCh)
+	// First signal stops gor gracefully, the second one exits immediately
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		log.Println("Stopping gor, waiting up to", Settings.shutdownTimeout)
+		cancel()
+
+		<-c
+		os.Exit(1)
+	}()
 
+	if err = p.Run(ctx); err != nil {
+		log.Fatal(err)
+	}
 }
 
-func finalize() {
-	for _, p := range Plugins.All {
-		if cp, ok := p.(io.Closer); ok {
-			cp.Close()
-		}
+func serveMetrics(address string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", stats.Metrics)
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("metrics listener failure: %v", err)
 	}
+
+	go func() {
+		log.Println("Serving metrics on", address)
+		if err := http.Serve(listener, mux); err != nil {
+			log.Println("Metrics listener failure:", err)
+		}
+	}()
+
+	return nil
 }
@@ -4,8 +4,9 @@ import (
 	"bufio"
 	"bytes"
 	"compress/gzip"
-	"errors"
+	"fmt"
 	"github.com/myzhan/goreplay-udp/proto"
+	"github.com/myzhan/goreplay-udp/stats"
 	"io"
 	"log"
 	"os"
@@ -21,9 +22,16 @@ type fileInputReader struct {
 	data      []byte
 	file      *os.File
 	timestamp int64
+	path      string
+	gzip      bool
+	binary    bool
 }
 
 func (f *fileInputReader) parseNext() error {
+	if f.binary {
+		return f.parseNextRecord()
+	}
+
 	payloadSeparatorAsBytes := []byte(proto.PayloadSeparator)
 	var buffer bytes.Buffer
 
@@ -59,6 +67,58 @@ func (f *fileInputReader) parseNext() error {
 	return nil
 }
 
+func (f *fileInputReader) parseNextRecord() error {
+	rec, err := proto.ReadRecord(f.reader)
+	if err != nil {
+		if err != io.EOF {
+			log.Println(f.path, err)
+		}
+		f.file.Close()
+		f.file = nil
+		return err
+	}
+
+	f.timestamp = rec.Timestamp
+	f.data = make([]byte, 0, len(rec.Meta)+len(rec.Data))
+	f.data = append(f.data, rec.Meta...)
+	f.data = append(f.data, rec.Data...)
+
+	return nil
+}
+
+// skipTo moves reader to the first payload captured not earlier than timestamp.
+// Binary files are seeked using their sidecar index, if there is one.
+func (f *fileInputReader) skipTo(timestamp int64) {
+	if f.file != nil && f.binary && !f.gzip && f.timestamp < timestamp {
+		if offset, ok := f.seekIndex(timestamp); ok {
+			if _, err := f.file.Seek(offset, io.SeekStart); err == nil {
+				f.reader.Reset(f.file)
+				f.parseNext()
+			}
+		}
+	}
+
+	for f.file != nil && f.timestamp < timestamp {
+		f.parseNext()
+	}
+}
+
+func (f *fileInputReader) seekIndex(timestamp int64) (int64, bool) {
+	index, err := os.Open(f.path + ".idx")
+	if err != nil {
+		return 0, false
+	}
+	defer index.Close()
+
+	entries, err := proto.ReadIndex(bufio.NewReader(index))
+	if err != nil {
+		log.Println("Wrong index file", f.path+".idx", err)
+		return 0, false
+	}
+
+	return proto.SeekIndex(entries, timestamp)
+}
+
 func (f *fileInputReader) ReadPayload() []byte {
 	defer f.parseNext()
 
@@ -80,7 +140,7 @@ func NewFileInputReader(path string) *fileInputReader {
 		return nil
 	}
 
-	r := &fileInputReader{file: file}
+	r := &fileInputReader{file: file, path: path}
 	if strings.HasSuffix(path, ".gz") {
 		gzReader, err := gzip.NewReader(file)
 		if err != nil {
@@ -88,10 +148,20 @@ func NewFileInputReader(path string) *fileInputReader {
 			return nil
 		}
 		r.reader = bufio.NewReader(gzReader)
+		r.gzip = true
 	} else {
 		r.reader = bufio.NewReader(file)
 	}
 
+	// Format is detected by magic bytes
+	if head, _ := r.reader.Peek(proto.BinaryHeaderSize); proto.IsBinary(head) {
+		if _, err := proto.ReadBinaryHeader(r.reader); err != nil {
+			log.Println(path, err)
+			return nil
+		}
+		r.binary = true
+	}
+
 	r.parseNext()
 
 	return r
@@ -102,23 +172,30 @@ type FileInput struct {
 	mu          sync.Mutex
 	data        chan []byte
 	exit        chan bool
+	done        chan bool
+	closeOnce   sync.Once
 	path        string
 	readers     []*fileInputReader
+	speedMu     sync.Mutex
 	SpeedFactor float64
 	loop        bool
+	offset      time.Duration
 }
 
-// NewFileInput constructor for FileInput. Accepts file path as argument.
-func NewFileInput(path string, loop bool) (i *FileInput) {
+// NewFileInput constructor for FileInput. Accepts file path, whether to loop it
+// and duration skipped from the start of capture.
+func NewFileInput(path string, loop bool, offset time.Duration) (i *FileInput, err error) {
 	i = new(FileInput)
 	i.data = make(chan []byte, 1000)
-	i.exit = make(chan bool, 1)
+	i.exit = make(chan bool)
+	i.done = make(chan bool)
 	i.path = path
 	i.SpeedFactor = 1
 	i.loop = loop
+	i.offset = offset
 
-	if err := i.init(); err != nil {
-		return
+	if err = i.init(); err != nil {
+		return nil, err
 	}
 
 	go i.emit()
@@ -139,13 +216,20 @@ func (i *FileInput) init() (err error) {
 	var matches []string
 
 	if matches, err = filepath.Glob(i.path); err != nil {
-		log.Println("Wrong file pattern", i.path, err)
-		return
+		return fmt.Errorf("wrong file pattern %s: %v", i.path, err)
 	}
 
+	// Sidecar indexes of binary files are not payloads
+	files := matches[:0]
+	for _, p := range matches {
+		if !strings.HasSuffix(p, ".idx") {
+			files = append(files, p)
+		}
+	}
+	matches = files
+
 	if len(matches) == 0 {
-		log.Println("No files match pattern: ", i.path)
-		return errors.New("No matching files")
+		return fmt.Errorf("no files match pattern %s", i.path)
 	}
 
 	i.readers = make([]*fileInputReader, len(matches))
@@ -154,17 +238,52 @@ func (i *FileInput) init() (err error) {
 		i.readers[idx] = NewFileInputReader(p)
 	}
 
+	if i.offset > 0 {
+		i.skip()
+	}
+
 	return nil
 }
 
+// skip moves all readers by offset from the earliest payload among them
+func (i *FileInput) skip() {
+	var start int64 = -1
+
+	for _, r := range i.readers {
+		if r != nil && r.file != nil && (start == -1 || r.timestamp < start) {
+			start = r.timestamp
+		}
+	}
+
+	if start == -1 {
+		return
+	}
+
+	for _, r := range i.readers {
+		if r != nil {
+			r.skipTo(start + int64(i.offset))
+		}
+	}
+}
+
 func (i *FileInput) PluginRead() (*proto.Message, error) {
 	var msg proto.Message
-	buf := <-i.data
+	buf, ok := <-i.data
+	if !ok {
+		return nil, io.EOF
+	}
 	msg.Meta, msg.Data = proto.PayloadMetaWithBody(buf)
 
 	return &msg, nil
 }
 
+// RegisterMetrics registers queue length of the plugin
+func (i *FileInput) RegisterMetrics(r *stats.Registry) {
+	r.GaugeFunc("goreplay_udp_queue_length", "Number of messages waiting in plugin queue", func() float64 {
+		return float64(len(i.data))
+	}, "plugin", i.String())
+}
+
 func (i *FileInput) String() string {
 	return "File input: " + i.path
 }
@@ -188,6 +307,9 @@ func (i *FileInput) nextReader() (next *fileInputReader) {
 func (i *FileInput) emit() {
 	var lastTime int64 = -1
 
+	defer close(i.done)
+	defer close(i.data)
+
 	for {
 		select {
 		case <-i.exit:
@@ -211,30 +333,67 @@ func (i *FileInput) emit() {
 			diff := reader.timestamp - lastTime
 			lastTime = reader.timestamp
 
-			if i.SpeedFactor != 1 {
-				diff = int64(float64(diff) / i.SpeedFactor)
+			if speed := i.Speed(); speed != 1 {
+				diff = int64(float64(diff) / speed)
 			}
 
-			time.Sleep(time.Duration(diff))
+			if !i.sleep(time.Duration(diff)) {
+				return
+			}
 		} else {
 			lastTime = reader.timestamp
 		}
 
-		i.data <- reader.ReadPayload()
+		select {
+		case <-i.exit:
+			return
+		case i.data <- reader.ReadPayload():
+		}
 	}
 
 	log.Printf("FileInput: end of file '%s'\n", i.path)
 }
 
-func (i *FileInput) Close() error {
-	defer i.mu.Unlock()
-	i.mu.Lock()
+// Speed returns replay speed factor
+func (i *FileInput) Speed() float64 {
+	i.speedMu.Lock()
+	defer i.speedMu.Unlock()
+	return i.SpeedFactor
+}
 
-	i.exit <- true
+// SetSpeed changes replay speed factor, new speed is used from the next payload
+func (i *FileInput) SetSpeed(speed float64) {
+	i.speedMu.Lock()
+	defer i.speedMu.Unlock()
+	i.SpeedFactor = speed
+}
 
-	for _, r := range i.readers {
-		r.Close()
+// sleep waits for the next payload, returns false if input is closed meanwhile
+func (i *FileInput) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-i.exit:
+		return false
+	case <-timer.C:
+		return true
 	}
+}
+
+// Close stops reading files, payloads not read yet are dropped
+func (i *FileInput) Close() error {
+	i.closeOnce.Do(func() {
+		close(i.exit)
+		<-i.done
+
+		i.mu.Lock()
+		defer i.mu.Unlock()
+
+		for _, r := range i.readers {
+			r.Close()
+		}
+	})
 
 	return nil
 }
@@ -1,19 +1,21 @@
 package input
 
 import (
-	"errors"
+	"fmt"
 	"github.com/google/uuid"
+	"github.com/myzhan/goreplay-udp/listener"
+	"github.com/myzhan/goreplay-udp/output"
 	"github.com/myzhan/goreplay-udp/proto"
 	"io"
 	"log"
 	"net"
 	"net/http"
-	"strings"
 	"time"
 )
 
 // ErrorStopped is the error returned when the go routines reading the input is stopped.
-var ErrorStopped = errors.New("reading stopped")
+// It is the same error outputs return, so pipeline stops copying from both of them the same way.
+var ErrorStopped = output.ErrorStopped
 
 // HTTPInput used for sending requests to Gor via http
 type HTTPInput struct {
@@ -24,12 +26,14 @@ type HTTPInput struct {
 }
 
 // NewHTTPInput constructor for HTTPInput. Accepts address with port which it will listen on.
-func NewHTTPInput(address string) (i *HTTPInput) {
+func NewHTTPInput(address string) (i *HTTPInput, err error) {
 	i = new(HTTPInput)
 	i.data = make(chan *proto.Message, 1000)
 	i.stop = make(chan bool)
 
-	i.listen(address)
+	if err = i.listen(address); err != nil {
+		return nil, err
+	}
 
 	return
 }
@@ -56,41 +60,52 @@ func (i *HTTPInput) handler(w http.ResponseWriter, r *http.Request) {
 
 	var msg proto.Message
 
-	remoteIp := r.Header.Get("X-Real-IP")
-	if len(remoteIp) == 0 {
-		remoteIp = r.RemoteAddr
-		if strings.Contains(remoteIp, ":") {
-			ss := strings.Split(remoteIp, ":")
-			remoteIp = ss[0]
-		}
-	}
-
-	msg.Meta = proto.PayloadHeader(proto.RequestPayload, []byte(uuid.New().String()), time.Now().UnixNano(), []byte(net.ParseIP(remoteIp)))
+	msg.Meta = proto.PayloadHeader(proto.RequestPayload, []byte(uuid.New().String()), time.Now().UnixNano(), remoteIP(r))
 	msg.Data, _ = io.ReadAll(r.Body)
 	//buf, _ := httputil.DumpRequestOut(r, true)
 	http.Error(w, http.StatusText(200), 200)
 	i.data <- &msg
 }
 
-func (i *HTTPInput) listen(address string) {
-	var err error
+// remoteIP returns client address given by X-Real-IP header or the address request came from,
+// IPv4 addresses are 4 bytes long
+func remoteIP(r *http.Request) net.IP {
+	host := r.Header.Get("X-Real-IP")
+	if host == "" {
+		host = r.RemoteAddr
+		if h, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			host = h
+		}
+	}
 
+	// Link-local addresses have zone, which isn't kept in payload header
+	host, _ = listener.SplitZone(host)
+	ip := net.ParseIP(host)
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+func (i *HTTPInput) listen(address string) (err error) {
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("/", i.handler)
 
 	i.listener, err = net.Listen("tcp", address)
 	if err != nil {
-		log.Fatal("HTTP input listener failure:", err)
+		return fmt.Errorf("HTTP input listener failure: %v", err)
 	}
 	i.address = i.listener.Addr().String()
 
 	go func() {
-		err = http.Serve(i.listener, mux)
+		err := http.Serve(i.listener, mux)
 		if err != nil && err != http.ErrServerClosed {
-			log.Fatal("HTTP input serve failure ", err)
+			log.Println("HTTP input serve failure", err)
 		}
 	}()
+
+	return nil
 }
 
 func (i *HTTPInput) String() string {
@@ -0,0 +1,26 @@
+package input
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func TestRemoteIP(t *testing.T) {
+	for remoteAddr, ip := range map[string]string{
+		"10.0.0.5:1234":        "10.0.0.5",
+		"[2001:db8::1]:1234":   "2001:db8::1",
+		"[fe80::1%eth0]:1234":  "fe80::1",
+		"[::ffff:10.0.0.5]:80": "10.0.0.5",
+	} {
+		r := &http.Request{RemoteAddr: remoteAddr, Header: http.Header{}}
+		assert.Equal(t, ip, remoteIP(r).String(), remoteAddr)
+	}
+
+	r := &http.Request{RemoteAddr: "10.0.0.5:1234", Header: http.Header{"X-Real-Ip": {"2001:db8::2"}}}
+	assert.Equal(t, "2001:db8::2", remoteIP(r).String())
+
+	// IPv4 addresses are 4 bytes, so they are written to payload header as IPv4 ones
+	r = &http.Request{RemoteAddr: "[::ffff:10.0.0.5]:80", Header: http.Header{}}
+	assert.Equal(t, 4, len(remoteIP(r)))
+}
@@ -0,0 +1,156 @@
+package input
+
+import (
+	"fmt"
+	"github.com/myzhan/goreplay-udp/listener"
+	"github.com/myzhan/goreplay-udp/proto"
+	"github.com/myzhan/goreplay-udp/stats"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// PcapInput replays UDP traffic from pcap or pcapng capture files, e.g. made by tcpdump
+type PcapInput struct {
+	data        chan *proto.UDPMessage
+	exit        chan bool
+	closeOnce   sync.Once
+	path        string
+	address     string
+	listener    *listener.UDPListener
+	config      *listener.Config
+	speedMu     sync.Mutex
+	SpeedFactor float64
+}
+
+// NewPcapInput constructor for PcapInput. Accepts file path and address used to filter
+// datagrams, in the same format as --input-udp.
+func NewPcapInput(path string, address string, config *listener.Config) (i *PcapInput, err error) {
+	i = new(PcapInput)
+	i.data = make(chan *proto.UDPMessage, 1000)
+	i.exit = make(chan bool)
+	i.path = path
+	i.address = address
+	i.config = config
+	i.SpeedFactor = 1
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("input-pcap: error while parsing address %s: %v", address, err)
+	}
+
+	if i.listener, err = listener.NewUDPFileListener(path, host, port, config); err != nil {
+		return nil, err
+	}
+
+	go i.emit()
+
+	return
+}
+
+// PluginRead reads message from this plugin
+func (i *PcapInput) PluginRead() (*proto.Message, error) {
+	msgUdp, ok := <-i.data
+	if !ok {
+		return nil, io.EOF
+	}
+
+	return udpPayload(msgUdp), nil
+}
+
+// emit sends datagrams keeping the intervals between their capture timestamps
+func (i *PcapInput) emit() {
+	var lastTime int64 = -1
+
+	defer close(i.data)
+
+	ch := i.listener.Receiver()
+	for {
+		var m *proto.UDPMessage
+		var ok bool
+
+		select {
+		case <-i.exit:
+			return
+		case m, ok = <-ch:
+		}
+
+		if !ok {
+			break
+		}
+
+		timestamp := m.Start.UnixNano()
+		if lastTime != -1 {
+			diff := timestamp - lastTime
+			lastTime = timestamp
+
+			if speed := i.Speed(); speed != 1 {
+				diff = int64(float64(diff) / speed)
+			}
+
+			if !i.sleep(time.Duration(diff)) {
+				return
+			}
+		} else {
+			lastTime = timestamp
+		}
+
+		select {
+		case <-i.exit:
+			return
+		case i.data <- m:
+		}
+	}
+
+	log.Printf("PcapInput: end of file '%s'\n", i.path)
+}
+
+// RegisterMetrics registers queue length of the plugin and metrics of its listener
+func (i *PcapInput) RegisterMetrics(r *stats.Registry) {
+	r.GaugeFunc("goreplay_udp_queue_length", "Number of messages waiting in plugin queue", func() float64 {
+		return float64(len(i.data))
+	}, "plugin", i.String())
+	i.listener.RegisterMetrics(r)
+}
+
+func (i *PcapInput) String() string {
+	return "Pcap input: " + i.path
+}
+
+// Speed returns replay speed factor
+func (i *PcapInput) Speed() float64 {
+	i.speedMu.Lock()
+	defer i.speedMu.Unlock()
+	return i.SpeedFactor
+}
+
+// SetSpeed changes replay speed factor, new speed is used from the next payload
+func (i *PcapInput) SetSpeed(speed float64) {
+	i.speedMu.Lock()
+	defer i.speedMu.Unlock()
+	i.SpeedFactor = speed
+}
+
+// sleep waits for the next datagram, returns false if input is closed meanwhile
+func (i *PcapInput) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-i.exit:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// Close stops replaying the capture file, datagrams not read yet are dropped
+func (i *PcapInput) Close() error {
+	i.closeOnce.Do(func() {
+		close(i.exit)
+		i.listener.Close()
+	})
+	return nil
+}
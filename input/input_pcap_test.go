@@ -0,0 +1,123 @@
+package input
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/myzhan/goreplay-udp/listener"
+	"github.com/myzhan/goreplay-udp/proto"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type pcapDatagram struct {
+	src, dst         string
+	srcPort, dstPort uint16
+	payload          string
+	offset           time.Duration
+}
+
+func writePcap(t *testing.T, datagrams []pcapDatagram) string {
+	path := filepath.Join(t.TempDir(), "capture.pcap")
+	f, err := os.Create(path)
+	assert.Nil(t, err)
+	defer f.Close()
+
+	w := pcapgo.NewWriter(f)
+	assert.Nil(t, w.WriteFileHeader(65536, layers.LinkTypeEthernet))
+
+	start := time.Now()
+	for _, d := range datagrams {
+		eth := &layers.Ethernet{
+			SrcMAC:       net.HardwareAddr{0, 0, 0, 0, 0, 1},
+			DstMAC:       net.HardwareAddr{0, 0, 0, 0, 0, 2},
+			EthernetType: layers.EthernetTypeIPv4,
+		}
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.ParseIP(d.src), DstIP: net.ParseIP(d.dst)}
+		udp := &layers.UDP{SrcPort: layers.UDPPort(d.srcPort), DstPort: layers.UDPPort(d.dstPort)}
+		udp.SetNetworkLayerForChecksum(ip)
+
+		buf := gopacket.NewSerializeBuffer()
+		opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+		assert.Nil(t, gopacket.SerializeLayers(buf, opts, eth, ip, udp, gopacket.Payload(d.payload)))
+
+		data := buf.Bytes()
+		ci := gopacket.CaptureInfo{Timestamp: start.Add(d.offset), CaptureLength: len(data), Length: len(data)}
+		assert.Nil(t, w.WritePacket(ci, data))
+	}
+
+	return path
+}
+
+func TestPcapInput(t *testing.T) {
+	path := writePcap(t, []pcapDatagram{
+		{"10.0.0.1", "10.0.0.2", 5000, 53, "request 1", 0},
+		{"10.0.0.2", "10.0.0.1", 53, 5000, "response 1", 10 * time.Millisecond},
+		{"10.0.0.1", "10.0.0.2", 5000, 53, "request 2", 50 * time.Millisecond},
+	})
+
+	input, err := NewPcapInput(path, "10.0.0.2:53", &listener.Config{TrackResponse: true, ResponseWindow: time.Second})
+	assert.Nil(t, err)
+	defer input.Close()
+
+	expected := []struct {
+		payloadType byte
+		data        string
+	}{
+		{proto.RequestPayload, "request 1"},
+		{proto.ResponsePayload, "response 1"},
+		{proto.RequestPayload, "request 2"},
+	}
+
+	var meta [][][]byte
+	start := time.Now()
+	for _, e := range expected {
+		msg, err := input.PluginRead()
+		assert.Nil(t, err)
+		assert.Equal(t, e.payloadType, msg.Meta[0])
+		assert.Equal(t, e.data, string(msg.Data))
+		meta = append(meta, proto.PayloadMeta(msg.Meta))
+	}
+	// Intervals between capture timestamps are kept
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+	// Response carries UUID of its request
+	assert.Equal(t, meta[0][1], meta[1][1])
+	assert.NotEqual(t, meta[0][1], meta[2][1])
+
+	_, err = input.PluginRead()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestPcapInputClose(t *testing.T) {
+	path := writePcap(t, []pcapDatagram{
+		{"10.0.0.1", "10.0.0.2", 5000, 53, "request 1", 0},
+		{"10.0.0.1", "10.0.0.2", 5000, 53, "request 2", time.Hour},
+	})
+
+	input, err := NewPcapInput(path, "10.0.0.2:53", &listener.Config{})
+	assert.Nil(t, err)
+
+	msg, err := input.PluginRead()
+	assert.Nil(t, err)
+	assert.Equal(t, "request 1", string(msg.Data))
+
+	// Closing input stops waiting for the next datagram
+	assert.Nil(t, input.Close())
+	assert.Nil(t, input.Close())
+
+	_, err = input.PluginRead()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestNewPcapInputError(t *testing.T) {
+	_, err := NewPcapInput(filepath.Join(t.TempDir(), "missing.pcap"), "10.0.0.2:53", &listener.Config{})
+	assert.NotNil(t, err)
+
+	_, err = NewPcapInput(writePcap(t, nil), "10.0.0.2", &listener.Config{})
+	assert.NotNil(t, err)
+}
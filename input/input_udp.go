@@ -1,67 +1,124 @@
 package input
 
 import (
+	"fmt"
 	"github.com/myzhan/goreplay-udp/listener"
 	"github.com/myzhan/goreplay-udp/proto"
+	"github.com/myzhan/goreplay-udp/stats"
 	"log"
 	"net"
+	"strconv"
+	"sync"
 )
 
 type UDPInput struct {
-	data          chan *proto.UDPMessage
-	address       string
-	quit          chan bool
-	listener      *listener.UDPListener
-	trackResponse bool
+	data      chan *proto.UDPMessage
+	address   string
+	quit      chan bool
+	closeOnce sync.Once
+	listener  *listener.UDPListener
+	config    *listener.Config
 }
 
-func NewUDPInput(address string, trackResponse bool) (i *UDPInput) {
+func NewUDPInput(address string, config *listener.Config) (i *UDPInput, err error) {
 	i = new(UDPInput)
 	i.data = make(chan *proto.UDPMessage)
 	i.address = address
 	i.quit = make(chan bool)
-	i.trackResponse = trackResponse
-	i.listen(address)
+	i.config = config
+	if err = i.listen(address); err != nil {
+		return nil, err
+	}
 	return
 }
 
 func (i *UDPInput) PluginRead() (*proto.Message, error) {
+	select {
+	case <-i.quit:
+		return nil, ErrorStopped
+	case msgUdp := <-i.data:
+		return udpPayload(msgUdp), nil
+	}
+}
+
+// udpPayload converts captured datagram into message passed between plugins
+func udpPayload(msgUdp *proto.UDPMessage) *proto.Message {
 	var msg proto.Message
-	msgUdp := <-i.data
 	msg.Data = msgUdp.Data()
 
-	if msgUdp.IsIncoming {
-		msg.Meta = proto.PayloadHeader(proto.RequestPayload, msgUdp.UUID(), msgUdp.Start.UnixNano(), msgUdp.SrcIp)
-	} else {
-		msg.Meta = proto.PayloadHeader(proto.ResponsePayload, msgUdp.UUID(), msgUdp.Start.UnixNano(), msgUdp.SrcIp)
+	payloadType := byte(proto.RequestPayload)
+	if !msgUdp.IsIncoming {
+		payloadType = proto.ResponsePayload
+	}
+
+	// Positional fields are followed by the rest of 5-tuple
+	msg.Meta = proto.PayloadHeader(payloadType, msgUdp.UUID(), msgUdp.Start.UnixNano(), msgUdp.SrcIp)
+	msg.Meta = proto.AppendMetaField(msg.Meta, proto.SrcPortField, strconv.Itoa(int(msgUdp.SrcPort)))
+	msg.Meta = proto.AppendMetaField(msg.Meta, proto.DstField, proto.FormatIP(msgUdp.DstIp))
+	msg.Meta = proto.AppendMetaField(msg.Meta, proto.DstPortField, strconv.Itoa(int(msgUdp.DstPort)))
+	if msgUdp.Port != 0 {
+		msg.Meta = proto.AppendMetaField(msg.Meta, proto.PortField, strconv.Itoa(int(msgUdp.Port)))
 	}
-	msgUdp = nil
-	return &msg, nil
+	if msgUdp.Interface != "" {
+		msg.Meta = proto.AppendMetaField(msg.Meta, proto.InterfaceField, msgUdp.Interface)
+	}
+	if msgUdp.Latency > 0 {
+		msg.Meta = proto.AppendMetaField(msg.Meta, proto.LatencyField, strconv.FormatInt(int64(msgUdp.Latency), 10))
+	}
+
+	return &msg
 }
 
-func (i *UDPInput) listen(address string) {
+func (i *UDPInput) listen(address string) error {
 	log.Println("Listening for traffic on: " + address)
 
 	host, port, err := net.SplitHostPort(address)
 
 	if err != nil {
-		log.Fatal("input-raw: error while parsing address", err)
+		return fmt.Errorf("input-raw: error while parsing address %s: %v", address, err)
 	}
 
-	i.listener = listener.NewUDPListener(host, port, i.trackResponse)
+	if i.listener, err = listener.NewUDPListener(host, port, i.config); err != nil {
+		return err
+	}
 
 	ch := i.listener.Receiver()
 
 	go func() {
 		for {
+			// Receiving UDPMessage
+			var m *proto.UDPMessage
 			select {
 			case <-i.quit:
 				return
-			default:
+			case m = <-ch:
+			}
+
+			select {
+			case <-i.quit:
+				return
+			case i.data <- m:
 			}
-			// Receiving UDPMessage
-			m := <-ch
-			i.data <- m
 		}
 	}()
+
+	return nil
+}
+
+// Close stops capturing, datagrams not read yet are dropped
+func (i *UDPInput) Close() error {
+	i.closeOnce.Do(func() {
+		close(i.quit)
+		i.listener.Close()
+	})
+	return nil
+}
+
+// RegisterMetrics registers metrics of the listener
+func (i *UDPInput) RegisterMetrics(r *stats.Registry) {
+	i.listener.RegisterMetrics(r)
+}
+
+func (i *UDPInput) String() string {
+	return "UDP input: " + i.address
 }
@@ -0,0 +1,166 @@
+package listener
+
+import (
+	"encoding/binary"
+	"github.com/myzhan/goreplay-udp/proto"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KeyFunc extracts protocol specific key used to pair response with its request,
+// e.g. DNS transaction ID. Datagrams with nil key are paired by addresses only.
+type KeyFunc func(payload []byte) []byte
+
+var correlationKeys = map[string]KeyFunc{
+	"none": nil,
+	"dns":  dnsKey,
+}
+
+// RegisterCorrelationKey makes protocol key available for --input-udp-response-match
+func RegisterCorrelationKey(name string, fn KeyFunc) {
+	correlationKeys[name] = fn
+}
+
+// CorrelationKeys returns names of registered protocol keys
+func CorrelationKeys() (names []string) {
+	for name := range correlationKeys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// dnsKey uses DNS transaction ID, first 2 bytes of the message
+func dnsKey(payload []byte) []byte {
+	if len(payload) < 2 {
+		return nil
+	}
+	return payload[:2]
+}
+
+type pendingRequest struct {
+	uuid  []byte
+	start time.Time
+}
+
+// Correlator pairs captured responses with requests by 5-tuple and protocol key,
+// so both of them carry the same UUID. Responses which arrive after the window are left unpaired.
+type Correlator struct {
+	mu      sync.Mutex
+	keyFn   KeyFunc
+	window  time.Duration
+	pending map[string][]pendingRequest
+
+	lastSweep time.Time
+}
+
+// NewCorrelator constructor for Correlator, accepts name of protocol key and pairing window
+func NewCorrelator(match string, window time.Duration) (*Correlator, bool) {
+	if match == "" {
+		match = "none"
+	}
+
+	keyFn, ok := correlationKeys[strings.ToLower(match)]
+	if !ok {
+		return nil, false
+	}
+
+	c := new(Correlator)
+	c.keyFn = keyFn
+	c.window = window
+	c.pending = make(map[string][]pendingRequest)
+
+	return c, true
+}
+
+func (c *Correlator) key(srcIP, dstIP []byte, srcPort, dstPort uint16, payload []byte) string {
+	key := make([]byte, 0, len(srcIP)+len(dstIP)+8)
+	key = append(key, srcIP...)
+	key = binary.BigEndian.AppendUint16(key, srcPort)
+	key = append(key, dstIP...)
+	key = binary.BigEndian.AppendUint16(key, dstPort)
+
+	if c.keyFn != nil {
+		key = append(key, c.keyFn(payload)...)
+	}
+
+	return string(key)
+}
+
+// Request remembers captured request, responses sent back to its source are paired with it
+func (c *Correlator) Request(m *proto.UDPMessage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.sweep(m.Start)
+
+	key := c.key(m.SrcIp, m.DstIp, m.SrcPort, m.DstPort, m.Data())
+	c.pending[key] = append(c.pending[key], pendingRequest{m.UUID(), m.Start})
+}
+
+// Response looks for the oldest pending request of the same flow and copies its UUID and latency to the response
+func (c *Correlator) Response(m *proto.UDPMessage) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.sweep(m.Start)
+
+	key := c.key(m.DstIp, m.SrcIp, m.DstPort, m.SrcPort, m.Data())
+	requests := c.pending[key]
+
+	for len(requests) > 0 {
+		req := requests[0]
+		requests = requests[1:]
+
+		if m.Start.Sub(req.start) > c.window {
+			continue
+		}
+
+		m.SetUUID(req.uuid)
+		m.Latency = m.Start.Sub(req.start)
+
+		c.store(key, requests)
+		return true
+	}
+
+	c.store(key, requests)
+	return false
+}
+
+func (c *Correlator) store(key string, requests []pendingRequest) {
+	if len(requests) == 0 {
+		delete(c.pending, key)
+	} else {
+		c.pending[key] = requests
+	}
+}
+
+// sweep drops requests which have not been answered within the window.
+// Capture timestamps are used instead of wall clock, so offline captures are paired the same way.
+func (c *Correlator) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < c.window {
+		return
+	}
+	c.lastSweep = now
+
+	for key, requests := range c.pending {
+		i := 0
+		for i < len(requests) && now.Sub(requests[i].start) > c.window {
+			i++
+		}
+		c.store(key, requests[i:])
+	}
+}
+
+// Pending returns number of requests waiting for response
+func (c *Correlator) Pending() (n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, requests := range c.pending {
+		n += len(requests)
+	}
+	return
+}
@@ -0,0 +1,126 @@
+package listener
+
+import (
+	"encoding/binary"
+	"github.com/myzhan/goreplay-udp/proto"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+var (
+	clientIP = net.ParseIP("10.0.0.1").To4()
+	serverIP = net.ParseIP("10.0.0.53").To4()
+)
+
+// datagram builds UDP message captured at given time, with its own UUID
+func datagram(src, dst net.IP, srcPort, dstPort uint16, payload string, at time.Time, uuid string) *proto.UDPMessage {
+	data := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint16(data, srcPort)
+	binary.BigEndian.PutUint16(data[2:], dstPort)
+	binary.BigEndian.PutUint16(data[4:], uint16(8+len(payload)))
+	data = append(data, payload...)
+
+	m := proto.NewUDPMessage(data, src, dst, false)
+	m.Start = at
+	m.SetUUID([]byte(uuid))
+	return m
+}
+
+func request(payload string, at time.Time, uuid string) *proto.UDPMessage {
+	return datagram(clientIP, serverIP, 1024, 53, payload, at, uuid)
+}
+
+func response(payload string, at time.Time) *proto.UDPMessage {
+	return datagram(serverIP, clientIP, 53, 1024, payload, at, "response")
+}
+
+func TestCorrelatorMatch(t *testing.T) {
+	c, ok := NewCorrelator("", time.Second)
+	assert.True(t, ok)
+	start := time.Unix(1000, 0)
+
+	c.Request(request("q", start, "a"))
+	assert.Equal(t, 1, c.Pending())
+
+	// Response of other flow is not paired
+	other := datagram(serverIP, clientIP, 53, 1025, "r", start, "response")
+	assert.False(t, c.Response(other))
+
+	r := response("r", start.Add(20*time.Millisecond))
+	assert.True(t, c.Response(r))
+	assert.Equal(t, "a", string(r.UUID()))
+	assert.Equal(t, 20*time.Millisecond, r.Latency)
+	assert.Equal(t, 0, c.Pending())
+
+	// Request is answered once
+	assert.False(t, c.Response(response("r", start.Add(30*time.Millisecond))))
+}
+
+func TestCorrelatorExpiry(t *testing.T) {
+	c, _ := NewCorrelator("", time.Second)
+	start := time.Unix(1000, 0)
+
+	c.Request(request("q", start, "a"))
+	assert.False(t, c.Response(response("r", start.Add(1500*time.Millisecond))))
+	assert.Equal(t, 0, c.Pending())
+
+	// Requests not answered within the window are swept by later traffic
+	c.Request(request("q", start.Add(2*time.Second), "b"))
+	c.Request(request("q", start.Add(5*time.Second), "c"))
+	assert.Equal(t, 1, c.Pending())
+
+	r := response("r", start.Add(5500*time.Millisecond))
+	assert.True(t, c.Response(r))
+	assert.Equal(t, "c", string(r.UUID()))
+}
+
+func TestCorrelatorDuplicateKeys(t *testing.T) {
+	c, _ := NewCorrelator("none", time.Second)
+	start := time.Unix(1000, 0)
+
+	// Requests of the same flow are answered in order
+	for i, uuid := range []string{"a", "b", "c"} {
+		c.Request(request("q", start.Add(time.Duration(i)*time.Millisecond), uuid))
+	}
+	assert.Equal(t, 3, c.Pending())
+
+	for _, uuid := range []string{"a", "b", "c"} {
+		r := response("r", start.Add(10*time.Millisecond))
+		assert.True(t, c.Response(r))
+		assert.Equal(t, uuid, string(r.UUID()))
+	}
+	assert.Equal(t, 0, c.Pending())
+}
+
+func TestCorrelatorDNSKey(t *testing.T) {
+	c, ok := NewCorrelator("DNS", time.Second)
+	assert.True(t, ok)
+	start := time.Unix(1000, 0)
+
+	// Responses are paired by transaction ID, whatever order they come in
+	c.Request(request("\x00\x01query", start, "a"))
+	c.Request(request("\x00\x02query", start, "b"))
+
+	r := response("\x00\x02answer", start.Add(time.Millisecond))
+	assert.True(t, c.Response(r))
+	assert.Equal(t, "b", string(r.UUID()))
+
+	assert.False(t, c.Response(response("\x00\x03answer", start.Add(time.Millisecond))))
+
+	r = response("\x00\x01answer", start.Add(time.Millisecond))
+	assert.True(t, c.Response(r))
+	assert.Equal(t, "a", string(r.UUID()))
+
+	assert.Nil(t, dnsKey([]byte{1}))
+}
+
+func TestNewCorrelatorUnknownKey(t *testing.T) {
+	c, ok := NewCorrelator("sip", time.Second)
+	assert.False(t, ok)
+	assert.Nil(t, c)
+
+	assert.Contains(t, CorrelationKeys(), "dns")
+	assert.Contains(t, CorrelationKeys(), "none")
+}
@@ -0,0 +1,187 @@
+package listener
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Largest datagram which can be reassembled, bigger ones can't carry UDP
+const maxDatagramSize = 65535
+
+type fragmentKey struct {
+	src, dst string
+	id       uint32
+	protocol uint8
+}
+
+type fragment struct {
+	offset int
+	data   []byte
+}
+
+type fragmentList struct {
+	fragments []fragment
+	// Datagram length, known once the last fragment is seen
+	total int
+	// End of the furthest fragment received
+	end       int
+	size      int
+	firstSeen time.Time
+}
+
+// complete returns reassembled datagram once fragments cover it without gaps
+func (f *fragmentList) complete() []byte {
+	if f.total < 0 {
+		return nil
+	}
+
+	sort.Slice(f.fragments, func(i, j int) bool {
+		return f.fragments[i].offset < f.fragments[j].offset
+	})
+
+	covered := 0
+	for _, fr := range f.fragments {
+		if fr.offset > covered {
+			return nil
+		}
+		if end := fr.offset + len(fr.data); end > covered {
+			covered = end
+		}
+	}
+
+	if covered < f.total {
+		return nil
+	}
+
+	datagram := make([]byte, f.total)
+	for _, fr := range f.fragments {
+		if fr.offset < f.total {
+			copy(datagram[fr.offset:], fr.data)
+		}
+	}
+
+	return datagram
+}
+
+// Defragmenter reassembles fragmented IPv4 and IPv6 datagrams.
+// Incomplete datagrams are dropped after timeout, or oldest first when fragments exceed memory limit.
+type Defragmenter struct {
+	mu       sync.Mutex
+	timeout  time.Duration
+	maxBytes int
+	bytes    int
+	lists    map[fragmentKey]*fragmentList
+
+	lastSweep time.Time
+	dropped   int64
+}
+
+// NewDefragmenter constructor for Defragmenter, accepts timeout and memory limit for pending fragments
+func NewDefragmenter(timeout time.Duration, maxBytes int) *Defragmenter {
+	d := new(Defragmenter)
+	d.timeout = timeout
+	d.maxBytes = maxBytes
+	d.lists = make(map[fragmentKey]*fragmentList)
+
+	return d
+}
+
+// Fragment stores fragment of datagram and returns the whole datagram once all fragments are received.
+// Offset is in bytes, more is false for the last fragment. Packet timestamps are used as a clock.
+func (d *Defragmenter) Fragment(key fragmentKey, offset int, more bool, data []byte, timestamp time.Time) []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.sweep(timestamp)
+
+	if offset+len(data) > maxDatagramSize || (d.maxBytes > 0 && len(data) > d.maxBytes) {
+		d.drop(key)
+		return nil
+	}
+
+	for d.maxBytes > 0 && d.bytes+len(data) > d.maxBytes {
+		d.dropOldest()
+	}
+
+	list, ok := d.lists[key]
+	if !ok {
+		list = &fragmentList{total: -1, firstSeen: timestamp}
+		d.lists[key] = list
+	}
+
+	// Fragments past the end of datagram or disagreeing on its length can't be reassembled
+	end := offset + len(data)
+	if list.total >= 0 && (end > list.total || !more && end != list.total) || !more && list.end > end {
+		d.drop(key)
+		return nil
+	}
+
+	// Fragment data may point to reused capture buffer
+	buf := make([]byte, len(data))
+	copy(buf, data)
+	list.fragments = append(list.fragments, fragment{offset, buf})
+	list.size += len(buf)
+	d.bytes += len(buf)
+
+	if end > list.end {
+		list.end = end
+	}
+	if !more {
+		list.total = end
+	}
+
+	datagram := list.complete()
+	if datagram != nil {
+		d.bytes -= list.size
+		delete(d.lists, key)
+	}
+
+	return datagram
+}
+
+func (d *Defragmenter) drop(key fragmentKey) {
+	if list, ok := d.lists[key]; ok {
+		d.bytes -= list.size
+		delete(d.lists, key)
+		d.dropped++
+	}
+}
+
+func (d *Defragmenter) dropOldest() {
+	var oldest fragmentKey
+	var oldestTime time.Time
+
+	found := false
+	for key, list := range d.lists {
+		if !found || list.firstSeen.Before(oldestTime) {
+			oldest, oldestTime = key, list.firstSeen
+			found = true
+		}
+	}
+
+	if found {
+		d.drop(oldest)
+	}
+}
+
+func (d *Defragmenter) sweep(now time.Time) {
+	if now.Sub(d.lastSweep) < d.timeout {
+		return
+	}
+	d.lastSweep = now
+
+	for key, list := range d.lists {
+		if now.Sub(list.firstSeen) > d.timeout {
+			d.drop(key)
+		}
+	}
+}
+
+// Dropped returns number of incomplete datagrams dropped because of timeout or memory limit
+func (d *Defragmenter) Dropped() int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.dropped
+}
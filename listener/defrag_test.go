@@ -0,0 +1,122 @@
+package listener
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestDefragOutOfOrder(t *testing.T) {
+	d := NewDefragmenter(time.Second, 0)
+	key := fragmentKey{src: "10.0.0.1", dst: "10.0.0.2", id: 1, protocol: 17}
+	now := time.Unix(1000, 0)
+
+	// Last fragment first, then the rest in reverse order
+	assert.Nil(t, d.Fragment(key, 16, false, []byte("cccc"), now))
+	assert.Nil(t, d.Fragment(key, 8, true, []byte("bbbbbbbb"), now))
+	assert.Equal(t, "aaaaaaaabbbbbbbbcccc", string(d.Fragment(key, 0, true, []byte("aaaaaaaa"), now)))
+
+	assert.Equal(t, 0, len(d.lists))
+	assert.Equal(t, 0, d.bytes)
+
+	// Fragments of other datagram with the same ID are not mixed in
+	other := key
+	other.src = "10.0.0.3"
+	assert.Nil(t, d.Fragment(key, 0, true, []byte("aaaaaaaa"), now))
+	assert.Nil(t, d.Fragment(other, 8, false, []byte("xx"), now))
+	assert.Equal(t, "aaaaaaaayy", string(d.Fragment(key, 8, false, []byte("yy"), now)))
+	assert.Equal(t, 1, len(d.lists))
+}
+
+func TestDefragOverlapping(t *testing.T) {
+	d := NewDefragmenter(time.Second, 0)
+	key := fragmentKey{src: "10.0.0.1", dst: "10.0.0.2", id: 2, protocol: 17}
+	now := time.Unix(1000, 0)
+
+	// Retransmitted fragments overlap already received ones
+	assert.Nil(t, d.Fragment(key, 0, true, []byte("aaaaaaaabbbb"), now))
+	assert.Nil(t, d.Fragment(key, 0, true, []byte("aaaaaaaabbbb"), now))
+	assert.Nil(t, d.Fragment(key, 16, false, []byte("cccc"), now))
+
+	// Gap is not filled yet
+	assert.Nil(t, d.Fragment(key, 16, false, []byte("cccc"), now))
+	assert.Equal(t, "aaaaaaaabbbbbbbbcccc", string(d.Fragment(key, 8, true, []byte("bbbbbbbbcccc"), now)))
+	assert.Equal(t, 0, d.bytes)
+}
+
+func TestDefragTimeout(t *testing.T) {
+	d := NewDefragmenter(time.Second, 0)
+	key := fragmentKey{src: "10.0.0.1", dst: "10.0.0.2", id: 3, protocol: 17}
+	now := time.Unix(1000, 0)
+
+	assert.Nil(t, d.Fragment(key, 0, true, []byte("aaaaaaaa"), now))
+
+	// Incomplete datagram is dropped once timeout passes, late fragment starts new one
+	assert.Nil(t, d.Fragment(key, 8, false, []byte("bb"), now.Add(2*time.Second)))
+	assert.Equal(t, int64(1), d.Dropped())
+	assert.Equal(t, 1, len(d.lists))
+	assert.Equal(t, 2, d.bytes)
+
+	// Within timeout it is completed
+	assert.Equal(t, "aaaaaaaabb", string(d.Fragment(key, 0, true, []byte("aaaaaaaa"), now.Add(2500*time.Millisecond))))
+	assert.Equal(t, int64(1), d.Dropped())
+}
+
+func TestDefragMaxBytes(t *testing.T) {
+	d := NewDefragmenter(time.Minute, 20)
+	now := time.Unix(1000, 0)
+
+	first := fragmentKey{src: "10.0.0.1", dst: "10.0.0.2", id: 4, protocol: 17}
+	second := fragmentKey{src: "10.0.0.1", dst: "10.0.0.2", id: 5, protocol: 17}
+
+	assert.Nil(t, d.Fragment(first, 0, true, []byte("aaaaaaaaaaaa"), now))
+	assert.Nil(t, d.Fragment(second, 0, true, []byte("bbbbbbbb"), now.Add(time.Millisecond)))
+	assert.Equal(t, 20, d.bytes)
+
+	// Oldest datagram is dropped to make room
+	assert.Nil(t, d.Fragment(second, 16, false, []byte("cccc"), now.Add(2*time.Millisecond)))
+	assert.Equal(t, int64(1), d.Dropped())
+	assert.Equal(t, 12, d.bytes)
+	assert.Equal(t, "bbbbbbbbddddddddcccc", string(d.Fragment(second, 8, true, []byte("dddddddd"), now.Add(3*time.Millisecond))))
+
+	// Fragment bigger than the whole limit can't be stored, its datagram is dropped
+	assert.Nil(t, d.Fragment(first, 0, true, []byte("aaaaaaaa"), now))
+	assert.Nil(t, d.Fragment(first, 8, true, make([]byte, 24), now))
+	assert.Equal(t, int64(2), d.Dropped())
+	assert.Equal(t, 0, d.bytes)
+
+	// As well as fragment past the largest datagram
+	assert.Nil(t, d.Fragment(first, maxDatagramSize-4, false, make([]byte, 8), now))
+	assert.Equal(t, 0, len(d.lists))
+}
+
+func TestDefragInconsistentLength(t *testing.T) {
+	d := NewDefragmenter(time.Second, 0)
+	key := fragmentKey{src: "10.0.0.1", dst: "10.0.0.2", id: 6, protocol: 17}
+	now := time.Unix(1000, 0)
+
+	// Last fragment ends before data already received
+	assert.Nil(t, d.Fragment(key, 0, true, make([]byte, 32), now))
+	assert.Nil(t, d.Fragment(key, 24, true, make([]byte, 8), now))
+	assert.Nil(t, d.Fragment(key, 8, false, make([]byte, 8), now))
+	assert.Equal(t, int64(1), d.Dropped())
+	assert.Equal(t, 0, len(d.lists))
+	assert.Equal(t, 0, d.bytes)
+
+	// Fragment past the end of datagram
+	assert.Nil(t, d.Fragment(key, 8, false, []byte("bbbb"), now))
+	assert.Nil(t, d.Fragment(key, 8, true, make([]byte, 8), now))
+	assert.Equal(t, int64(2), d.Dropped())
+	assert.Equal(t, 0, len(d.lists))
+
+	// Second last fragment with other length
+	assert.Nil(t, d.Fragment(key, 8, false, []byte("bbbb"), now))
+	assert.Nil(t, d.Fragment(key, 16, false, []byte("cccc"), now))
+	assert.Equal(t, int64(3), d.Dropped())
+
+	// The same last fragment retransmitted is fine
+	assert.Nil(t, d.Fragment(key, 8, false, []byte("bbbb"), now))
+	assert.Nil(t, d.Fragment(key, 8, false, []byte("bbbb"), now))
+	assert.Equal(t, "aaaaaaaabbbb", string(d.Fragment(key, 0, true, []byte("aaaaaaaa"), now)))
+	assert.Equal(t, int64(3), d.Dropped())
+}
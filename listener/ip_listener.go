@@ -1,13 +1,15 @@
 package listener
 
 import (
+	"fmt"
 	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
+	"github.com/myzhan/goreplay-udp/stats"
 	"io"
 	"log"
 	"net"
 	"runtime"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -18,6 +20,7 @@ type ipPacket struct {
 	dstIP     []byte
 	payload   []byte
 	timestamp time.Time
+	device    string
 }
 
 type IPListener struct {
@@ -25,29 +28,69 @@ type IPListener struct {
 
 	// IP to listen
 	addr string
-	// Port to listen
-	port uint16
+	// Ports to listen
+	ports Ports
+	// Extra BPF expression ANDed into generated filter
+	bpf string
+	// Capture file to read instead of live interfaces
+	file string
 
 	trackResponse bool
 
 	pcapHandles []*pcap.Handle
+	defrag      *Defragmenter
+
+	// Handles of live capture get their metrics in registry once it is known
+	metrics *stats.Registry
+	devices map[*pcap.Handle]string
 
 	ipPacketsChan chan *ipPacket
 
-	readyChan chan bool
+	// Gets nil once capture is started, or error why it can't be
+	readyChan chan error
 }
 
-func NewIPListener(addr string, port uint16, trackResponse bool) (l *IPListener) {
+// NewIPListener captures packets on interfaces with given address, returns error if none of them can be opened
+func NewIPListener(addr string, ports Ports, config *Config) (l *IPListener, err error) {
 	l = &IPListener{}
 	l.ipPacketsChan = make(chan *ipPacket, 10000)
 
-	l.readyChan = make(chan bool, 1)
+	l.readyChan = make(chan error, 1)
 	l.addr = addr
-	l.port = port
-	l.trackResponse = trackResponse
+	l.ports = ports
+	l.bpf = config.BPF
+	l.trackResponse = config.TrackResponse
+	l.defrag = NewDefragmenter(config.DefragTimeout, config.DefragMaxBytes)
+	l.devices = make(map[*pcap.Handle]string)
 
 	go l.readPcap()
 
+	if err = l.ready(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// NewIPFileListener reads packets from pcap or pcapng file instead of network interfaces.
+// Receiver channel is closed once the whole file is read.
+func NewIPFileListener(path string, addr string, ports Ports, config *Config) (l *IPListener, err error) {
+	l = &IPListener{}
+	l.ipPacketsChan = make(chan *ipPacket, 10000)
+
+	l.readyChan = make(chan error, 1)
+	l.file = path
+	l.addr = addr
+	l.ports = ports
+	l.bpf = config.BPF
+	l.trackResponse = config.TrackResponse
+	l.defrag = NewDefragmenter(config.DefragTimeout, config.DefragMaxBytes)
+	l.devices = make(map[*pcap.Handle]string)
+
+	go l.readPcapFile()
+
+	if err = l.ready(); err != nil {
+		return nil, err
+	}
 	return
 }
 
@@ -78,14 +121,12 @@ func (e *DeviceNotFoundError) Error() string {
 	return msg
 }
 
+// isLoopback reports if any address of the device is loopback one, addresses are listed in no particular order
 func isLoopback(device pcap.Interface) bool {
-	if len(device.Addresses) == 0 {
-		return false
-	}
-
-	switch device.Addresses[0].IP.String() {
-	case "127.0.0.1", "::1":
-		return true
+	for _, address := range device.Addresses {
+		if address.IP.IsLoopback() {
+			return true
+		}
 	}
 
 	return false
@@ -100,20 +141,34 @@ func listenAllInterfaces(addr string) bool {
 	}
 }
 
+// SplitZone splits zone of IPv6 link-local address like fe80::1%eth0, which names interface of the address
+func SplitZone(addr string) (host, zone string) {
+	if i := strings.LastIndex(addr, "%"); i != -1 {
+		return addr[:i], addr[i+1:]
+	}
+	return addr, ""
+}
+
 func findPcapDevices(addr string) (interfaces []pcap.Interface, err error) {
 	devices, err := pcap.FindAllDevs()
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
+	host, zone := SplitZone(addr)
+	ip := net.ParseIP(host)
+
 	for _, device := range devices {
 		if listenAllInterfaces(addr) && len(device.Addresses) > 0 || isLoopback(device) {
 			interfaces = append(interfaces, device)
 			continue
 		}
+		if zone != "" && device.Name != zone {
+			continue
+		}
 
 		for _, address := range device.Addresses {
-			if device.Name == addr || address.IP.String() == addr {
+			if device.Name == addr || ip != nil && ip.Equal(address.IP) {
 				interfaces = append(interfaces, device)
 				return interfaces, nil
 			}
@@ -127,19 +182,33 @@ func findPcapDevices(addr string) (interfaces []pcap.Interface, err error) {
 	return interfaces, nil
 }
 
-func (l *IPListener) buildPacket(srcIP []byte, dstIP []byte, payload []byte, timestamp time.Time) *ipPacket {
+// hostFilter builds BPF expression matching any of addresses, direction is "src" or "dst".
+// Addresses are formatted without zone, which BPF doesn't accept.
+func hostFilter(direction string, ips []net.IP) string {
+	items := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		if ip != nil {
+			items = append(items, direction+" host "+ip.String())
+		}
+	}
+	return strings.Join(items, " or ")
+}
+
+func (l *IPListener) buildPacket(srcIP []byte, dstIP []byte, payload []byte, timestamp time.Time, device string) *ipPacket {
 	return &ipPacket{
 		srcIP:     srcIP,
 		dstIP:     dstIP,
 		payload:   payload,
 		timestamp: timestamp,
+		device:    device,
 	}
 }
 
 func (l *IPListener) readPcap() {
 	devices, err := findPcapDevices(l.addr)
 	if err != nil {
-		log.Fatal(err)
+		l.readyChan <- err
+		return
 	}
 
 	bpfSupported := true
@@ -147,7 +216,13 @@ func (l *IPListener) readPcap() {
 		bpfSupported = false
 	}
 
+	if !bpfSupported && l.bpf != "" {
+		log.Println("BPF filters are not supported on", runtime.GOOS, "filter is ignored:", l.bpf)
+	}
+
 	var wg sync.WaitGroup
+	var opened int
+	var bpfErr error
 	wg.Add(len(devices))
 	for _, d := range devices {
 		go func(device pcap.Interface) {
@@ -175,46 +250,45 @@ func (l *IPListener) readPcap() {
 				return
 			}
 
-			defer handle.Close()
+			defer l.closeHandle(handle)
 			l.mu.Lock()
 			l.pcapHandles = append(l.pcapHandles, handle)
+			l.devices[handle] = device.Name
+			if l.metrics != nil {
+				l.registerHandleMetrics(handle, device.Name)
+			}
 
 			var bpfDstHost, bpfSrcHost string
-			var loopback = isLoopback(device)
 
-			if loopback {
+			if isLoopback(device) {
+				// Traffic between local addresses of both families goes through loopback
 				var allAddr []string
 				for _, dc := range devices {
 					for _, addr := range dc.Addresses {
-						allAddr = append(allAddr, "(dst host "+addr.IP.String()+" and src host "+addr.IP.String()+")")
+						if addr.IP != nil {
+							allAddr = append(allAddr, "("+hostFilter("dst", []net.IP{addr.IP})+" and "+hostFilter("src", []net.IP{addr.IP})+")")
+						}
 					}
 				}
 
 				bpfDstHost = strings.Join(allAddr, " or ")
 				bpfSrcHost = bpfDstHost
 			} else {
-				for i, addr := range device.Addresses {
-					bpfDstHost += "dst host " + addr.IP.String()
-					bpfSrcHost += "src host " + addr.IP.String()
-					if i != len(device.Addresses)-1 {
-						bpfDstHost += " or "
-						bpfSrcHost += " or "
-					}
+				var ips []net.IP
+				for _, addr := range device.Addresses {
+					ips = append(ips, addr.IP)
 				}
+				bpfDstHost = hostFilter("dst", ips)
+				bpfSrcHost = hostFilter("src", ips)
 			}
 
 			if bpfSupported {
-
-				var bpf string
-
-				if l.trackResponse {
-					bpf = "(udp dst port " + strconv.Itoa(int(l.port)) + " and (" + bpfDstHost + ")) or (" + "udp src port " + strconv.Itoa(int(l.port)) + " and (" + bpfSrcHost + "))"
-				} else {
-					bpf = "udp dst port " + strconv.Itoa(int(l.port)) + " and (" + bpfDstHost + ")"
-				}
+				bpf := udpFilter(l.ports, bpfDstHost, bpfSrcHost, l.trackResponse, l.bpf)
 
 				if err := handle.SetBPFFilter(bpf); err != nil {
 					log.Println("BPF filter error:", err, "Device:", device.Name, bpf)
+					bpfErr = fmt.Errorf("BPF filter error: %v, filter: %s", err, bpf)
+					l.mu.Unlock()
 					wg.Done()
 					return
 				}
@@ -222,6 +296,7 @@ func (l *IPListener) readPcap() {
 
 			// TODO: !bpfSupported
 
+			opened++
 			l.mu.Unlock()
 
 			source := gopacket.NewPacketSource(handle, handle.LinkType())
@@ -230,36 +305,270 @@ func (l *IPListener) readPcap() {
 
 			wg.Done()
 
-			for {
-				packet, err := source.NextPacket()
-				if err == io.EOF {
-					break
-				} else if err != nil {
-					log.Println("NextPacket error:", err)
-					continue
-				}
+			l.readPackets(source, device.Name)
+		}(d)
+	}
+	wg.Wait()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if opened == 0 && bpfErr != nil {
+		l.readyChan <- bpfErr
+		return
+	}
+	if opened == 0 {
+		l.readyChan <- fmt.Errorf("can't capture on any interface with addr %q", l.addr)
+		return
+	}
+	l.readyChan <- nil
+}
+
+func (l *IPListener) readPcapFile() {
+	handle, err := pcap.OpenOffline(l.file)
+	if err != nil {
+		l.readyChan <- fmt.Errorf("can't open pcap file %s: %v", l.file, err)
+		return
+	}
+	defer l.closeHandle(handle)
+
+	var bpfDstHost, bpfSrcHost string
+	if !listenAllInterfaces(l.addr) {
+		host, _ := SplitZone(l.addr)
+		if ip := net.ParseIP(host); ip != nil {
+			bpfDstHost = hostFilter("dst", []net.IP{ip})
+			bpfSrcHost = hostFilter("src", []net.IP{ip})
+		} else {
+			// Host names are resolved by pcap
+			bpfDstHost = "dst host " + host
+			bpfSrcHost = "src host " + host
+		}
+	}
+
+	bpf := udpFilter(l.ports, bpfDstHost, bpfSrcHost, l.trackResponse, l.bpf)
+	if err := handle.SetBPFFilter(bpf); err != nil {
+		l.readyChan <- fmt.Errorf("BPF filter error: %v, file: %s, filter: %s", err, l.file, bpf)
+		return
+	}
 
-				networkLayer := packet.NetworkLayer()
+	l.mu.Lock()
+	l.pcapHandles = append(l.pcapHandles, handle)
+	l.mu.Unlock()
 
-				srcIP := networkLayer.NetworkFlow().Src().Raw()
-				dstIP := networkLayer.NetworkFlow().Dst().Raw()
-				payload := networkLayer.LayerPayload()
+	source := gopacket.NewPacketSource(handle, handle.LinkType())
+	source.Lazy = true
+	// Packets are buffered far ahead of replay, so they can't share the read buffer
+	source.NoCopy = false
 
-				l.ipPacketsChan <- l.buildPacket(srcIP, dstIP, payload, packet.Metadata().Timestamp)
+	l.readyChan <- nil
+
+	// Capture file doesn't tell which interface packets came from
+	l.readPackets(source, "")
+	close(l.ipPacketsChan)
+}
+
+func (l *IPListener) readPackets(source *gopacket.PacketSource, device string) {
+	for {
+		packet, err := source.NextPacket()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			log.Println("NextPacket error:", err)
+			continue
+		}
+
+		networkLayer := packet.NetworkLayer()
+		if networkLayer == nil {
+			continue
+		}
+
+		srcIP := networkLayer.NetworkFlow().Src().Raw()
+		dstIP := networkLayer.NetworkFlow().Dst().Raw()
+		payload := l.defragment(packet, networkLayer)
+		if payload == nil {
+			continue
+		}
+
+		l.ipPacketsChan <- l.buildPacket(srcIP, dstIP, payload, packet.Metadata().Timestamp, device)
+	}
+}
+
+// defragment returns UDP datagram carried by the packet, reassembling it if the packet is a fragment.
+// Nil is returned until all fragments of the datagram are received.
+func (l *IPListener) defragment(packet gopacket.Packet, networkLayer gopacket.NetworkLayer) []byte {
+	timestamp := packet.Metadata().Timestamp
+
+	switch ip := networkLayer.(type) {
+	case *layers.IPv4:
+		more := ip.Flags&layers.IPv4MoreFragments != 0
+		if !more && ip.FragOffset == 0 {
+			return ip.Payload
+		}
+		if ip.Protocol != layers.IPProtocolUDP {
+			return nil
+		}
+
+		key := fragmentKey{string(ip.SrcIP), string(ip.DstIP), uint32(ip.Id), uint8(ip.Protocol)}
+		return l.defrag.Fragment(key, int(ip.FragOffset)*8, more, ip.Payload, timestamp)
+	case *layers.IPv6:
+		frag, ok := packet.Layer(layers.LayerTypeIPv6Fragment).(*layers.IPv6Fragment)
+		if !ok {
+			return ipv6Payload(packet, ip)
+		}
+		if frag.NextHeader != layers.IPProtocolUDP {
+			return nil
+		}
+
+		key := fragmentKey{string(ip.SrcIP), string(ip.DstIP), frag.Identification, uint8(frag.NextHeader)}
+		return l.defrag.Fragment(key, int(frag.FragmentOffset)*8, frag.MoreFragments, frag.Payload, timestamp)
+	}
+
+	return networkLayer.LayerPayload()
+}
+
+// ipv6Payload returns UDP datagram of not fragmented packet, skipping extension headers
+func ipv6Payload(packet gopacket.Packet, ip *layers.IPv6) []byte {
+	if ip.NextHeader == layers.IPProtocolUDP {
+		return ip.Payload
+	}
+
+	udp, ok := packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	if !ok {
+		return ip.Payload
+	}
+	return append(append([]byte(nil), udp.Contents...), udp.Payload...)
+}
+
+// Matches IPv4 fragments after the first one, which have no UDP header, and all IPv6 fragments
+const bpfFragments = "((ip[6:2] & 0x1fff != 0) or (ip6 and ip6[6] == 44))"
+
+// udpFilter builds BPF expression for requests to the ports and, when tracking responses,
+// for replies from them. Fragments between the same hosts pass as well, ports are checked after reassembly.
+// Empty host expression matches any host, extra expression is ANDed into the whole filter.
+func udpFilter(ports Ports, dstHost, srcHost string, trackResponse bool, extra string) string {
+	req := "(" + ports.filter("dst") + ")"
+	frag := bpfFragments
+	if dstHost != "" {
+		req += " and (" + dstHost + ")"
+		frag += " and (" + dstHost + ")"
+	}
+
+	filter := "(" + req + ") or (" + frag + ")"
+
+	if trackResponse {
+		resp := "(" + ports.filter("src") + ")"
+		respFrag := bpfFragments
+		if srcHost != "" {
+			resp += " and (" + srcHost + ")"
+			respFrag += " and (" + srcHost + ")"
+		}
+
+		filter = "(" + req + ") or (" + resp + ") or (" + frag + ") or (" + respFrag + ")"
+	}
+
+	if extra != "" {
+		filter = "(" + filter + ") and (" + extra + ")"
+	}
+
+	return filter
+}
+
+// closeHandle forgets about handle before closing it, so its stats are not read anymore
+func (l *IPListener) closeHandle(handle *pcap.Handle) {
+	l.mu.Lock()
+	for i, h := range l.pcapHandles {
+		if h == handle {
+			l.pcapHandles = append(l.pcapHandles[:i], l.pcapHandles[i+1:]...)
+			break
+		}
+	}
+	delete(l.devices, handle)
+	l.mu.Unlock()
+
+	handle.Close()
+}
+
+// Close stops capturing, packets already captured stay in Receiver channel
+func (l *IPListener) Close() error {
+	l.mu.Lock()
+	handles := append([]*pcap.Handle(nil), l.pcapHandles...)
+	l.mu.Unlock()
+
+	for _, h := range handles {
+		l.closeHandle(h)
+	}
+
+	return nil
+}
+
+// source names what is captured, used as metrics label
+func (l *IPListener) source() string {
+	if l.file != "" {
+		return l.file
+	}
+	return net.JoinHostPort(l.addr, l.ports.String())
+}
+
+// RegisterMetrics registers metrics of capture, handles opened later are registered as they are opened
+func (l *IPListener) RegisterMetrics(r *stats.Registry) {
+	r.CounterFunc("goreplay_udp_defrag_dropped_total", "Number of incomplete fragmented datagrams dropped", func() float64 {
+		return float64(l.defrag.Dropped())
+	}, "source", l.source())
+	r.GaugeFunc("goreplay_udp_listener_queue_length", "Number of captured packets waiting for decoding", func() float64 {
+		return float64(len(l.ipPacketsChan))
+	}, "source", l.source())
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.metrics = r
+	for _, handle := range l.pcapHandles {
+		if device, ok := l.devices[handle]; ok {
+			l.registerHandleMetrics(handle, device)
+		}
+	}
+}
+
+// registerHandleMetrics exposes packets received and dropped by pcap in l.metrics, must be called with l.mu held
+func (l *IPListener) registerHandleMetrics(handle *pcap.Handle, device string) {
+	var last pcap.Stats
+
+	stat := func(get func(s *pcap.Stats) int) func() float64 {
+		return func() float64 {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+
+			// Closed handle keeps its last values
+			for _, h := range l.pcapHandles {
+				if h == handle {
+					if s, err := handle.Stats(); err == nil {
+						last = *s
+					}
+					break
+				}
 			}
 
-		}(d)
+			return float64(get(&last))
+		}
 	}
-	wg.Wait()
-	l.readyChan <- true
+
+	l.metrics.CounterFunc("goreplay_udp_pcap_received_total", "Number of packets received by pcap", stat(func(s *pcap.Stats) int {
+		return s.PacketsReceived
+	}), "source", l.source(), "device", device)
+	l.metrics.CounterFunc("goreplay_udp_pcap_dropped_total", "Number of packets dropped by pcap because of buffer overflow", stat(func(s *pcap.Stats) int {
+		return s.PacketsDropped
+	}), "source", l.source(), "device", device)
+	l.metrics.CounterFunc("goreplay_udp_pcap_if_dropped_total", "Number of packets dropped by network interface", stat(func(s *pcap.Stats) int {
+		return s.PacketsIfDropped
+	}), "source", l.source(), "device", device)
 }
 
-func (l *IPListener) IsReady() bool {
+// ready waits until capture is started, returns error if it can't be started in 5 seconds
+func (l *IPListener) ready() error {
 	select {
-	case <-l.readyChan:
-		return true
+	case err := <-l.readyChan:
+		return err
 	case <-time.After(5 * time.Second):
-		return false
+		return fmt.Errorf("listener %s is not ready after 5 seconds", l.source())
 	}
 }
 
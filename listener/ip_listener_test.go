@@ -0,0 +1,64 @@
+package listener
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestHostFilter(t *testing.T) {
+	assert.Equal(t, "dst host 10.0.0.1 or dst host fe80::1", hostFilter("dst", []net.IP{net.ParseIP("10.0.0.1"), nil, net.ParseIP("fe80::1")}))
+
+	host, zone := SplitZone("fe80::1%eth0")
+	assert.Equal(t, "fe80::1", host)
+	assert.Equal(t, "eth0", zone)
+
+	host, zone = SplitZone("::1")
+	assert.Equal(t, "::1", host)
+	assert.Equal(t, "", zone)
+}
+
+// Capture needs root and libpcap, test is skipped without them
+func TestUDPListenerDualStack(t *testing.T) {
+	conn4, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer conn4.Close()
+
+	port := conn4.LocalAddr().(*net.UDPAddr).Port
+	conn6, err := net.ListenPacket("udp6", net.JoinHostPort("::1", strconv.Itoa(port)))
+	if err != nil {
+		t.Skip("IPv6 is not available on loopback:", err)
+	}
+	defer conn6.Close()
+
+	l, err := NewUDPListener("", strconv.Itoa(port), &Config{DefragTimeout: time.Second, DefragMaxBytes: 1 << 20})
+	if err != nil {
+		t.Skip("can't capture:", err)
+	}
+	defer l.Close()
+
+	for _, addr := range []string{conn4.LocalAddr().String(), conn6.LocalAddr().String()} {
+		c, err := net.Dial("udp", addr)
+		assert.Nil(t, err)
+		c.Write([]byte("data"))
+		c.Close()
+	}
+
+	captured := make(map[int]bool)
+	timeout := time.After(2 * time.Second)
+	for len(captured) < 2 {
+		select {
+		case m := <-l.Receiver():
+			assert.True(t, m.IsIncoming)
+			assert.Equal(t, uint16(port), m.Port)
+			assert.Equal(t, "data", string(m.Data()))
+			captured[len(m.SrcIp)] = true
+		case <-timeout:
+			t.Fatalf("captured datagrams of IP versions %v, expected both", captured)
+		}
+	}
+	assert.True(t, captured[net.IPv4len])
+	assert.True(t, captured[net.IPv6len])
+}
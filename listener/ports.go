@@ -0,0 +1,80 @@
+package listener
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// PortRange is inclusive range of ports, single port has the same From and To
+type PortRange struct {
+	From uint16
+	To   uint16
+}
+
+// Ports is list of ports and port ranges captured by listener
+type Ports []PortRange
+
+// ParsePorts parses comma separated list of ports and port ranges, e.g. 53,5353,5060-5080
+func ParsePorts(s string) (ports Ports, err error) {
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+
+		from, to := item, item
+		if i := strings.Index(item, "-"); i != -1 {
+			from, to = item[:i], item[i+1:]
+		}
+
+		var r PortRange
+		if r.From, err = parsePort(from); err != nil {
+			return nil, fmt.Errorf("invalid port %q in %q", item, s)
+		}
+		if r.To, err = parsePort(to); err != nil || r.To < r.From {
+			return nil, fmt.Errorf("invalid port range %q in %q", item, s)
+		}
+
+		ports = append(ports, r)
+	}
+
+	return ports, nil
+}
+
+func parsePort(s string) (uint16, error) {
+	port, err := strconv.ParseUint(s, 10, 16)
+	return uint16(port), err
+}
+
+// Contains reports if port is in the list
+func (p Ports) Contains(port uint16) bool {
+	for _, r := range p {
+		if port >= r.From && port <= r.To {
+			return true
+		}
+	}
+	return false
+}
+
+func (p Ports) String() string {
+	items := make([]string, 0, len(p))
+	for _, r := range p {
+		if r.From == r.To {
+			items = append(items, strconv.Itoa(int(r.From)))
+		} else {
+			items = append(items, strconv.Itoa(int(r.From))+"-"+strconv.Itoa(int(r.To)))
+		}
+	}
+	return strings.Join(items, ",")
+}
+
+// filter builds BPF expression matching UDP datagrams with listed ports, direction is "src" or "dst"
+func (p Ports) filter(direction string) string {
+	items := make([]string, 0, len(p))
+	for _, r := range p {
+		if r.From == r.To {
+			items = append(items, "udp "+direction+" port "+strconv.Itoa(int(r.From)))
+		} else {
+			items = append(items, "udp "+direction+" portrange "+strconv.Itoa(int(r.From))+"-"+strconv.Itoa(int(r.To)))
+		}
+	}
+	return strings.Join(items, " or ")
+}
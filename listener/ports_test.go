@@ -0,0 +1,36 @@
+package listener
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParsePorts(t *testing.T) {
+	ports, err := ParsePorts("5060-5080, 53,5353")
+	assert.Nil(t, err)
+	assert.Equal(t, Ports{{5060, 5080}, {53, 53}, {5353, 5353}}, ports)
+	assert.Equal(t, "5060-5080,53,5353", ports.String())
+
+	assert.True(t, ports.Contains(5060))
+	assert.True(t, ports.Contains(5070))
+	assert.True(t, ports.Contains(5080))
+	assert.True(t, ports.Contains(53))
+	assert.False(t, ports.Contains(5081))
+	assert.False(t, ports.Contains(54))
+
+	for _, s := range []string{"", "dns", "53,", "70000", "5080-5060", "1-2-3"} {
+		_, err := ParsePorts(s)
+		assert.NotNil(t, err, s)
+	}
+}
+
+func TestUDPFilter(t *testing.T) {
+	ports := Ports{{53, 53}, {5060, 5080}}
+
+	assert.Equal(t, "(((udp dst port 53 or udp dst portrange 5060-5080)) or ("+bpfFragments+")) and (not src net 10.0.0.0/8)",
+		udpFilter(ports, "", "", false, "not src net 10.0.0.0/8"))
+
+	assert.Equal(t, "((udp dst port 53) and (dst host 10.0.0.1)) or ((udp src port 53) and (src host 10.0.0.1)) or ("+
+		bpfFragments+" and (dst host 10.0.0.1)) or ("+bpfFragments+" and (src host 10.0.0.1))",
+		udpFilter(Ports{{53, 53}}, "dst host 10.0.0.1", "src host 10.0.0.1", true, ""))
+}
@@ -1,50 +1,116 @@
 package listener
 
 import (
+	"fmt"
 	"github.com/myzhan/goreplay-udp/proto"
-	"log"
-	"strconv"
+	"github.com/myzhan/goreplay-udp/stats"
+	"strings"
+	"time"
 )
 
+// Config holds capture settings shared by live and file listeners
+type Config struct {
+	TrackResponse bool
+	// Protocol key used along with addresses to pair responses with requests, see CorrelationKeys
+	ResponseMatch string
+	// Responses captured later than this after the request are not paired
+	ResponseWindow time.Duration
+	// Incomplete fragmented datagrams are dropped after this timeout
+	DefragTimeout time.Duration
+	// Memory limit for fragments waiting for reassembly
+	DefragMaxBytes int
+	// Extra BPF expression ANDed into filter built from address and ports
+	BPF string
+}
+
 type UDPListener struct {
 	// IP to listen
 	addr string
-	// Port to listen
-	port uint16
+	// Ports to listen
+	ports Ports
+
+	trackResponse bool
 
 	messagesChan chan *proto.UDPMessage
 
 	underlying *IPListener
+	correlator *Correlator
+}
+
+// NewUDPListener captures UDP datagrams sent to the ports on interfaces with given address,
+// ports are comma separated list of ports and ranges, see ParsePorts
+func NewUDPListener(addr string, ports string, config *Config) (l *UDPListener, err error) {
+	if l, err = newUDPListener(addr, ports, config); err != nil {
+		return nil, err
+	}
+	if l.underlying, err = NewIPListener(addr, l.ports, config); err != nil {
+		return nil, err
+	}
+
+	go l.recv()
+
+	return
+}
+
+// NewUDPFileListener decodes UDP datagrams from pcap or pcapng file.
+// Receiver channel is closed once the whole file is read.
+func NewUDPFileListener(path string, addr string, ports string, config *Config) (l *UDPListener, err error) {
+	if l, err = newUDPListener(addr, ports, config); err != nil {
+		return nil, err
+	}
+	if l.underlying, err = NewIPFileListener(path, addr, l.ports, config); err != nil {
+		return nil, err
+	}
+
+	go l.recv()
+
+	return
 }
 
-func NewUDPListener(addr string, port string, trackResponse bool) (l *UDPListener) {
+func newUDPListener(addr string, ports string, config *Config) (l *UDPListener, err error) {
 	l = &UDPListener{}
 	l.messagesChan = make(chan *proto.UDPMessage, 10000)
 	l.addr = addr
-	intPort, err := strconv.Atoi(port)
-	if err != nil {
-		log.Fatalf("Invaild Port: %s, %v\n", port, err)
+	l.trackResponse = config.TrackResponse
+	if l.ports, err = ParsePorts(ports); err != nil {
+		return nil, err
 	}
-	l.port = uint16(intPort)
 
-	l.underlying = NewIPListener(addr, l.port, trackResponse)
-
-	if l.underlying.IsReady() {
-		go l.recv()
-	} else {
-		log.Fatalln("IP Listener is not ready after 5 seconds")
+	if config.TrackResponse {
+		var ok bool
+		if l.correlator, ok = NewCorrelator(config.ResponseMatch, config.ResponseWindow); !ok {
+			return nil, fmt.Errorf("unknown response match %s, available: %s", config.ResponseMatch, strings.Join(CorrelationKeys(), ", "))
+		}
 	}
 
 	return
 }
 
+// RegisterMetrics registers metrics of capture and pending requests
+func (l *UDPListener) RegisterMetrics(r *stats.Registry) {
+	l.underlying.RegisterMetrics(r)
+
+	if l.correlator == nil {
+		return
+	}
+
+	r.GaugeFunc("goreplay_udp_pending_requests", "Number of captured requests waiting to be paired with response", func() float64 {
+		return float64(l.correlator.Pending())
+	}, "source", l.underlying.source())
+}
+
 func (l *UDPListener) parseUDPPacket(packet *ipPacket) (message *proto.UDPMessage) {
 	data := packet.payload
 	message = proto.NewUDPMessage(data, packet.srcIP, packet.dstIP, false)
-	if message.DstPort == l.port {
+	// Datagrams are tagged with listened port, which is source port of responses
+	if l.ports.Contains(message.DstPort) {
 		message.IsIncoming = true
+		message.Port = message.DstPort
+	} else if l.ports.Contains(message.SrcPort) {
+		message.Port = message.SrcPort
 	}
 	message.Start = packet.timestamp
+	message.Interface = packet.device
 	return
 }
 
@@ -52,13 +118,33 @@ func (l *UDPListener) recv() {
 	for {
 		ipPacketsChan := l.underlying.Receiver()
 		select {
-		case packet := <-ipPacketsChan:
+		case packet, ok := <-ipPacketsChan:
+			if !ok {
+				close(l.messagesChan)
+				return
+			}
 			message := l.parseUDPPacket(packet)
+			// Reassembled fragments are not filtered by ports in BPF
+			if !message.IsIncoming && (!l.trackResponse || message.Port == 0) {
+				continue
+			}
+			if l.correlator != nil {
+				if message.IsIncoming {
+					l.correlator.Request(message)
+				} else {
+					l.correlator.Response(message)
+				}
+			}
 			l.messagesChan <- message
 		}
 	}
 }
 
+// Close stops capturing and closes pcap handles
+func (l *UDPListener) Close() error {
+	return l.underlying.Close()
+}
+
 func (l *UDPListener) Receiver() chan *proto.UDPMessage {
 	return l.messagesChan
 }
@@ -0,0 +1,282 @@
+package modifier
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"github.com/myzhan/goreplay-udp/proto"
+	"github.com/myzhan/goreplay-udp/stats"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Config holds filter and rewrite rules as given on command line
+type Config struct {
+	// Payload patterns, regexp or hex:<bytes> matched anywhere in the payload
+	AllowPayload []string
+	DenyPayload  []string
+	// Source addresses as IP, CIDR network, optionally with port, or just :port
+	AllowSource []string
+	DenySource  []string
+	// Regexp replacements as pattern:replacement, replacement may refer to groups as $1
+	Rewrite []string
+	// Fixed offset patches as offset:hexbytes, negative offset counts from the end of payload
+	Patch []string
+}
+
+type payloadPattern struct {
+	re    *regexp.Regexp
+	bytes []byte
+}
+
+func (p *payloadPattern) match(payload []byte) bool {
+	if p.re != nil {
+		return p.re.Match(payload)
+	}
+	return bytes.Contains(payload, p.bytes)
+}
+
+type sourcePattern struct {
+	network *net.IPNet
+	port    uint16
+}
+
+func (p *sourcePattern) match(ip net.IP, port uint16) bool {
+	if p.port != 0 && p.port != port {
+		return false
+	}
+	return p.network == nil || (ip != nil && p.network.Contains(ip))
+}
+
+type rewriteRule struct {
+	re          *regexp.Regexp
+	replacement []byte
+}
+
+type patchRule struct {
+	offset int
+	data   []byte
+}
+
+// Modifier filters and rewrites request payloads between inputs and outputs
+type Modifier struct {
+	allowPayload []payloadPattern
+	denyPayload  []payloadPattern
+	allowSource  []sourcePattern
+	denySource   []sourcePattern
+	rewrite      []rewriteRule
+	patch        []patchRule
+
+	filtered *stats.Counter
+}
+
+// NewModifier parses rules of the config
+func NewModifier(config *Config) (m *Modifier, err error) {
+	m = new(Modifier)
+
+	if m.allowPayload, err = parsePayloadPatterns(config.AllowPayload); err != nil {
+		return nil, err
+	}
+	if m.denyPayload, err = parsePayloadPatterns(config.DenyPayload); err != nil {
+		return nil, err
+	}
+	if m.allowSource, err = parseSourcePatterns(config.AllowSource); err != nil {
+		return nil, err
+	}
+	if m.denySource, err = parseSourcePatterns(config.DenySource); err != nil {
+		return nil, err
+	}
+
+	for _, r := range config.Rewrite {
+		pattern, replacement, ok := splitRewriteRule(r)
+		if !ok {
+			return nil, fmt.Errorf("invalid rewrite rule %q, expected pattern:replacement", r)
+		}
+
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rewrite rule %q: %v", r, err)
+		}
+		m.rewrite = append(m.rewrite, rewriteRule{re: re, replacement: []byte(replacement)})
+	}
+
+	for _, p := range config.Patch {
+		sides := strings.SplitN(p, ":", 2)
+		if len(sides) != 2 {
+			return nil, fmt.Errorf("invalid patch %q, expected offset:hexbytes", p)
+		}
+
+		offset, err := strconv.Atoi(sides[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid patch offset %q", p)
+		}
+		data, err := hex.DecodeString(sides[1])
+		if err != nil || len(data) == 0 {
+			return nil, fmt.Errorf("invalid patch bytes %q", p)
+		}
+		m.patch = append(m.patch, patchRule{offset: offset, data: data})
+	}
+
+	m.filtered = new(stats.Counter)
+
+	return m, nil
+}
+
+// splitRewriteRule splits rule at the first ':' which is not escaped as '\:', escaped one stays in the pattern,
+// where it matches ':' as well
+func splitRewriteRule(r string) (pattern, replacement string, ok bool) {
+	for i := 0; i < len(r); i++ {
+		switch r[i] {
+		case '\\':
+			i++
+		case ':':
+			return r[:i], r[i+1:], true
+		}
+	}
+	return "", "", false
+}
+
+func parsePayloadPatterns(patterns []string) (parsed []payloadPattern, err error) {
+	for _, p := range patterns {
+		if strings.HasPrefix(p, "hex:") {
+			data, err := hex.DecodeString(p[4:])
+			if err != nil || len(data) == 0 {
+				return nil, fmt.Errorf("invalid hex pattern %q", p)
+			}
+			parsed = append(parsed, payloadPattern{bytes: data})
+			continue
+		}
+
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid payload pattern %q: %v", p, err)
+		}
+		parsed = append(parsed, payloadPattern{re: re})
+	}
+
+	return parsed, nil
+}
+
+// parseSourcePatterns accepts IP, CIDR network, [IPv6], any of them with :port, or just :port
+func parseSourcePatterns(patterns []string) (parsed []sourcePattern, err error) {
+	for _, p := range patterns {
+		var sp sourcePattern
+
+		host := strings.TrimSpace(p)
+		if h, port, err := net.SplitHostPort(host); err == nil {
+			host = h
+			intPort, err := strconv.ParseUint(port, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("invalid source %q: invalid port", p)
+			}
+			sp.port = uint16(intPort)
+		}
+
+		if strings.Contains(host, "/") {
+			if _, sp.network, err = net.ParseCIDR(host); err != nil {
+				return nil, fmt.Errorf("invalid source %q: %v", p, err)
+			}
+		} else if host != "" {
+			ip := net.ParseIP(host)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid source %q: invalid IP", p)
+			}
+
+			bits := 8 * len(ip)
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			sp.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		} else if sp.port == 0 {
+			return nil, fmt.Errorf("invalid source %q", p)
+		}
+
+		parsed = append(parsed, sp)
+	}
+
+	return parsed, nil
+}
+
+// RegisterMetrics registers counter of filtered requests
+func (m *Modifier) RegisterMetrics(r *stats.Registry) {
+	if m == nil {
+		return
+	}
+	m.filtered = r.Counter("goreplay_udp_filtered_total", "Number of requests dropped by filter rules")
+}
+
+// Rewrite applies rules to request payload. Returns false if it should be dropped.
+// Payload is copied before changes, so the original one is never modified.
+func (m *Modifier) Rewrite(meta, payload []byte) ([]byte, bool) {
+	if m == nil {
+		return payload, true
+	}
+
+	if !m.allowed(meta, payload) {
+		m.filtered.Inc()
+		return nil, false
+	}
+
+	for _, r := range m.rewrite {
+		payload = r.re.ReplaceAll(payload, r.replacement)
+	}
+
+	if len(m.patch) > 0 {
+		patched := make([]byte, len(payload))
+		copy(patched, payload)
+
+		for _, p := range m.patch {
+			offset := p.offset
+			if offset < 0 {
+				offset += len(patched)
+			}
+			// Patches not fitting into the payload are skipped
+			if offset < 0 || offset+len(p.data) > len(patched) {
+				continue
+			}
+			copy(patched[offset:], p.data)
+		}
+		payload = patched
+	}
+
+	return payload, true
+}
+
+func (m *Modifier) allowed(meta, payload []byte) bool {
+	if len(m.allowSource) > 0 || len(m.denySource) > 0 {
+		src := proto.ParseMeta(meta)
+
+		if len(m.allowSource) > 0 && !matchSource(m.allowSource, src) {
+			return false
+		}
+		if matchSource(m.denySource, src) {
+			return false
+		}
+	}
+
+	if len(m.allowPayload) > 0 && !matchPayload(m.allowPayload, payload) {
+		return false
+	}
+
+	return !matchPayload(m.denyPayload, payload)
+}
+
+func matchSource(patterns []sourcePattern, meta *proto.Meta) bool {
+	for i := range patterns {
+		if patterns[i].match(meta.SrcIP, meta.SrcPort) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPayload(patterns []payloadPattern, payload []byte) bool {
+	for i := range patterns {
+		if patterns[i].match(payload) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package modifier
+
+import (
+	"github.com/myzhan/goreplay-udp/proto"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+)
+
+func requestMeta(ip string, port string) []byte {
+	meta := proto.PayloadHeader(proto.RequestPayload, []byte("uuid"), 1, net.ParseIP(ip).To4())
+	return proto.AppendMetaField(meta, proto.SrcPortField, port)
+}
+
+func TestModifierFilter(t *testing.T) {
+	m, err := NewModifier(&Config{
+		AllowPayload: []string{"^ping", "hex:0001"},
+		DenyPayload:  []string{"secret"},
+		AllowSource:  []string{"10.0.0.0/8"},
+		DenySource:   []string{"10.0.0.1", ":5353"},
+	})
+	assert.Nil(t, err)
+
+	tests := []struct {
+		ip      string
+		port    string
+		payload string
+		allowed bool
+	}{
+		{"10.1.2.3", "1024", "ping", true},
+		{"10.1.2.3", "1024", "\xff\x00\x01", true},
+		{"10.1.2.3", "1024", "pong", false},
+		{"10.1.2.3", "1024", "ping secret", false},
+		{"192.168.0.1", "1024", "ping", false},
+		{"10.0.0.1", "1024", "ping", false},
+		{"10.1.2.3", "5353", "ping", false},
+	}
+
+	for _, tt := range tests {
+		_, ok := m.Rewrite(requestMeta(tt.ip, tt.port), []byte(tt.payload))
+		assert.Equal(t, tt.allowed, ok, tt)
+	}
+}
+
+func TestModifierRewrite(t *testing.T) {
+	m, err := NewModifier(&Config{
+		Rewrite: []string{`prod\.(\w+):staging.$1`},
+		Patch:   []string{"0:50", "-1:21", "100:00"},
+	})
+	assert.Nil(t, err)
+
+	payload := []byte("xprod.api.hits:1|c")
+	rewritten, ok := m.Rewrite(requestMeta("10.0.0.1", "1024"), payload)
+	assert.True(t, ok)
+	assert.Equal(t, "Pstaging.api.hits:1|!", string(rewritten))
+	assert.Equal(t, "xprod.api.hits:1|c", string(payload))
+
+	var empty *Modifier
+	rewritten, ok = empty.Rewrite(nil, payload)
+	assert.True(t, ok)
+	assert.Equal(t, payload, rewritten)
+}
+
+func TestModifierRewriteColon(t *testing.T) {
+	// Escaped ':' is part of pattern, replacement may have ':' as is
+	m, err := NewModifier(&Config{
+		Rewrite: []string{`hits\:(\d+):hits:$1:2`, `\\:x`},
+	})
+	assert.Nil(t, err)
+
+	rewritten, ok := m.Rewrite(requestMeta("10.0.0.1", "1024"), []byte(`api.hits:1|c\`))
+	assert.True(t, ok)
+	assert.Equal(t, "api.hits:1:2|cx", string(rewritten))
+
+	_, err = NewModifier(&Config{Rewrite: []string{`escaped\:only`}})
+	assert.NotNil(t, err)
+}
+
+func TestModifierInvalidRules(t *testing.T) {
+	invalid := []*Config{
+		{AllowPayload: []string{"hex:zz"}},
+		{DenyPayload: []string{"("}},
+		{AllowSource: []string{"10.0.0.0/33"}},
+		{DenySource: []string{"10.0.0.1:port"}},
+		{Rewrite: []string{"no-replacement"}},
+		{Patch: []string{"x:00"}},
+		{Patch: []string{"0:"}},
+	}
+
+	for _, config := range invalid {
+		_, err := NewModifier(config)
+		assert.NotNil(t, err, config)
+	}
+}
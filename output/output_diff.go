@@ -0,0 +1,271 @@
+package output
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/myzhan/goreplay-udp/dns"
+	"github.com/myzhan/goreplay-udp/proto"
+	"github.com/myzhan/goreplay-udp/stats"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Ways to compare responses
+const (
+	DiffBytes = "bytes"
+	DiffDNS   = "dns"
+)
+
+// Latency deltas kept for percentiles, sampled when there are more pairs
+const diffLatencySamples = 10000
+
+type DiffOutputConfig struct {
+	// Response without its pair for this long is reported as missing
+	Timeout  time.Duration `json:"output-diff-timeout"`
+	Protocol string        `json:"output-diff-protocol"`
+}
+
+// diffPair collects original and replayed response of one request
+type diffPair struct {
+	original    []byte
+	originalLat int64
+	hasOriginal bool
+	replayed    []byte
+	replayedLat int64
+	hasReplayed bool
+	seen        time.Time
+}
+
+// DiffOutput pairs original responses with replayed ones by UUID, reports mismatches as they are found
+// and summary on close
+type DiffOutput struct {
+	mu      sync.Mutex
+	path    string
+	config  *DiffOutputConfig
+	file    *os.File
+	writer  *bufio.Writer
+	pending map[string]*diffPair
+	closed  bool
+
+	lastSweep       time.Time
+	matched         int
+	mismatched      int
+	missingReplayed int
+	missingOriginal int
+
+	latencyCount   int
+	latencySum     int64
+	latencyMin     int64
+	latencyMax     int64
+	latencySamples []int64
+
+	results map[string]*stats.Counter
+}
+
+// NewDiffOutput constructor for DiffOutput, accepts path of report file
+func NewDiffOutput(path string, config *DiffOutputConfig) (*DiffOutput, error) {
+	if config.Protocol != DiffBytes && config.Protocol != DiffDNS {
+		return nil, fmt.Errorf("[OUTPUT-DIFF] unknown protocol %q, available: %s, %s", config.Protocol, DiffBytes, DiffDNS)
+	}
+
+	o := new(DiffOutput)
+	o.path = path
+	o.config = config
+	o.pending = make(map[string]*diffPair)
+	o.lastSweep = time.Now()
+
+	var err error
+	if o.file, err = os.Create(path); err != nil {
+		return nil, fmt.Errorf("[OUTPUT-DIFF] %v", err)
+	}
+	o.writer = bufio.NewWriter(o.file)
+
+	o.results = make(map[string]*stats.Counter)
+	for _, result := range []string{"match", "mismatch", "missing_replayed", "missing_original"} {
+		o.results[result] = new(stats.Counter)
+	}
+
+	return o, nil
+}
+
+func (o *DiffOutput) PluginWrite(msg *proto.Message) (int, error) {
+	meta := proto.ParseMeta(msg.Meta)
+	if meta.Type != proto.ResponsePayload && meta.Type != proto.ReplayedResponsePayload {
+		return len(msg.Data), nil
+	}
+	// Only original datagram is compared, responses to its amplified copies have no captured pair
+	if _, ok := proto.MetaField(msg.Meta, proto.OriginField); ok {
+		return len(msg.Data), nil
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed {
+		return 0, ErrorStopped
+	}
+
+	uuid := string(meta.UUID)
+	pair, ok := o.pending[uuid]
+	if !ok {
+		pair = &diffPair{seen: time.Now()}
+		o.pending[uuid] = pair
+	}
+
+	if meta.Type == proto.ResponsePayload {
+		pair.original, pair.originalLat, pair.hasOriginal = msg.Data, meta.Latency, true
+	} else {
+		pair.replayed, pair.replayedLat, pair.hasReplayed = msg.Data, meta.Latency, true
+	}
+
+	if pair.hasOriginal && pair.hasReplayed {
+		delete(o.pending, uuid)
+		o.compare(uuid, pair)
+	}
+
+	if time.Since(o.lastSweep) > time.Second {
+		o.sweep(time.Now().Add(-o.config.Timeout))
+	}
+
+	return len(msg.Data) + len(msg.Meta), nil
+}
+
+func (o *DiffOutput) compare(uuid string, pair *diffPair) {
+	diffs := o.diff(pair.original, pair.replayed)
+
+	if len(diffs) == 0 {
+		o.matched++
+		o.results["match"].Inc()
+	} else {
+		o.mismatched++
+		o.results["mismatch"].Inc()
+		fmt.Fprintf(o.writer, "mismatch %s: %s\n", uuid, strings.Join(diffs, "; "))
+	}
+
+	// Latency is known only for responses paired with their requests
+	if pair.originalLat > 0 && pair.replayedLat > 0 {
+		o.observeLatency(pair.replayedLat - pair.originalLat)
+	}
+}
+
+func (o *DiffOutput) diff(original, replayed []byte) []string {
+	if o.config.Protocol == DiffDNS {
+		diffs, err := dns.Compare(original, replayed)
+		if err == nil {
+			return diffs
+		}
+	}
+
+	if string(original) == string(replayed) {
+		return nil
+	}
+
+	offset := 0
+	for offset < len(original) && offset < len(replayed) && original[offset] == replayed[offset] {
+		offset++
+	}
+	return []string{fmt.Sprintf("length %d != %d, first difference at byte %d", len(original), len(replayed), offset)}
+}
+
+func (o *DiffOutput) observeLatency(delta int64) {
+	if o.latencyCount == 0 || delta < o.latencyMin {
+		o.latencyMin = delta
+	}
+	if o.latencyCount == 0 || delta > o.latencyMax {
+		o.latencyMax = delta
+	}
+	o.latencyCount++
+	o.latencySum += delta
+
+	// Reservoir sampling keeps uniform sample of all deltas
+	if len(o.latencySamples) < diffLatencySamples {
+		o.latencySamples = append(o.latencySamples, delta)
+	} else if i := rand.Intn(o.latencyCount); i < diffLatencySamples {
+		o.latencySamples[i] = delta
+	}
+}
+
+// sweep reports pairs not completed since deadline as missing
+func (o *DiffOutput) sweep(deadline time.Time) {
+	for uuid, pair := range o.pending {
+		if pair.seen.After(deadline) {
+			continue
+		}
+		delete(o.pending, uuid)
+
+		if pair.hasOriginal {
+			o.missingReplayed++
+			o.results["missing_replayed"].Inc()
+			fmt.Fprintf(o.writer, "missing replayed response %s\n", uuid)
+		} else {
+			o.missingOriginal++
+			o.results["missing_original"].Inc()
+			fmt.Fprintf(o.writer, "missing original response %s\n", uuid)
+		}
+	}
+	o.lastSweep = time.Now()
+}
+
+func (o *DiffOutput) writeSummary(w io.Writer) {
+	fmt.Fprintln(w, "Summary")
+	fmt.Fprintf(w, "pairs: %d\n", o.matched+o.mismatched)
+	fmt.Fprintf(w, "matched: %d\n", o.matched)
+	fmt.Fprintf(w, "mismatched: %d\n", o.mismatched)
+	fmt.Fprintf(w, "missing replayed responses: %d\n", o.missingReplayed)
+	fmt.Fprintf(w, "missing original responses: %d\n", o.missingOriginal)
+
+	if o.latencyCount == 0 {
+		return
+	}
+
+	sort.Slice(o.latencySamples, func(i, j int) bool { return o.latencySamples[i] < o.latencySamples[j] })
+	// Nearest rank percentile
+	percentile := func(p float64) time.Duration {
+		rank := int(math.Ceil(p * float64(len(o.latencySamples))))
+		return time.Duration(o.latencySamples[rank-1])
+	}
+
+	fmt.Fprintf(w, "latency delta (replayed - original): avg=%v p50=%v p90=%v p99=%v min=%v max=%v\n",
+		time.Duration(o.latencySum/int64(o.latencyCount)), percentile(0.5), percentile(0.9), percentile(0.99),
+		time.Duration(o.latencyMin), time.Duration(o.latencyMax))
+}
+
+// Close reports pending responses as missing and writes summary
+func (o *DiffOutput) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed {
+		return nil
+	}
+	o.closed = true
+
+	o.sweep(time.Now())
+	o.writeSummary(o.writer)
+
+	if err := o.writer.Flush(); err != nil {
+		o.file.Close()
+		return err
+	}
+	return o.file.Close()
+}
+
+// RegisterMetrics registers counters of compared responses
+func (o *DiffOutput) RegisterMetrics(r *stats.Registry) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for result := range o.results {
+		o.results[result] = r.Counter("goreplay_udp_diff_results_total", "Number of compared responses by result", "plugin", o.String(), "result", result)
+	}
+}
+
+func (o *DiffOutput) String() string {
+	return "Diff output: " + o.path
+}
@@ -0,0 +1,57 @@
+package output
+
+import (
+	"github.com/myzhan/goreplay-udp/proto"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiffOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diff")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "diff.txt")
+	o, err := NewDiffOutput(path, &DiffOutputConfig{Timeout: time.Minute, Protocol: DiffBytes})
+	assert.Nil(t, err)
+
+	write := func(payloadType byte, uuid string, latency string, data string) {
+		meta := proto.PayloadHeader(payloadType, []byte(uuid), 1, nil)
+		meta = proto.AppendMetaField(meta, proto.LatencyField, latency)
+		o.PluginWrite(&proto.Message{Meta: meta, Data: []byte(data)})
+	}
+
+	write(proto.RequestPayload, "1", "0", "query")
+	write(proto.ResponsePayload, "1", "1000000", "answer")
+	write(proto.ReplayedResponsePayload, "1", "3000000", "answer")
+
+	write(proto.ResponsePayload, "2", "1000000", "answer")
+	write(proto.ReplayedResponsePayload, "2", "1000000", "answeR")
+
+	write(proto.ResponsePayload, "3", "1000000", "answer")
+	write(proto.ReplayedResponsePayload, "4", "1000000", "answer")
+
+	// Responses to amplified copies are not compared
+	meta := proto.PayloadHeader(proto.ReplayedResponsePayload, []byte("5"), 1, nil)
+	meta = proto.AppendMetaField(meta, proto.OriginField, "1")
+	o.PluginWrite(&proto.Message{Meta: meta, Data: []byte("answer")})
+
+	assert.Nil(t, o.Close())
+
+	report, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+
+	lines := strings.Split(string(report), "\n")
+	assert.Contains(t, lines, "mismatch 2: length 6 != 6, first difference at byte 5")
+	assert.Contains(t, lines, "missing replayed response 3")
+	assert.Contains(t, lines, "missing original response 4")
+	assert.NotContains(t, lines, "missing original response 5")
+	assert.Contains(t, lines, "matched: 1")
+	assert.Contains(t, lines, "mismatched: 1")
+	assert.Contains(t, lines, "latency delta (replayed - original): avg=1ms p50=0s p90=2ms p99=2ms min=0s max=2ms")
+}
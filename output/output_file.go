@@ -3,6 +3,7 @@ package output
 import (
 	"bufio"
 	"compress/gzip"
+	"errors"
 	"fmt"
 	"github.com/myzhan/goreplay-udp/proto"
 	"io"
@@ -29,11 +30,21 @@ var dateFileNameFuncs = map[string]func(*FileOutput) string{
 	"%t":  func(o *FileOutput) string { return string(o.payloadType) },
 }
 
+// Formats of capture file
+const (
+	FormatText   = "text"
+	FormatBinary = "binary"
+)
+
+// Binary files get index entry once per this interval of capture time
+const indexInterval = int64(time.Second)
+
 type FileOutputConfig struct {
-	FlushInterval time.Duration
-	SizeLimit     unitSizeVar
-	QueueLimit    int
-	Append        bool
+	FlushInterval time.Duration `json:"output-file-flush-interval"`
+	SizeLimit     unitSizeVar   `json:"output-file-size-limit"`
+	QueueLimit    int           `json:"output-file-queue-limit"`
+	Append        bool          `json:"output-file-append"`
+	Format        string        `json:"output-file-format"`
 }
 
 // FileOutput output plugin
@@ -49,12 +60,24 @@ type FileOutput struct {
 	currentID      []byte
 	payloadType    []byte
 	closed         bool
+	// Next message goes to the next chunk
+	rotate bool
+
+	// Binary format state: position in current file and its sidecar index
+	offset      int64
+	index       *os.File
+	indexWriter *bufio.Writer
+	lastIndexed int64
 
 	config *FileOutputConfig
 }
 
 // NewFileOutput constructor for FileOutput, accepts path
-func NewFileOutput(pathTemplate string, config *FileOutputConfig) *FileOutput {
+func NewFileOutput(pathTemplate string, config *FileOutputConfig) (*FileOutput, error) {
+	if config.Format != FormatText && config.Format != FormatBinary {
+		return nil, fmt.Errorf("unknown output file format %q, available: %s, %s", config.Format, FormatText, FormatBinary)
+	}
+
 	o := new(FileOutput)
 	o.pathTemplate = pathTemplate
 	o.config = config
@@ -67,15 +90,13 @@ func NewFileOutput(pathTemplate string, config *FileOutputConfig) *FileOutput {
 	go func() {
 		for {
 			time.Sleep(config.FlushInterval)
-			if o.closed {
+			if !o.flush() {
 				break
 			}
-			o.updateName()
-			o.flush()
 		}
 	}()
 
-	return o
+	return o, nil
 }
 
 func getFileIndex(name string) int {
@@ -131,10 +152,8 @@ func (s sortByFileIndex) Less(i, j int) bool {
 	return s[i] < s[j]
 }
 
+// filename returns name of the file to write, must be called with o.mu held
 func (o *FileOutput) filename() string {
-	defer o.mu.Unlock()
-	o.mu.Lock()
-
 	path := o.pathTemplate
 
 	for name, fn := range dateFileNameFuncs {
@@ -144,7 +163,7 @@ func (o *FileOutput) filename() string {
 	if !o.config.Append {
 		nextChunk := false
 
-		if o.currentName == "" ||
+		if o.currentName == "" || o.rotate ||
 			((o.config.QueueLimit > 0 && o.queueLength >= o.config.QueueLimit) ||
 				(o.config.SizeLimit > 0 && o.chunkSize >= int(o.config.SizeLimit))) {
 			nextChunk = true
@@ -154,6 +173,15 @@ func (o *FileOutput) filename() string {
 		withoutExt := strings.TrimSuffix(path, ext)
 
 		if matches, err := filepath.Glob(withoutExt + "*" + ext); err == nil {
+			// Index files of binary chunks match the pattern when path has no extension
+			chunks := matches[:0]
+			for _, m := range matches {
+				if !strings.HasSuffix(m, ".idx") {
+					chunks = append(chunks, m)
+				}
+			}
+			matches = chunks
+
 			if len(matches) == 0 {
 				return setFileIndex(path, 0)
 			}
@@ -182,6 +210,12 @@ func (o *FileOutput) updateName() {
 }
 
 func (o *FileOutput) PluginWrite(msg *proto.Message) (n int, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed {
+		return 0, ErrorStopped
+	}
 
 	if o.requestPerFile {
 		meta := proto.PayloadMeta(msg.Meta)
@@ -192,10 +226,13 @@ func (o *FileOutput) PluginWrite(msg *proto.Message) (n int, err error) {
 	o.updateName()
 
 	if o.file == nil || o.currentName != o.file.Name() {
-		o.mu.Lock()
-		o.Close()
+		o.closeFile()
 
 		o.file, err = os.OpenFile(o.currentName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+		if err != nil {
+			o.file = nil
+			return 0, fmt.Errorf("cannot open file %q: %v", o.currentName, err)
+		}
 		o.file.Sync()
 
 		if strings.HasSuffix(o.currentName, ".gz") {
@@ -204,12 +241,16 @@ func (o *FileOutput) PluginWrite(msg *proto.Message) (n int, err error) {
 			o.writer = bufio.NewWriter(o.file)
 		}
 
-		if err != nil {
-			log.Fatal(o, "Cannot open file %q. Error: %s", o.currentName, err)
+		o.queueLength = 0
+		o.chunkSize = 0
+		o.rotate = false
+		if o.config.Format == FormatBinary {
+			o.openBinary()
 		}
+	}
 
-		o.queueLength = 0
-		o.mu.Unlock()
+	if o.config.Format == FormatBinary {
+		return o.writeBinary(msg)
 	}
 
 	var nn int
@@ -224,7 +265,50 @@ func (o *FileOutput) PluginWrite(msg *proto.Message) (n int, err error) {
 	return n, nil
 }
 
-func (o *FileOutput) flush() {
+// openBinary writes header of binary file and creates its index, gzipped files are not indexed
+func (o *FileOutput) openBinary() {
+	n, _ := proto.WriteBinaryHeader(o.writer)
+	o.offset = int64(n)
+	o.lastIndexed = -1
+
+	if strings.HasSuffix(o.currentName, ".gz") {
+		return
+	}
+
+	var err error
+	o.index, err = os.OpenFile(o.currentName+".idx", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	if err != nil {
+		log.Println("Cannot open index file:", err)
+		o.index = nil
+		return
+	}
+
+	o.indexWriter = bufio.NewWriter(o.index)
+	proto.WriteIndexHeader(o.indexWriter)
+}
+
+func (o *FileOutput) writeBinary(msg *proto.Message) (n int, err error) {
+	rec := proto.NewRecord(msg)
+
+	buf, err := rec.MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+
+	if o.indexWriter != nil && (o.lastIndexed < 0 || rec.Timestamp-o.lastIndexed >= indexInterval) {
+		proto.WriteIndexEntry(o.indexWriter, proto.IndexEntry{Timestamp: rec.Timestamp, Offset: o.offset})
+		o.lastIndexed = rec.Timestamp
+	}
+
+	n, err = o.writer.Write(buf)
+	o.offset += int64(n)
+	o.queueLength++
+
+	return n, err
+}
+
+// flush writes buffered data to the file, returns false once output is closed
+func (o *FileOutput) flush() bool {
 	// Don't exit on panic
 	defer func() {
 		if r := recover(); r != nil {
@@ -235,6 +319,11 @@ func (o *FileOutput) flush() {
 	defer o.mu.Unlock()
 	o.mu.Lock()
 
+	if o.closed {
+		return false
+	}
+	o.updateName()
+
 	if o.file != nil {
 		if strings.HasSuffix(o.currentName, ".gz") {
 			o.writer.(*gzip.Writer).Flush()
@@ -246,22 +335,75 @@ func (o *FileOutput) flush() {
 			o.chunkSize = int(stat.Size())
 		}
 	}
+
+	if o.indexWriter != nil {
+		o.indexWriter.Flush()
+	}
+
+	return true
+}
+
+// Flush writes buffered data to the file
+func (o *FileOutput) Flush() error {
+	if !o.flush() {
+		return ErrorStopped
+	}
+	return nil
+}
+
+// Rotate closes current file, the next message is written to the next chunk
+func (o *FileOutput) Rotate() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed {
+		return ErrorStopped
+	}
+	if o.config.Append {
+		return errors.New("file output in append mode can't be rotated")
+	}
+
+	o.rotate = true
+	err := o.closeFile()
+	o.file = nil
+
+	return err
 }
 
 func (o *FileOutput) String() string {
-	return "File output: " + o.file.Name()
+	return "File output: " + o.pathTemplate
 }
 
+// Close flushes and closes current file, messages written after that are rejected
 func (o *FileOutput) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed {
+		return nil
+	}
+	o.closed = true
+
+	return o.closeFile()
+}
+
+// closeFile flushes and closes current file and its index, must be called with o.mu held
+func (o *FileOutput) closeFile() (err error) {
 	if o.file != nil {
 		if strings.HasSuffix(o.currentName, ".gz") {
 			o.writer.(*gzip.Writer).Close()
 		} else {
 			o.writer.(*bufio.Writer).Flush()
 		}
-		o.file.Close()
+		err = o.file.Close()
 	}
 
-	o.closed = true
-	return nil
+	if o.index != nil {
+		o.indexWriter.Flush()
+		o.index.Close()
+		o.index = nil
+		o.indexWriter = nil
+	}
+
+	return err
 }
@@ -0,0 +1,63 @@
+package output
+
+import (
+	"github.com/myzhan/goreplay-udp/proto"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileOutputRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	config := &FileOutputConfig{FlushInterval: time.Minute, SizeLimit: 1 << 20, QueueLimit: 1000, Format: FormatText}
+	o, err := NewFileOutput(filepath.Join(dir, "requests.gor"), config)
+	assert.Nil(t, err)
+
+	msg := &proto.Message{Meta: proto.PayloadHeader(proto.RequestPayload, []byte("uuid"), 1, nil), Data: []byte("data")}
+
+	_, err = o.PluginWrite(msg)
+	assert.Nil(t, err)
+	assert.Nil(t, o.Rotate())
+	_, err = o.PluginWrite(msg)
+	assert.Nil(t, err)
+	_, err = o.PluginWrite(msg)
+	assert.Nil(t, err)
+	assert.Nil(t, o.Close())
+
+	assert.Equal(t, ErrorStopped, o.Rotate())
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	assert.Equal(t, []string{filepath.Join(dir, "requests_0.gor"), filepath.Join(dir, "requests_1.gor")}, files)
+}
+
+func TestFileOutputBinaryWithoutExtension(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	config := &FileOutputConfig{FlushInterval: time.Minute, SizeLimit: 1 << 20, QueueLimit: 1000, Format: FormatBinary}
+	o, err := NewFileOutput(filepath.Join(dir, "capture"), config)
+	assert.Nil(t, err)
+
+	msg := &proto.Message{Meta: proto.PayloadHeader(proto.RequestPayload, []byte("uuid"), 1, nil), Data: []byte("data")}
+
+	_, err = o.PluginWrite(msg)
+	assert.Nil(t, err)
+	_, err = o.PluginWrite(msg)
+	assert.Nil(t, err)
+	assert.Nil(t, o.Rotate())
+	_, err = o.PluginWrite(msg)
+	assert.Nil(t, err)
+	assert.Nil(t, o.Close())
+
+	// Index files are not taken for chunks
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	assert.Equal(t, []string{filepath.Join(dir, "capture_0"), filepath.Join(dir, "capture_0.idx"),
+		filepath.Join(dir, "capture_1"), filepath.Join(dir, "capture_1.idx")}, files)
+}
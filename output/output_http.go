@@ -6,11 +6,13 @@ import (
 	"errors"
 	"fmt"
 	"github.com/myzhan/goreplay-udp/proto"
+	"github.com/myzhan/goreplay-udp/stats"
 	"log"
 	"math"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strings"
 	"sync/atomic"
 	"time"
 	//"github.com/buger/goreplay/size"
@@ -29,8 +31,8 @@ const (
 type HTTPOutputConfig struct {
 	TrackResponses bool          `json:"output-http-track-response"`
 	Stats          bool          `json:"output-http-stats"`
-	OriginalHost   bool          `json:"output-http-original-host"`
-	RedirectLimit  int           `json:"output-http-redirect-limit"`
+	OriginalHost   bool          `json:"http-original-host"`
+	RedirectLimit  int           `json:"output-http-redirects"`
 	WorkersMin     int           `json:"output-http-workers-min"`
 	WorkersMax     int           `json:"output-http-workers"`
 	StatsMs        int           `json:"output-http-stats-ms"`
@@ -56,16 +58,22 @@ type HTTPOutput struct {
 	queue      chan *proto.Message
 	responses  chan *proto.Response
 	stop       chan bool // Channel used only to indicate goroutine should shutdown
+	// Last send error of workers, reported by the next write
+	lastError sendErrorSlot
 }
 
 // NewHTTPOutput constructor for HTTPOutput
 // Initialize workers
-func NewHTTPOutput(address string, config *HTTPOutputConfig) *HTTPOutput {
+func NewHTTPOutput(address string, config *HTTPOutputConfig) (*HTTPOutput, error) {
 	o := new(HTTPOutput)
 	var err error
+	// Address may be given without scheme, like [::1]:8080, which isn't valid URL
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
 	config.url, err = url.Parse(address)
 	if err != nil {
-		log.Fatal(fmt.Sprintf("[OUTPUT-HTTP] parse HTTP output URL error[%q]", err))
+		return nil, fmt.Errorf("[OUTPUT-HTTP] parse HTTP output URL error[%q]", err)
 	}
 	if config.url.Scheme == "" {
 		config.url.Scheme = "http"
@@ -121,7 +129,7 @@ func NewHTTPOutput(address string, config *HTTPOutputConfig) *HTTPOutput {
 		go o.startWorker()
 	}
 	go o.workerMaster()
-	return o
+	return o, nil
 }
 
 func (o *HTTPOutput) workerMaster() {
@@ -180,7 +188,8 @@ func (o *HTTPOutput) PluginWrite(msg *proto.Message) (n int, err error) {
 			atomic.AddInt32(&o.activeWorkers, 1)
 		}
 	}
-	return len(msg.Data) + len(msg.Meta), nil
+	// Message is queued, error is of an earlier one failed in worker
+	return len(msg.Data) + len(msg.Meta), o.lastError.take()
 }
 
 // PluginRead reads message from this plugin
@@ -213,6 +222,7 @@ func (o *HTTPOutput) sendRequest(client *HTTPClient, msg *proto.Message) {
 
 	if err != nil {
 		log.Println(fmt.Sprintf("[HTTP-OUTPUT] error when sending: %q", err))
+		o.lastError.set(err)
 		return
 	}
 	if resp == nil {
@@ -220,10 +230,20 @@ func (o *HTTPOutput) sendRequest(client *HTTPClient, msg *proto.Message) {
 	}
 
 	if o.config.TrackResponses {
-		o.responses <- &proto.Response{resp, uuid, start.UnixNano(), stop.UnixNano() - start.UnixNano()}
+		o.responses <- &proto.Response{Payload: resp, Uuid: uuid, RoundTripTime: stop.UnixNano() - start.UnixNano(), StartedAt: start.UnixNano()}
 	}
 }
 
+// RegisterMetrics registers queue and workers metrics of the plugin
+func (o *HTTPOutput) RegisterMetrics(r *stats.Registry) {
+	r.GaugeFunc("goreplay_udp_queue_length", "Number of messages waiting in plugin queue", func() float64 {
+		return float64(len(o.queue))
+	}, "plugin", o.String())
+	r.GaugeFunc("goreplay_udp_workers", "Number of active output workers", func() float64 {
+		return float64(atomic.LoadInt32(&o.activeWorkers))
+	}, "plugin", o.String())
+}
+
 func (o *HTTPOutput) String() string {
 	return "HTTP output: " + o.config.rawURL
 }
@@ -281,7 +301,7 @@ func (c *HTTPClient) Send(msg *proto.Message) ([]byte, error) {
 	}
 	req.Header.Set("Content-Type", "application/octet-stream")
 	ms := proto.PayloadMeta(msg.Meta)
-	if len(ms) == 4 {
+	if len(ms) >= 4 {
 		req.Header.Set("X-Real-IP", string(ms[3]))
 	} else {
 		log.Println(fmt.Sprintf("[HTTPCLIENT] receive meta incorrect:%s", string(msg.Meta)))
@@ -0,0 +1,43 @@
+package output
+
+import (
+	"github.com/myzhan/goreplay-udp/proto"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHTTPOutputIPv6(t *testing.T) {
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 is not available:", err)
+	}
+
+	realIP := make(chan string, 1)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		realIP <- r.Header.Get("X-Real-IP")
+	}))
+	server.Listener.Close()
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	// Address without scheme is accepted, IPv6 host is bracketed
+	o, err := NewHTTPOutput(listener.Addr().String(), &HTTPOutputConfig{QueueLen: 1, Timeout: time.Second, WorkerTimeout: time.Second})
+	assert.Nil(t, err)
+	defer o.Close()
+	assert.Equal(t, "HTTP output: http://"+listener.Addr().String(), o.String())
+
+	_, err = o.PluginWrite(&proto.Message{Meta: proto.PayloadHeader(proto.RequestPayload, []byte("uuid"), 1, net.ParseIP("2001:db8::1")), Data: []byte("data")})
+	assert.Nil(t, err)
+
+	select {
+	case ip := <-realIP:
+		assert.Equal(t, "2001:db8::1", ip)
+	case <-time.After(2 * time.Second):
+		t.Fatal("request is not replayed")
+	}
+}
@@ -1,17 +1,28 @@
 package output
 
 import (
+	"fmt"
+	"github.com/myzhan/goreplay-udp/dns"
 	"github.com/myzhan/goreplay-udp/proto"
 	"os"
 )
 
+// FormatDNS prints decoded summary of DNS messages instead of payload
+const FormatDNS = "dns"
+
 // StdOutput used for debugging, prints all incoming requests
 type StdOutput struct {
+	format string
 }
 
 // NewStdOutput constructor for StdOutput
-func NewStdOutput() (i *StdOutput) {
+func NewStdOutput(format string) (i *StdOutput, err error) {
+	if format != FormatText && format != FormatDNS {
+		return nil, fmt.Errorf("unknown output stdout format %q, available: %s, %s", format, FormatText, FormatDNS)
+	}
+
 	i = new(StdOutput)
+	i.format = format
 	return
 }
 
@@ -19,7 +30,7 @@ func (i *StdOutput) PluginWrite(msg *proto.Message) (int, error) {
 	var n, nn int
 	var err error
 	n, err = os.Stdout.Write(msg.Meta)
-	nn, err = os.Stdout.Write(msg.Data)
+	nn, err = os.Stdout.Write(i.payload(msg.Data))
 	n += nn
 	nn, err = os.Stdout.Write([]byte(proto.PayloadSeparator))
 	n += nn
@@ -27,6 +38,16 @@ func (i *StdOutput) PluginWrite(msg *proto.Message) (int, error) {
 	return n, err
 }
 
+// payload renders payload in configured format, falling back to raw bytes
+func (i *StdOutput) payload(data []byte) []byte {
+	if i.format == FormatDNS {
+		if summary, err := dns.Summary(data); err == nil {
+			return []byte(summary)
+		}
+	}
+	return data
+}
+
 func (i *StdOutput) String() string {
 	return "Stdout Output"
 }
@@ -1,9 +1,17 @@
 package output
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/myzhan/goreplay-udp/client"
 	"github.com/myzhan/goreplay-udp/proto"
 	"github.com/myzhan/goreplay-udp/stats"
+	"log"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -11,10 +19,38 @@ import (
 const initialDynamicWorkers = 10
 
 type UDPOutputConfig struct {
-	Workers        int
-	Timeout        time.Duration
-	Stats          bool
-	IgnoreResponse bool
+	Workers        int           `json:"output-udp-workers"`
+	Timeout        time.Duration `json:"output-udp-timeout"`
+	Stats          bool          `json:"output-udp-stats"`
+	IgnoreResponse bool          `json:"output-udp-ignore-response"`
+	// Send from captured source address using raw socket, responses are not tracked
+	RawSocket bool `json:"output-udp-raw"`
+	// Translation of captured source addresses in raw socket mode, see client.AddressMap
+	SourceMap []string `json:"output-udp-source-map"`
+	// Replay each original source address from its own socket, keeping order of its datagrams
+	FlowAffinity bool `json:"output-udp-flow-affinity"`
+	// Sockets of flows without datagrams for this long are closed
+	FlowIdleTimeout time.Duration `json:"output-udp-flow-idle-timeout"`
+	// Datagrams of new flows are dropped while this many flows are active
+	MaxFlows int `json:"output-udp-max-flows"`
+	// Send each datagram to its recorded destination, output address is used when meta has none
+	OriginalDestination bool `json:"output-udp-original-destination"`
+	// Translation of recorded destination addresses, see client.AddressMap
+	DestinationMap []string `json:"output-udp-destination-map"`
+	// Send each datagram at its captured time relative to the first one
+	Timing bool `json:"output-udp-timing"`
+	// Timing is scaled by this factor, 2 replays twice faster
+	TimingSpeed float64 `json:"output-udp-timing-speed"`
+	// Send each datagram this many times, copies are delayed randomly up to AmplifyJitter
+	Amplify       int           `json:"output-udp-amplify"`
+	AmplifyJitter time.Duration `json:"output-udp-amplify-jitter"`
+	// Identifiers changed in each copy, see MutateSrcPort and MutateDNSID
+	AmplifyMutate []string `json:"output-udp-amplify-mutate"`
+	// Ramp-up profile of timing speed: linear or step, empty disables it
+	Ramp         string        `json:"output-udp-ramp"`
+	RampFrom     float64       `json:"output-udp-ramp-from"`
+	RampDuration time.Duration `json:"output-udp-ramp-duration"`
+	RampSteps    int           `json:"output-udp-ramp-steps"`
 }
 
 type UDPOutPut struct {
@@ -22,8 +58,13 @@ type UDPOutPut struct {
 	// alignment. atomic.* functions crash on 32bit machines if operand is not
 	// aligned at 64bit. See https://github.com/golang/go/issues/599
 	activeWorkers int64
+	activeFlows   int64
+	// Messages written but not sent yet
+	pending int64
 
 	needWorker chan int
+	done       chan struct{}
+	closeOnce  sync.Once
 
 	address   string
 	queue     chan *proto.Message
@@ -31,24 +72,127 @@ type UDPOutPut struct {
 
 	config     *UDPOutputConfig
 	queueStats *stats.GorStat
+	raw        *client.RawClient
+	dstMap     *client.AddressMap
+	scheduler  *udpScheduler
+	amplifier  *amplifier
+	latency    *stats.Histogram
+	sendErrors *stats.Counter
+	dropped    *stats.Counter
+	// Responses are not read, raw socket mode ignores them whatever config says
+	ignoreResponse bool
+	// Last send error of workers, reported by the next write
+	lastError sendErrorSlot
+
+	flowsMu sync.Mutex
+	flows   map[string]*udpFlow
 }
 
-func NewUDPOutput(address string, config *UDPOutputConfig) (o *UDPOutPut) {
+// ValidateUDPOutputConfig checks options of UDP output without creating it
+func ValidateUDPOutputConfig(config *UDPOutputConfig) error {
+	if config.OriginalDestination && config.RawSocket {
+		return errors.New("original destination can't be used with raw socket")
+	}
+	if (config.Timing || config.Ramp != "") && config.TimingSpeed <= 0 {
+		return errors.New("timing speed should be positive")
+	}
+
+	if _, err := client.NewAddressMap(config.DestinationMap); err != nil {
+		return err
+	}
+	if _, err := client.NewAddressMap(config.SourceMap); err != nil {
+		return err
+	}
+	if _, err := newAmplifier(config); err != nil {
+		return err
+	}
+	if config.Ramp != "" {
+		if _, err := newRampProfile(config.Ramp, config.RampFrom, config.TimingSpeed, config.RampDuration, config.RampSteps); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func NewUDPOutput(address string, config *UDPOutputConfig) (o *UDPOutPut, err error) {
+	if err = ValidateUDPOutputConfig(config); err != nil {
+		return nil, fmt.Errorf("[OUTPUT-UDP] %v", err)
+	}
+
 	o = new(UDPOutPut)
 	o.address = address
 	o.config = config
+	o.ignoreResponse = config.IgnoreResponse
 
 	if o.config.Stats {
 		o.queueStats = stats.NewGorStat("output_udp")
 	}
 
+	if o.config.OriginalDestination {
+		if o.dstMap, err = client.NewAddressMap(o.config.DestinationMap); err != nil {
+			return nil, fmt.Errorf("[OUTPUT-UDP] %v", err)
+		}
+	}
+
+	if o.config.RawSocket {
+		sourceMap, err := client.NewAddressMap(o.config.SourceMap)
+		if err != nil {
+			return nil, fmt.Errorf("[OUTPUT-UDP] %v", err)
+		}
+
+		if o.raw, err = client.NewRawClient(address, sourceMap); err != nil {
+			return nil, fmt.Errorf("[OUTPUT-UDP] raw socket error: %v", err)
+		}
+
+		// Responses are sent to the original source address
+		o.ignoreResponse = true
+	} else if _, err = net.ResolveUDPAddr("udp", address); err != nil {
+		return nil, fmt.Errorf("[OUTPUT-UDP] %v", err)
+	}
+
 	o.queue = make(chan *proto.Message, 10000)
 	o.needWorker = make(chan int, 1)
+	o.done = make(chan struct{})
 
-	if !o.config.IgnoreResponse {
+	if !o.ignoreResponse {
 		o.responses = make(chan *proto.Response, 10000)
 	}
 
+	if o.config.Amplify > 1 {
+		if o.amplifier, err = newAmplifier(o.config); err != nil {
+			return nil, fmt.Errorf("[OUTPUT-UDP] %v", err)
+		}
+	}
+
+	if o.config.Timing || o.config.Ramp != "" {
+		speed := o.config.TimingSpeed
+		offset := func(capture time.Duration) time.Duration {
+			return time.Duration(float64(capture) / speed)
+		}
+
+		if o.config.Ramp != "" {
+			ramp, err := newRampProfile(o.config.Ramp, o.config.RampFrom, speed, o.config.RampDuration, o.config.RampSteps)
+			if err != nil {
+				return nil, fmt.Errorf("[OUTPUT-UDP] %v", err)
+			}
+			offset = ramp.offset
+		}
+
+		o.scheduler = newUDPScheduler(offset, 10000, o.dispatch)
+	}
+
+	// Counted outside of registry until RegisterMetrics
+	o.latency = stats.NewHistogram(stats.DefaultLatencyBuckets)
+	o.sendErrors = new(stats.Counter)
+	o.dropped = new(stats.Counter)
+
+	// Each flow gets its own worker instead of shared pool
+	if o.config.FlowAffinity {
+		o.flows = make(map[string]*udpFlow)
+		return o, nil
+	}
+
 	// Initial workers count
 	if o.config.Workers == 0 {
 		o.needWorker <- initialDynamicWorkers
@@ -57,12 +201,18 @@ func NewUDPOutput(address string, config *UDPOutputConfig) (o *UDPOutPut) {
 	}
 
 	go o.workerMaster()
-	return o
+	return o, nil
 }
 
 func (o *UDPOutPut) workerMaster() {
 	for {
-		newWorkers := <-o.needWorker
+		var newWorkers int
+		select {
+		case <-o.done:
+			return
+		case newWorkers = <-o.needWorker:
+		}
+
 		for i := 0; i < newWorkers; i++ {
 			go o.startWorker()
 		}
@@ -75,13 +225,18 @@ func (o *UDPOutPut) workerMaster() {
 }
 
 func (o *UDPOutPut) startWorker() {
-	c := client.NewUDPClient(o.address, o.config.Timeout, o.config.IgnoreResponse)
+	clients := make(map[string]*client.UDPClient)
+	defer closeClients(clients)
+
 	deathCount := 0
 	atomic.AddInt64(&o.activeWorkers, 1)
 	for {
 		select {
+		case <-o.done:
+			atomic.AddInt64(&o.activeWorkers, -1)
+			return
 		case data := <-o.queue:
-			o.sendRequest(c, data)
+			o.process(clients, data)
 			deathCount = 0
 		case <-time.After(time.Millisecond * 100):
 			// When dynamic scaling enabled workers die after 2s of inactivity
@@ -104,12 +259,68 @@ func (o *UDPOutPut) startWorker() {
 	}
 }
 
+// process sends message using worker's clients
+func (o *UDPOutPut) process(clients map[string]*client.UDPClient, msg *proto.Message) {
+	if o.raw != nil {
+		o.sendRaw(msg)
+	} else if c := o.client(clients, msg); c != nil {
+		o.sendRequest(c, msg)
+	} else {
+		o.sendErrors.Inc()
+		o.lastError.set(fmt.Errorf("[OUTPUT-UDP] no socket for %s", o.destination(msg)))
+	}
+	atomic.AddInt64(&o.pending, -1)
+}
+
 func (o *UDPOutPut) PluginWrite(msg *proto.Message) (n int, err error) {
 	if !proto.IsRequestPayload(msg.Meta) {
 		return len(msg.Data), nil
 	}
 
-	o.queue <- msg
+	select {
+	case <-o.done:
+		return 0, ErrorStopped
+	default:
+	}
+
+	if o.amplifier == nil {
+		o.send(msg, 0)
+	} else {
+		for i := 0; i < o.amplifier.copies; i++ {
+			o.send(o.amplifier.copy(msg, i), o.amplifier.delay(i))
+		}
+	}
+
+	// Message is queued, error is of an earlier one failed in worker
+	return len(msg.Data) + len(msg.Meta), o.lastError.take()
+}
+
+// send dispatches message after delay, at its scheduled time when timing is enabled
+func (o *UDPOutPut) send(msg *proto.Message, delay time.Duration) {
+	atomic.AddInt64(&o.pending, 1)
+
+	switch {
+	case o.scheduler != nil:
+		o.scheduler.add(msg, delay)
+	case delay > 0:
+		time.AfterFunc(delay, func() { o.dispatch(msg) })
+	default:
+		o.dispatch(msg)
+	}
+}
+
+// dispatch passes message to workers, messages dispatched after Close are dropped
+func (o *UDPOutPut) dispatch(msg *proto.Message) {
+	if o.config.FlowAffinity {
+		o.writeFlow(msg)
+		return
+	}
+
+	select {
+	case <-o.done:
+		return
+	case o.queue <- msg:
+	}
 
 	if o.config.Stats {
 		o.queueStats.Write(len(o.queue))
@@ -119,35 +330,216 @@ func (o *UDPOutPut) PluginWrite(msg *proto.Message) (n int, err error) {
 		workersCount := atomic.LoadInt64(&o.activeWorkers)
 
 		if len(o.queue) > int(workersCount) {
-			o.needWorker <- len(o.queue)
+			select {
+			case <-o.done:
+			case o.needWorker <- len(o.queue):
+			}
 		}
 	}
-
-	return len(msg.Data) + len(msg.Meta), nil
 }
 
 // PluginRead reads message from this plugin
 func (o *UDPOutPut) PluginRead() (*proto.Message, error) {
-	if o.config.IgnoreResponse {
+	if o.ignoreResponse {
 		return nil, ErrorStopped
 	}
 	var resp *proto.Response
 	var msg proto.Message
-	resp = <-o.responses
+	select {
+	case <-o.done:
+		return nil, ErrorStopped
+	case resp = <-o.responses:
+	}
 	msg.Data = resp.Payload
 
-	msg.Meta = proto.PayloadHeader(proto.ReplayedResponsePayload, resp.Uuid, resp.RoundTripTime, nil)
+	msg.Meta = proto.PayloadHeader(proto.ReplayedResponsePayload, resp.Uuid, resp.StartedAt, nil)
+	msg.Meta = proto.AppendMetaField(msg.Meta, proto.LatencyField, strconv.FormatInt(resp.RoundTripTime, 10))
+	if resp.Origin != nil {
+		msg.Meta = proto.AppendMetaField(msg.Meta, proto.OriginField, string(resp.Origin))
+	}
 
 	return &msg, nil
 }
 
+// destination returns address the message should be replayed to
+func (o *UDPOutPut) destination(msg *proto.Message) string {
+	if !o.config.OriginalDestination {
+		return o.address
+	}
+
+	meta := proto.ParseMeta(msg.Meta)
+	if meta.DstIP == nil || meta.DstPort == 0 {
+		return o.address
+	}
+
+	ip, port := o.dstMap.Translate(meta.DstIP, meta.DstPort)
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+}
+
+// client returns worker's socket for destination of the message, dialing new destinations
+func (o *UDPOutPut) client(clients map[string]*client.UDPClient, msg *proto.Message) *client.UDPClient {
+	address := o.destination(msg)
+
+	c, ok := clients[address]
+	if !ok {
+		var err error
+		if c, err = client.NewUDPClient(address, o.config.Timeout, o.ignoreResponse); err != nil {
+			log.Println("[OUTPUT-UDP]", err)
+			return nil
+		}
+		clients[address] = c
+	}
+
+	return c
+}
+
+func closeClients(clients map[string]*client.UDPClient) {
+	for _, c := range clients {
+		c.Close()
+	}
+}
+
 func (o *UDPOutPut) sendRequest(client *client.UDPClient, msg *proto.Message) {
 	if !proto.IsRequestPayload(msg.Meta) {
 		return
 	}
 
-	//TODO: should send meta?
-	client.Send(msg.Data)
+	uuid := proto.PayloadMeta(msg.Meta)[1]
+	origin, _ := proto.MetaField(msg.Meta, proto.OriginField)
+	start := time.Now()
+	resp, err := client.Send(msg.Data)
+	stop := time.Now()
+
+	if err != nil {
+		o.sendErrors.Inc()
+		// Missing response is counted, but it isn't failure of the output
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			o.lastError.set(fmt.Errorf("[OUTPUT-UDP] %v", err))
+		}
+		return
+	}
+	if resp == nil {
+		return
+	}
+	o.latency.Observe(stop.Sub(start).Seconds())
+
+	if !o.ignoreResponse {
+		select {
+		case <-o.done:
+		case o.responses <- &proto.Response{
+			Payload:       resp,
+			Uuid:          uuid,
+			RoundTripTime: stop.UnixNano() - start.UnixNano(),
+			StartedAt:     start.UnixNano(),
+			Origin:        origin,
+		}:
+		}
+	}
+}
+
+// sendRaw sends request on behalf of its captured source address
+func (o *UDPOutPut) sendRaw(msg *proto.Message) {
+	if !proto.IsRequestPayload(msg.Meta) {
+		return
+	}
+
+	var srcIP net.IP
+	if meta := proto.PayloadMeta(msg.Meta); len(meta) > 3 {
+		srcIP = net.ParseIP(string(meta[3]))
+	}
+	if srcIP == nil {
+		log.Printf("[OUTPUT-UDP] no source address in meta: %s\n", msg.Meta)
+		return
+	}
+
+	var srcPort uint16
+	if p, ok := proto.MetaField(msg.Meta, proto.SrcPortField); ok {
+		port, _ := strconv.ParseUint(string(p), 10, 16)
+		srcPort = uint16(port)
+	}
+	if srcPort == 0 {
+		// ephemeral port range
+		srcPort = uint16(49152 + rand.Intn(16384))
+	}
+
+	if err := o.raw.Send(msg.Data, srcIP, srcPort); err != nil {
+		o.sendErrors.Inc()
+		o.lastError.set(fmt.Errorf("[OUTPUT-UDP] raw socket write error: %v", err))
+		log.Printf("[OUTPUT-UDP] raw socket write error: %v\n", err)
+	}
+}
+
+// RegisterMetrics registers replay latency, errors and queue metrics of the plugin
+func (o *UDPOutPut) RegisterMetrics(r *stats.Registry) {
+	name := o.String()
+
+	o.latency = r.Histogram("goreplay_udp_replay_latency_seconds", "Round trip time of replayed requests", stats.DefaultLatencyBuckets, "plugin", name)
+	o.sendErrors = r.Counter("goreplay_udp_replay_errors_total", "Number of replayed requests failed to send or without response", "plugin", name)
+	o.dropped = r.Counter("goreplay_udp_messages_dropped_total", "Number of messages dropped", "plugin", name, "reason", "flow")
+
+	r.GaugeFunc("goreplay_udp_queue_length", "Number of messages waiting in plugin queue", func() float64 {
+		if o.config.FlowAffinity {
+			o.flowsMu.Lock()
+			defer o.flowsMu.Unlock()
+
+			n := 0
+			for _, flow := range o.flows {
+				n += len(flow.queue)
+			}
+			return float64(n)
+		}
+		return float64(len(o.queue))
+	}, "plugin", name)
+	r.GaugeFunc("goreplay_udp_responses_queue_length", "Number of replayed responses waiting to be read", func() float64 {
+		return float64(len(o.responses))
+	}, "plugin", name)
+	r.GaugeFunc("goreplay_udp_workers", "Number of active output workers", func() float64 {
+		return float64(atomic.LoadInt64(&o.activeWorkers))
+	}, "plugin", name)
+	if o.scheduler != nil {
+		o.scheduler.lag = r.Histogram("goreplay_udp_schedule_lag_seconds", "Delay of sent datagrams after their scheduled time", stats.DefaultLatencyBuckets, "plugin", name)
+		r.GaugeFunc("goreplay_udp_scheduled", "Number of datagrams waiting for their scheduled time", func() float64 {
+			return float64(o.scheduler.Len())
+		}, "plugin", name)
+	}
+	r.GaugeFunc("goreplay_udp_flows", "Number of flows with dedicated socket", func() float64 {
+		return float64(atomic.LoadInt64(&o.activeFlows))
+	}, "plugin", name)
+}
+
+// Drain waits until all written messages are sent, returns number of messages left when ctx is done
+func (o *UDPOutPut) Drain(ctx context.Context) int {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		pending := atomic.LoadInt64(&o.pending)
+		if pending <= 0 {
+			return 0
+		}
+
+		select {
+		case <-ctx.Done():
+			return int(pending)
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close stops workers, messages not sent yet are dropped
+func (o *UDPOutPut) Close() error {
+	o.closeOnce.Do(func() {
+		close(o.done)
+
+		if o.scheduler != nil {
+			o.scheduler.close()
+		}
+		if o.raw != nil {
+			o.raw.Close()
+		}
+	})
+
+	return nil
 }
 
 func (o *UDPOutPut) String() string {
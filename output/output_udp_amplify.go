@@ -0,0 +1,157 @@
+package output
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/myzhan/goreplay-udp/proto"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Identifiers which can be changed in each copy of amplified datagram
+const (
+	MutateSrcPort = "sport"
+	MutateDNSID   = "dns-id"
+)
+
+// Ramp-up profiles, speed grows from RampFrom to TimingSpeed during RampDuration
+const (
+	RampLinear = "linear"
+	RampStep   = "step"
+)
+
+// Linear ramp is approximated with this many steps
+const linearRampSteps = 100
+
+// amplifier sends each datagram several times
+type amplifier struct {
+	copies        int
+	jitter        time.Duration
+	mutateSrcPort bool
+	mutateDNSID   bool
+}
+
+func newAmplifier(config *UDPOutputConfig) (*amplifier, error) {
+	a := &amplifier{copies: config.Amplify, jitter: config.AmplifyJitter}
+
+	for _, list := range config.AmplifyMutate {
+		for _, m := range strings.Split(list, ",") {
+			switch strings.TrimSpace(m) {
+			case MutateSrcPort:
+				a.mutateSrcPort = true
+			case MutateDNSID:
+				a.mutateDNSID = true
+			default:
+				return nil, fmt.Errorf("unknown amplify mutation %q, available: %s, %s", m, MutateSrcPort, MutateDNSID)
+			}
+		}
+	}
+
+	return a, nil
+}
+
+// delay returns random delay of the copy, original datagram is never delayed
+func (a *amplifier) delay(i int) time.Duration {
+	if i == 0 || a.jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(a.jitter)))
+}
+
+// copy returns i-th copy of the message with its own UUID and mutated identifiers, 0 is original message
+func (a *amplifier) copy(msg *proto.Message, i int) *proto.Message {
+	if i == 0 {
+		return msg
+	}
+
+	fields := bytes.Split(bytes.TrimSuffix(msg.Meta, []byte("\n")), []byte(" "))
+	var origin []byte
+	if len(fields) > 1 {
+		origin = fields[1]
+		sha := sha1.Sum([]byte(string(fields[1]) + strconv.Itoa(i)))
+		uuid := make([]byte, 40)
+		hex.Encode(uuid, sha[:])
+		fields[1] = uuid
+	}
+	meta := append(bytes.Join(fields, []byte(" ")), '\n')
+	if origin != nil {
+		meta = proto.AppendMetaField(meta, proto.OriginField, string(origin))
+	}
+
+	if a.mutateSrcPort {
+		// Each copy looks like another client, keeping ports out of well known range
+		port, _ := proto.MetaField(meta, proto.SrcPortField)
+		p, _ := strconv.Atoi(string(port))
+		p = 1024 + (p+i*7919)%(65536-1024)
+		meta = proto.SetMetaField(meta, proto.SrcPortField, strconv.Itoa(p))
+	}
+
+	data := msg.Data
+	if a.mutateDNSID && len(data) >= 2 {
+		data = append([]byte(nil), data...)
+		binary.BigEndian.PutUint16(data, uint16(rand.Intn(1<<16)))
+	}
+
+	return &proto.Message{Meta: meta, Data: data}
+}
+
+// rampProfile maps capture time passed since the first datagram to wall time,
+// while replay speed grows step by step
+type rampProfile struct {
+	from     float64
+	to       float64
+	duration time.Duration
+	steps    int
+}
+
+func newRampProfile(profile string, from, to float64, duration time.Duration, steps int) (*rampProfile, error) {
+	r := &rampProfile{from: from, to: to, duration: duration, steps: steps}
+
+	switch profile {
+	case RampLinear:
+		r.steps = linearRampSteps
+	case RampStep:
+		if r.steps < 1 {
+			return nil, fmt.Errorf("ramp steps should be positive")
+		}
+	default:
+		return nil, fmt.Errorf("unknown ramp profile %q, available: %s, %s", profile, RampLinear, RampStep)
+	}
+
+	if from <= 0 || to <= 0 || duration <= 0 {
+		return nil, fmt.Errorf("ramp speeds and duration should be positive")
+	}
+
+	return r, nil
+}
+
+// speed of k-th step, the first step runs at from speed and the last one at to speed
+func (r *rampProfile) speed(k int) float64 {
+	if r.steps == 1 {
+		return r.to
+	}
+	return r.from + (r.to-r.from)*float64(k)/float64(r.steps-1)
+}
+
+// offset returns wall time since start at which datagram captured at given time since start is sent
+func (r *rampProfile) offset(capture time.Duration) time.Duration {
+	step := r.duration / time.Duration(r.steps)
+	wall := time.Duration(0)
+
+	for k := 0; k < r.steps; k++ {
+		speed := r.speed(k)
+		covered := time.Duration(float64(step) * speed)
+		if capture <= covered {
+			return wall + time.Duration(float64(capture)/speed)
+		}
+		capture -= covered
+		wall += step
+	}
+
+	return wall + time.Duration(float64(capture)/r.to)
+}
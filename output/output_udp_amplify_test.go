@@ -0,0 +1,58 @@
+package output
+
+import (
+	"github.com/myzhan/goreplay-udp/proto"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAmplifierCopy(t *testing.T) {
+	a, err := newAmplifier(&UDPOutputConfig{Amplify: 3, AmplifyMutate: []string{"sport,dns-id"}})
+	assert.Nil(t, err)
+
+	meta := proto.PayloadHeader(proto.RequestPayload, []byte("f45590522cd1838b4a0d5c5aab80b77929dea3b3"), 1, net.ParseIP("10.0.0.5").To4())
+	meta = proto.AppendMetaField(meta, proto.SrcPortField, "40000")
+	msg := &proto.Message{Meta: meta, Data: []byte{0x12, 0x34, 0x01}}
+
+	assert.Equal(t, msg, a.copy(msg, 0))
+
+	first, second := proto.ParseMeta(a.copy(msg, 1).Meta), proto.ParseMeta(a.copy(msg, 2).Meta)
+	assert.NotEqual(t, first.UUID, second.UUID)
+	assert.Len(t, first.UUID, 40)
+	assert.NotEqual(t, first.SrcPort, second.SrcPort)
+	assert.True(t, first.SrcPort >= 1024)
+	assert.Equal(t, "10.0.0.5", first.SrcIP.String())
+
+	// Copy is linked to the original
+	origin, ok := proto.MetaField(a.copy(msg, 1).Meta, proto.OriginField)
+	assert.True(t, ok)
+	assert.Equal(t, "f45590522cd1838b4a0d5c5aab80b77929dea3b3", string(origin))
+
+	copied := a.copy(msg, 1)
+	assert.Equal(t, byte(0x01), copied.Data[2])
+	assert.Equal(t, []byte{0x12, 0x34, 0x01}, msg.Data)
+
+	_, err = newAmplifier(&UDPOutputConfig{Amplify: 2, AmplifyMutate: []string{"ttl"}})
+	assert.NotNil(t, err)
+}
+
+func TestRampProfile(t *testing.T) {
+	// Two steps of 10s: at 1x and 2x speed
+	r, err := newRampProfile(RampStep, 1, 2, 20*time.Second, 2)
+	assert.Nil(t, err)
+
+	assert.Equal(t, 5*time.Second, r.offset(5*time.Second))
+	assert.Equal(t, 10*time.Second, r.offset(10*time.Second))
+	assert.Equal(t, 15*time.Second, r.offset(20*time.Second))
+	assert.Equal(t, 25*time.Second, r.offset(40*time.Second))
+
+	linear, err := newRampProfile(RampLinear, 0.5, 1, time.Minute, 0)
+	assert.Nil(t, err)
+	assert.True(t, linear.offset(time.Second) > time.Second)
+	assert.True(t, linear.offset(10*time.Minute) > 10*time.Minute)
+
+	_, err = newRampProfile("exponential", 1, 2, time.Minute, 1)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,127 @@
+package output
+
+import (
+	"fmt"
+	"github.com/myzhan/goreplay-udp/client"
+	"github.com/myzhan/goreplay-udp/proto"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// udpFlow holds datagrams of one original source address, sent in order by dedicated worker
+type udpFlow struct {
+	key   string
+	queue chan *proto.Message
+
+	// Number of writers about to queue message, idle worker keeps running while it is not zero
+	writers int32
+}
+
+// flowKey identifies original client by captured source IP and port
+func flowKey(meta []byte) string {
+	var host, port string
+
+	if m := proto.PayloadMeta(meta); len(m) > 3 {
+		host = string(m[3])
+	}
+	if p, ok := proto.MetaField(meta, proto.SrcPortField); ok {
+		port = string(p)
+	}
+
+	// IPv6 addresses are bracketed, so they can't be mixed up with port
+	return net.JoinHostPort(host, port)
+}
+
+// Default limit of active flows
+const defaultMaxFlows = 10000
+
+// writeFlow queues message to the worker of its flow, starting one for new flows. Message is dropped when its flow
+// queue is full or there are too many flows, so dispatcher is never blocked by slow flow.
+func (o *UDPOutPut) writeFlow(msg *proto.Message) {
+	key := flowKey(msg.Meta)
+
+	maxFlows := o.config.MaxFlows
+	if maxFlows <= 0 {
+		maxFlows = defaultMaxFlows
+	}
+
+	// Writer is registered under lock, so idle worker can't exit with message on its way to the queue
+	o.flowsMu.Lock()
+	flow, ok := o.flows[key]
+	if !ok {
+		if len(o.flows) >= maxFlows {
+			o.flowsMu.Unlock()
+			o.drop(fmt.Errorf("[OUTPUT-UDP] datagram of new flow %s is dropped, %d flows are active", key, maxFlows))
+			return
+		}
+		flow = &udpFlow{key: key, queue: make(chan *proto.Message, 1000)}
+		o.flows[key] = flow
+		go o.startFlowWorker(flow)
+	}
+	atomic.AddInt32(&flow.writers, 1)
+	o.flowsMu.Unlock()
+
+	defer atomic.AddInt32(&flow.writers, -1)
+
+	select {
+	case <-o.done:
+		return
+	case flow.queue <- msg:
+	default:
+		o.drop(fmt.Errorf("[OUTPUT-UDP] datagram is dropped, queue of flow %s is full", key))
+		return
+	}
+
+	if o.config.Stats {
+		o.queueStats.Write(len(flow.queue))
+	}
+}
+
+// drop counts message which won't be sent, error is reported by the next write
+func (o *UDPOutPut) drop(err error) {
+	o.dropped.Inc()
+	o.lastError.set(err)
+	atomic.AddInt64(&o.pending, -1)
+}
+
+func (o *UDPOutPut) startFlowWorker(flow *udpFlow) {
+	clients := make(map[string]*client.UDPClient)
+	defer closeClients(clients)
+
+	atomic.AddInt64(&o.activeFlows, 1)
+	defer atomic.AddInt64(&o.activeFlows, -1)
+
+	timeout := o.config.FlowIdleTimeout
+	if timeout <= 0 {
+		timeout = time.Minute
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-o.done:
+			return
+		case msg := <-flow.queue:
+			o.process(clients, msg)
+		case <-timer.C:
+			o.flowsMu.Lock()
+			if len(flow.queue) == 0 && atomic.LoadInt32(&flow.writers) == 0 {
+				delete(o.flows, flow.key)
+				o.flowsMu.Unlock()
+				return
+			}
+			o.flowsMu.Unlock()
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(timeout)
+	}
+}
@@ -0,0 +1,181 @@
+package output
+
+import (
+	"container/heap"
+	"github.com/myzhan/goreplay-udp/proto"
+	"github.com/myzhan/goreplay-udp/stats"
+	"log"
+	"sync"
+	"time"
+)
+
+// Lag above this is logged, at most once per scheduleLagLogInterval
+const (
+	scheduleLagWarning     = 100 * time.Millisecond
+	scheduleLagLogInterval = 10 * time.Second
+)
+
+type scheduledMessage struct {
+	at  time.Time
+	seq uint64
+	msg *proto.Message
+}
+
+// scheduledHeap orders messages by dispatch time, keeping arrival order for equal times
+type scheduledHeap []*scheduledMessage
+
+func (h scheduledHeap) Len() int { return len(h) }
+func (h scheduledHeap) Less(i, j int) bool {
+	if h[i].at.Equal(h[j].at) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].at.Before(h[j].at)
+}
+func (h scheduledHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *scheduledHeap) Push(x interface{}) { *h = append(*h, x.(*scheduledMessage)) }
+func (h *scheduledHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// udpScheduler dispatches datagrams at their captured time relative to the first one, mapped to wall time by offset
+type udpScheduler struct {
+	offset   func(capture time.Duration) time.Duration
+	dispatch func(*proto.Message)
+
+	mu      sync.Mutex
+	pending scheduledHeap
+	seq     uint64
+	started bool
+	base    time.Time
+	baseTs  int64
+	lastTs  int64
+	shift   int64
+
+	wake  chan struct{}
+	slots chan struct{}
+	stop  chan struct{}
+
+	lag        *stats.Histogram
+	lastLagLog time.Time
+}
+
+func newUDPScheduler(offset func(time.Duration) time.Duration, size int, dispatch func(*proto.Message)) *udpScheduler {
+	s := new(udpScheduler)
+	s.offset = offset
+	s.dispatch = dispatch
+	s.wake = make(chan struct{}, 1)
+	s.slots = make(chan struct{}, size)
+	s.stop = make(chan struct{})
+	s.lag = stats.NewHistogram(stats.DefaultLatencyBuckets)
+
+	go s.run()
+	return s
+}
+
+// add schedules message with extra delay, blocking while scheduler is full. Message is dropped once scheduler is closed.
+func (s *udpScheduler) add(msg *proto.Message, delay time.Duration) {
+	select {
+	case <-s.stop:
+		return
+	case s.slots <- struct{}{}:
+	}
+
+	ts := proto.ParseMeta(msg.Meta).Timestamp
+	now := time.Now()
+
+	s.mu.Lock()
+	if !s.started {
+		s.base, s.baseTs, s.lastTs, s.started = now, ts, ts, true
+	}
+	// Looped input starts new round from the first timestamp again, the round continues after the last one.
+	// Other timestamps going back are just reordered datagrams of the same round.
+	if ts <= s.baseTs && ts+s.shift < s.lastTs {
+		s.shift = s.lastTs - ts
+	}
+	ts += s.shift
+	if ts > s.lastTs {
+		s.lastTs = ts
+	}
+
+	at := s.base.Add(s.offset(time.Duration(ts-s.baseTs)) + delay)
+	s.seq++
+	heap.Push(&s.pending, &scheduledMessage{at: at, seq: s.seq, msg: msg})
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *udpScheduler) run() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		s.mu.Lock()
+		if len(s.pending) == 0 {
+			s.mu.Unlock()
+
+			select {
+			case <-s.stop:
+				return
+			case <-s.wake:
+			}
+			continue
+		}
+
+		next := s.pending[0]
+		if wait := time.Until(next.at); wait > 0 {
+			s.mu.Unlock()
+
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(wait)
+
+			// Message scheduled earlier may arrive while waiting
+			select {
+			case <-s.stop:
+				return
+			case <-timer.C:
+			case <-s.wake:
+			}
+			continue
+		}
+
+		heap.Pop(&s.pending)
+		s.mu.Unlock()
+		<-s.slots
+
+		s.observeLag(time.Since(next.at))
+		s.dispatch(next.msg)
+	}
+}
+
+func (s *udpScheduler) observeLag(lag time.Duration) {
+	s.lag.Observe(lag.Seconds())
+
+	if lag > scheduleLagWarning && time.Since(s.lastLagLog) > scheduleLagLogInterval {
+		log.Printf("[OUTPUT-UDP] datagrams are sent %v later than scheduled, replay can't keep up with captured rate\n", lag)
+		s.lastLagLog = time.Now()
+	}
+}
+
+// close stops dispatching, messages waiting for their time are dropped
+func (s *udpScheduler) close() {
+	close(s.stop)
+}
+
+// Len returns number of messages waiting for their time
+func (s *udpScheduler) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.pending)
+}
@@ -0,0 +1,87 @@
+package output
+
+import (
+	"github.com/myzhan/goreplay-udp/proto"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestUDPScheduler(t *testing.T) {
+	sent := make(chan string, 3)
+	times := make(chan time.Time, 3)
+
+	// Captured 100ms apart, replayed twice faster
+	offset := func(capture time.Duration) time.Duration { return capture / 2 }
+
+	s := newUDPScheduler(offset, 10, func(msg *proto.Message) {
+		sent <- string(msg.Data)
+		times <- time.Now()
+	})
+
+	start := time.Now()
+	for _, m := range []struct {
+		ts   int64
+		data string
+	}{{1000, "a"}, {1000 + int64(200*time.Millisecond), "c"}, {1000 + int64(100*time.Millisecond), "b"}} {
+		s.add(&proto.Message{Meta: proto.PayloadHeader(proto.RequestPayload, []byte("uuid"), m.ts, nil), Data: []byte(m.data)}, 0)
+	}
+
+	for i, expected := range []string{"a", "b", "c"} {
+		assert.Equal(t, expected, <-sent)
+
+		elapsed := (<-times).Sub(start)
+		assert.True(t, elapsed >= time.Duration(i)*50*time.Millisecond, elapsed)
+		assert.True(t, elapsed < time.Duration(i)*50*time.Millisecond+40*time.Millisecond, elapsed)
+	}
+	assert.Equal(t, 0, s.Len())
+}
+
+func TestUDPSchedulerLoop(t *testing.T) {
+	times := make(chan time.Time, 6)
+
+	// Captured 200ms apart, replayed four times faster
+	offset := func(capture time.Duration) time.Duration { return capture / 4 }
+
+	s := newUDPScheduler(offset, 10, func(msg *proto.Message) {
+		times <- time.Now()
+	})
+
+	// Looped input restarts the file three times
+	start := time.Now()
+	for round := 0; round < 3; round++ {
+		for _, ts := range []int64{1000, 1000 + int64(200*time.Millisecond)} {
+			s.add(&proto.Message{Meta: proto.PayloadHeader(proto.RequestPayload, []byte("uuid"), ts, nil), Data: []byte("a")}, 0)
+		}
+	}
+
+	// Each round starts where the previous one ended
+	for _, expected := range []time.Duration{0, 50, 50, 100, 100, 150} {
+		expected *= time.Millisecond
+		elapsed := (<-times).Sub(start)
+		assert.True(t, elapsed >= expected, elapsed)
+		assert.True(t, elapsed < expected+40*time.Millisecond, elapsed)
+	}
+}
+
+func TestUDPSchedulerClose(t *testing.T) {
+	s := newUDPScheduler(func(capture time.Duration) time.Duration { return capture }, 1, func(msg *proto.Message) {})
+
+	// The only slot is taken by message scheduled far ahead
+	s.add(&proto.Message{Meta: proto.PayloadHeader(proto.RequestPayload, []byte("uuid"), 1, nil)}, time.Hour)
+
+	added := make(chan struct{})
+	go func() {
+		s.add(&proto.Message{Meta: proto.PayloadHeader(proto.RequestPayload, []byte("uuid"), 1, nil)}, 0)
+		close(added)
+	}()
+
+	// Writer blocked on full scheduler is released by close
+	s.close()
+	select {
+	case <-added:
+	case <-time.After(time.Second):
+		t.Fatal("add is blocked after close")
+	}
+	assert.Equal(t, 1, s.Len())
+}
@@ -0,0 +1,249 @@
+package output
+
+import (
+	"context"
+	"github.com/myzhan/goreplay-udp/proto"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUDPOutputDrainAndClose(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer server.Close()
+
+	o, err := NewUDPOutput(server.LocalAddr().String(), &UDPOutputConfig{Workers: 2, Timeout: time.Second, IgnoreResponse: true})
+	assert.Nil(t, err)
+
+	for i := 0; i < 5; i++ {
+		_, err := o.PluginWrite(&proto.Message{Meta: proto.PayloadHeader(proto.RequestPayload, []byte("uuid"), 1, nil), Data: []byte("data")})
+		assert.Nil(t, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.Equal(t, 0, o.Drain(ctx))
+
+	buf := make([]byte, 16)
+	for i := 0; i < 5; i++ {
+		server.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := server.ReadFrom(buf)
+		assert.Nil(t, err)
+		assert.Equal(t, "data", string(buf[:n]))
+	}
+
+	assert.Nil(t, o.Close())
+	assert.Nil(t, o.Close())
+
+	_, err = o.PluginWrite(&proto.Message{Meta: proto.PayloadHeader(proto.RequestPayload, []byte("uuid"), 1, nil), Data: []byte("data")})
+	assert.Equal(t, ErrorStopped, err)
+
+	_, err = o.PluginRead()
+	assert.Equal(t, ErrorStopped, err)
+}
+
+func TestNewUDPOutputError(t *testing.T) {
+	_, err := NewUDPOutput("127.0.0.1:53", &UDPOutputConfig{OriginalDestination: true, RawSocket: true})
+	assert.NotNil(t, err)
+
+	_, err = NewUDPOutput("127.0.0.1:53", &UDPOutputConfig{Timing: true})
+	assert.NotNil(t, err)
+}
+
+func TestUDPOutputRawConfig(t *testing.T) {
+	config := &UDPOutputConfig{Workers: 1, Timeout: time.Second, RawSocket: true}
+	o, err := NewUDPOutput("127.0.0.1:53", config)
+	if err != nil {
+		t.Skip("raw socket is not available:", err)
+	}
+	defer o.Close()
+
+	// Responses are ignored without changing config shared with other outputs
+	assert.True(t, o.ignoreResponse)
+	assert.False(t, config.IgnoreResponse)
+	_, err = o.PluginRead()
+	assert.Equal(t, ErrorStopped, err)
+}
+
+func TestUDPOutputSendError(t *testing.T) {
+	o, err := NewUDPOutput("127.0.0.1:9", &UDPOutputConfig{Workers: 1, Timeout: time.Second, IgnoreResponse: true})
+	assert.Nil(t, err)
+	defer o.Close()
+
+	write := func(size int) error {
+		_, err := o.PluginWrite(&proto.Message{Meta: proto.PayloadHeader(proto.RequestPayload, []byte("uuid"), 1, nil), Data: make([]byte, size)})
+		return err
+	}
+
+	// Datagram too large fails in worker, the next write reports it
+	assert.Nil(t, write(70000))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.Equal(t, 0, o.Drain(ctx))
+
+	assert.IsType(t, &SendError{}, write(1))
+	assert.Nil(t, write(1))
+}
+
+func destinationMeta(dst string, port int) []byte {
+	meta := proto.PayloadHeader(proto.RequestPayload, []byte("uuid"), 1, net.ParseIP("10.0.0.1").To4())
+	meta = proto.AppendMetaField(meta, proto.SrcPortField, "5353")
+	meta = proto.AppendMetaField(meta, proto.DstField, dst)
+	return proto.AppendMetaField(meta, proto.DstPortField, strconv.Itoa(port))
+}
+
+func TestUDPOutputOriginalDestination(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer server.Close()
+
+	serverAddr := server.LocalAddr().String()
+	o, err := NewUDPOutput("127.0.0.1:9", &UDPOutputConfig{
+		Workers:             1,
+		Timeout:             time.Second,
+		IgnoreResponse:      true,
+		OriginalDestination: true,
+		DestinationMap:      []string{"10.0.0.53:53=" + serverAddr},
+	})
+	assert.Nil(t, err)
+	defer o.Close()
+
+	// Recorded destination is translated through the map
+	mapped := &proto.Message{Meta: destinationMeta("10.0.0.53", 53), Data: []byte("data")}
+	assert.Equal(t, serverAddr, o.destination(mapped))
+
+	// Destinations missing in the map are used as they are
+	assert.Equal(t, "10.0.0.54:53", o.destination(&proto.Message{Meta: destinationMeta("10.0.0.54", 53)}))
+
+	// Output address is used when meta has no destination
+	assert.Equal(t, "127.0.0.1:9", o.destination(&proto.Message{Meta: proto.PayloadHeader(proto.RequestPayload, []byte("uuid"), 1, nil)}))
+
+	_, err = o.PluginWrite(mapped)
+	assert.Nil(t, err)
+
+	buf := make([]byte, 16)
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := server.ReadFrom(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "data", string(buf[:n]))
+}
+
+func TestUDPOutputIPv6(t *testing.T) {
+	server, err := net.ListenPacket("udp6", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 is not available:", err)
+	}
+	defer server.Close()
+
+	// Datagram goes to its recorded IPv6 destination from socket of its flow
+	o, err := NewUDPOutput("127.0.0.1:9", &UDPOutputConfig{Workers: 1, Timeout: time.Second, IgnoreResponse: true, OriginalDestination: true, FlowAffinity: true})
+	assert.Nil(t, err)
+	defer o.Close()
+
+	meta := proto.PayloadHeader(proto.RequestPayload, []byte("uuid"), 1, net.ParseIP("fe80::1"))
+	meta = proto.AppendMetaField(meta, proto.SrcPortField, "5353")
+	meta = proto.AppendMetaField(meta, proto.DstField, "::1")
+	meta = proto.AppendMetaField(meta, proto.DstPortField, strconv.Itoa(server.LocalAddr().(*net.UDPAddr).Port))
+	assert.Equal(t, "[fe80::1]:5353", flowKey(meta))
+
+	_, err = o.PluginWrite(&proto.Message{Meta: meta, Data: []byte("data")})
+	assert.Nil(t, err)
+
+	buf := make([]byte, 16)
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := server.ReadFrom(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "data", string(buf[:n]))
+}
+
+func TestUDPOutputFlowAffinity(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer server.Close()
+
+	o, err := NewUDPOutput(server.LocalAddr().String(), &UDPOutputConfig{Timeout: time.Second, IgnoreResponse: true, FlowAffinity: true, FlowIdleTimeout: 50 * time.Millisecond})
+	assert.Nil(t, err)
+	defer o.Close()
+
+	write := func(data string) {
+		meta := proto.PayloadHeader(proto.RequestPayload, []byte("uuid"), 1, net.ParseIP("10.0.0.1"))
+		meta = proto.AppendMetaField(meta, proto.SrcPortField, "5353")
+		_, err := o.PluginWrite(&proto.Message{Meta: meta, Data: []byte(data)})
+		assert.Nil(t, err)
+	}
+	read := func() (string, net.Addr) {
+		buf := make([]byte, 16)
+		server.SetReadDeadline(time.Now().Add(time.Second))
+		n, addr, err := server.ReadFrom(buf)
+		assert.Nil(t, err)
+		return string(buf[:n]), addr
+	}
+
+	// Datagrams of one flow are sent in order from the same socket
+	for i := 0; i < 50; i++ {
+		write(strconv.Itoa(i))
+	}
+	_, first := read()
+	for i := 1; i < 50; i++ {
+		data, addr := read()
+		assert.Equal(t, strconv.Itoa(i), data)
+		assert.Equal(t, first.String(), addr.String())
+	}
+
+	// Idle flow is evicted and its socket closed, next datagram starts new one
+	assert.Eventually(t, func() bool { return atomic.LoadInt64(&o.activeFlows) == 0 }, time.Second, 10*time.Millisecond)
+	o.flowsMu.Lock()
+	assert.Equal(t, 0, len(o.flows))
+	o.flowsMu.Unlock()
+
+	write("again")
+	data, _ := read()
+	assert.Equal(t, "again", data)
+	assert.Equal(t, int64(1), atomic.LoadInt64(&o.activeFlows))
+}
+
+func TestUDPOutputFlowLimits(t *testing.T) {
+	o, err := NewUDPOutput("127.0.0.1:9", &UDPOutputConfig{Timeout: time.Second, IgnoreResponse: true, FlowAffinity: true, MaxFlows: 2})
+	assert.Nil(t, err)
+	defer o.Close()
+
+	// Flow with full queue and no worker
+	stuck := &udpFlow{key: "10.0.0.1:1", queue: make(chan *proto.Message)}
+	o.flows[stuck.key] = stuck
+
+	write := func(port string) {
+		meta := proto.PayloadHeader(proto.RequestPayload, []byte("uuid"), 1, net.ParseIP("10.0.0.1"))
+		done := make(chan struct{})
+		go func() {
+			o.writeFlow(&proto.Message{Meta: proto.AppendMetaField(meta, proto.SrcPortField, port), Data: []byte("a")})
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("dispatcher is blocked by flow", port)
+		}
+	}
+
+	// Datagram of full flow is dropped instead of waiting
+	write("1")
+	assert.Equal(t, uint64(1), o.dropped.Value())
+	assert.Equal(t, int32(0), atomic.LoadInt32(&stuck.writers))
+
+	// New flows are dropped above limit
+	write("2")
+	write("3")
+	assert.Equal(t, uint64(2), o.dropped.Value())
+	o.flowsMu.Lock()
+	assert.Equal(t, 2, len(o.flows))
+	o.flowsMu.Unlock()
+
+	// Drops are reported by the next write
+	_, err = o.PluginWrite(&proto.Message{Meta: proto.PayloadHeader(proto.RequestPayload, []byte("uuid"), 1, nil), Data: []byte("a")})
+	assert.IsType(t, &SendError{}, err)
+}
@@ -0,0 +1,41 @@
+package output
+
+import (
+	"fmt"
+	"sync"
+)
+
+// SendError is returned by write of outputs sending messages from their own workers, it reports that an earlier
+// message failed to send. Message being written is queued anyway, so it shouldn't be written again.
+type SendError struct {
+	Err error
+}
+
+func (e *SendError) Error() string {
+	return fmt.Sprintf("send error: %v", e.Err)
+}
+
+// sendErrorSlot keeps error of a worker until the next write reports it
+type sendErrorSlot struct {
+	mu  sync.Mutex
+	err error
+}
+
+func (s *sendErrorSlot) set(err error) {
+	s.mu.Lock()
+	s.err = err
+	s.mu.Unlock()
+}
+
+// take returns SendError of the last failed send since previous call, nil if there was none
+func (s *sendErrorSlot) take() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err == nil {
+		return nil
+	}
+	err := &SendError{s.err}
+	s.err = nil
+	return err
+}
@@ -0,0 +1,94 @@
+package pipeline
+
+import (
+	"fmt"
+	"github.com/myzhan/goreplay-udp/output"
+	"github.com/myzhan/goreplay-udp/proto"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// Ways to handle message an output failed to write
+const (
+	ErrorPolicyRetry   = "retry"
+	ErrorPolicySkip    = "skip"
+	ErrorPolicyDisable = "disable"
+	ErrorPolicyAbort   = "abort"
+)
+
+// Skipped messages are logged at most once per this interval
+const errorLogInterval = 10 * time.Second
+
+// ErrorPolicy decides what happens with message an output failed to write, empty Mode skips the message.
+// Policy keeps state of its output, so each output needs its own policy.
+type ErrorPolicy struct {
+	Mode string
+	// Retries and backoff delay before the first retry used by retry mode, delay doubles after each attempt
+	Retries int
+	Delay   time.Duration
+
+	disabled int32
+	lastLog  int64
+}
+
+// ValidateErrorPolicy checks that mode is one of known policies
+func ValidateErrorPolicy(mode string) error {
+	switch mode {
+	case ErrorPolicyRetry, ErrorPolicySkip, ErrorPolicyDisable, ErrorPolicyAbort:
+		return nil
+	}
+	return fmt.Errorf("unknown output error policy %q, available: %s, %s, %s, %s", mode, ErrorPolicyRetry, ErrorPolicySkip, ErrorPolicyDisable, ErrorPolicyAbort)
+}
+
+// Disabled reports if output was disabled after write error
+func (p *ErrorPolicy) Disabled() bool {
+	return atomic.LoadInt32(&p.disabled) != 0
+}
+
+// write writes message to output applying the policy, returns error only when copying should stop.
+// Stopped output is disabled whatever the mode, so the rest of outputs keep getting messages.
+func (p *ErrorPolicy) write(out PluginWriter, msg *proto.Message, metrics *pluginMetrics) error {
+	if p.Disabled() {
+		return nil
+	}
+
+	_, err := out.PluginWrite(msg)
+	_, queued := err.(*output.SendError)
+
+	if p.Mode == ErrorPolicyRetry {
+		// Backoff doubles after each attempt, message queued by output isn't written again
+		delay := p.Delay
+		for i := 0; i < p.Retries && err != nil && err != output.ErrorStopped && !queued; i++ {
+			time.Sleep(delay)
+			delay *= 2
+			_, err = out.PluginWrite(msg)
+		}
+	}
+	metrics.count(msg, err)
+
+	if err == nil {
+		return nil
+	}
+	if err == output.ErrorStopped {
+		atomic.StoreInt32(&p.disabled, 1)
+		return nil
+	}
+
+	switch p.Mode {
+	case ErrorPolicyAbort:
+		return fmt.Errorf("%s write error: %v", out, err)
+	case ErrorPolicyDisable:
+		if atomic.CompareAndSwapInt32(&p.disabled, 0, 1) {
+			log.Printf("%s is disabled after write error: %v\n", out, err)
+		}
+	default:
+		now := time.Now().UnixNano()
+		last := atomic.LoadInt64(&p.lastLog)
+		if now-last > int64(errorLogInterval) && atomic.CompareAndSwapInt64(&p.lastLog, last, now) {
+			log.Printf("%s write error, message is dropped: %v\n", out, err)
+		}
+	}
+
+	return nil
+}
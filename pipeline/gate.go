@@ -0,0 +1,64 @@
+package pipeline
+
+import (
+	"sync"
+)
+
+// pauseGate blocks reading from input while it is paused
+type pauseGate struct {
+	mu      sync.Mutex
+	resumed chan struct{}
+}
+
+func newPauseGate() *pauseGate {
+	g := &pauseGate{resumed: make(chan struct{})}
+	close(g.resumed)
+	return g
+}
+
+func (g *pauseGate) pause() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	select {
+	case <-g.resumed:
+		g.resumed = make(chan struct{})
+	default:
+	}
+}
+
+func (g *pauseGate) resume() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	select {
+	case <-g.resumed:
+	default:
+		close(g.resumed)
+	}
+}
+
+func (g *pauseGate) paused() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	select {
+	case <-g.resumed:
+		return false
+	default:
+		return true
+	}
+}
+
+// wait blocks while input is paused, nil gate never blocks
+func (g *pauseGate) wait() {
+	if g == nil {
+		return
+	}
+
+	g.mu.Lock()
+	resumed := g.resumed
+	g.mu.Unlock()
+
+	<-resumed
+}
@@ -0,0 +1,296 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"github.com/myzhan/goreplay-udp/output"
+	"github.com/myzhan/goreplay-udp/proto"
+	"github.com/myzhan/goreplay-udp/stats"
+	"hash/fnv"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limiter is a wrapper for input or output plugin which adds rate limiting
+type Limiter struct {
+	plugin    interface{}
+	limit     float64
+	burst     float64
+	isPercent bool
+	perSource bool
+
+	mu      sync.Mutex
+	bucket  *tokenBucket
+	sources map[string]*tokenBucket
+	swept   time.Time
+
+	dropped *stats.Counter
+
+	// Clock of token buckets, replaced in tests
+	now func() time.Time
+}
+
+// tokenBucket allows rate events per second on average, with bursts up to its size
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// allow takes token if there is one, refilling bucket for time passed since last call
+func (b *tokenBucket) allow(now time.Time, rate, burst float64) bool {
+	b.refill(now, rate, burst)
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (b *tokenBucket) refill(now time.Time, rate, burst float64) {
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+}
+
+// parseLimitOptions parses limit in form of <rate>[,burst=N][,per-source] or <percent>%
+func parseLimitOptions(options string) (limit, burst float64, isPercent, perSource bool, err error) {
+	parts := strings.Split(options, ",")
+
+	value := strings.TrimSpace(parts[0])
+	if strings.HasSuffix(value, "%") {
+		value = strings.TrimSuffix(value, "%")
+		isPercent = true
+	}
+
+	if limit, err = strconv.ParseFloat(value, 64); err != nil || limit < 0 {
+		return 0, 0, false, false, fmt.Errorf("invalid limit %q", options)
+	}
+
+	for _, opt := range parts[1:] {
+		opt = strings.TrimSpace(opt)
+
+		switch {
+		case opt == "per-source":
+			perSource = true
+		case strings.HasPrefix(opt, "burst="):
+			if burst, err = strconv.ParseFloat(opt[len("burst="):], 64); err != nil || burst < 1 {
+				return 0, 0, false, false, fmt.Errorf("invalid limit burst %q", options)
+			}
+		default:
+			return 0, 0, false, false, fmt.Errorf("unknown limit option %q", opt)
+		}
+	}
+
+	if isPercent && (burst != 0 || perSource) {
+		return 0, 0, false, false, fmt.Errorf("burst and per-source can't be used with percent limit %q", options)
+	}
+
+	// By default bucket holds one second worth of tokens
+	if burst == 0 && limit > 0 {
+		burst = math.Max(1, limit)
+	}
+
+	return limit, burst, isPercent, perSource, nil
+}
+
+// ValidateLimit checks limit options without creating limiter
+func ValidateLimit(options string) error {
+	_, _, _, _, err := parseLimitOptions(options)
+	return err
+}
+
+// NewLimiter constructor for Limiter, accepts plugin and options
+// `options` allow to specify absolute rate in requests per second, or percent of clients to sample
+func NewLimiter(plugin interface{}, options string) (PluginReadWriter, error) {
+	l := new(Limiter)
+
+	var err error
+	if l.limit, l.burst, l.isPercent, l.perSource, err = parseLimitOptions(options); err != nil {
+		return nil, err
+	}
+
+	l.plugin = plugin
+	l.now = time.Now
+	l.bucket = &tokenBucket{tokens: l.burst, last: l.now()}
+	l.sources = make(map[string]*tokenBucket)
+	l.swept = l.now()
+	l.dropped = new(stats.Counter)
+
+	l.applySpeed()
+
+	return l, nil
+}
+
+// applySpeed sets speed of file inputs from percent limit, speed is kept as it is for absolute limits
+func (l *Limiter) applySpeed() {
+	if !l.isPercent {
+		return
+	}
+
+	// File inputs have their own rate limiting. Unlike other inputs we not just dropping requests, we can slow down or speed up request emittion.
+	if s, ok := l.plugin.(SpeedController); ok {
+		s.SetSpeed(l.limit / 100)
+	}
+}
+
+// RegisterMetrics registers counter of dropped messages and metrics of the wrapped plugin
+func (l *Limiter) RegisterMetrics(r *stats.Registry) {
+	l.dropped = r.Counter("goreplay_udp_messages_dropped_total", "Number of messages dropped", "plugin", fmt.Sprint(l.plugin), "reason", "limit")
+
+	if m, ok := l.plugin.(MetricsRegisterer); ok {
+		m.RegisterMetrics(r)
+	}
+}
+
+// Plugin returns the wrapped plugin
+func (l *Limiter) Plugin() interface{} {
+	return l.plugin
+}
+
+// SetLimit changes limit of running plugin, accepts the same options as plugin address after "|"
+func (l *Limiter) SetLimit(options string) error {
+	limit, burst, isPercent, perSource, err := parseLimitOptions(options)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.limit, l.burst, l.isPercent, l.perSource = limit, burst, isPercent, perSource
+	l.bucket = &tokenBucket{tokens: l.burst, last: l.now()}
+	l.sources = make(map[string]*tokenBucket)
+	l.applySpeed()
+
+	return nil
+}
+
+// Limit returns current limit in the same format as SetLimit accepts
+func (l *Limiter) Limit() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.isPercent {
+		return strconv.FormatFloat(l.limit, 'f', -1, 64) + "%"
+	}
+
+	limit := strconv.FormatFloat(l.limit, 'f', -1, 64) + ",burst=" + strconv.FormatFloat(l.burst, 'f', -1, 64)
+	if l.perSource {
+		limit += ",per-source"
+	}
+	return limit
+}
+
+func (l *Limiter) isLimited(msg *proto.Message) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// File inputs have their own limiting algorithm
+	if _, ok := l.plugin.(SpeedController); ok && l.isPercent {
+		return false
+	}
+
+	if l.isPercent {
+		return !sampled(msg.Meta, l.limit)
+	}
+
+	now := l.now()
+	if !l.perSource {
+		return !l.bucket.allow(now, l.limit, l.burst)
+	}
+
+	// Each client has its own bucket, client is identified by source IP and port
+	m := proto.ParseMeta(msg.Meta)
+	src := string(m.SrcIP) + ":" + strconv.Itoa(int(m.SrcPort))
+	bucket, ok := l.sources[src]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.sources[src] = bucket
+	}
+	limited := !bucket.allow(now, l.limit, l.burst)
+
+	// Full buckets are the same as new ones, so they are dropped to keep memory bounded
+	if now.Sub(l.swept) > time.Minute {
+		for k, b := range l.sources {
+			if b.refill(now, l.limit, l.burst); b.tokens >= l.burst {
+				delete(l.sources, k)
+			}
+		}
+		l.swept = now
+	}
+
+	return limited
+}
+
+// sampled deterministically picks percent of clients by hash of their address, so all datagrams of a client
+// are kept together. Messages without addresses are sampled by UUID, which keeps requests with their responses.
+func sampled(meta []byte, percent float64) bool {
+	var h uint32
+	if m := proto.ParseMeta(meta); m.SrcIP != nil || m.DstIP != nil {
+		h = flowHash(meta)
+	} else {
+		hash := fnv.New32a()
+		hash.Write(m.UUID)
+		h = hash.Sum32()
+	}
+
+	return float64(h%10000) < percent*100
+}
+
+func (l *Limiter) PluginWrite(msg *proto.Message) (n int, err error) {
+	if l.isLimited(msg) {
+		l.dropped.Inc()
+		return 0, nil
+	}
+
+	n, err = l.plugin.(PluginWriter).PluginWrite(msg)
+
+	return
+}
+
+func (l *Limiter) PluginRead() (msg *proto.Message, err error) {
+	if r, ok := l.plugin.(PluginReader); ok {
+		msg, err = r.PluginRead()
+	} else {
+		return nil, output.ErrorStopped
+	}
+
+	if err != nil || msg == nil {
+		return
+	}
+
+	if l.isLimited(msg) {
+		l.dropped.Inc()
+		return nil, nil
+	}
+
+	return
+}
+
+// Drain waits for the wrapped plugin to send queued messages
+func (l *Limiter) Drain(ctx context.Context) int {
+	if d, ok := l.plugin.(PluginDrainer); ok {
+		return d.Drain(ctx)
+	}
+	return 0
+}
+
+// Close closes the wrapped plugin
+func (l *Limiter) Close() error {
+	if c, ok := l.plugin.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// String names limiter by its plugin only, so it doesn't change with limit, current limit is returned by Limit
+func (l *Limiter) String() string {
+	return fmt.Sprintf("Limiting %s", l.plugin)
+}
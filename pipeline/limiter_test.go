@@ -0,0 +1,152 @@
+package pipeline
+
+import (
+	"github.com/myzhan/goreplay-udp/proto"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func sourceMessage(ip string, port int) *proto.Message {
+	meta := proto.PayloadHeader(proto.RequestPayload, []byte("uuid"), 1, net.ParseIP(ip).To4())
+	meta = proto.AppendMetaField(meta, proto.SrcPortField, strconv.Itoa(port))
+	return &proto.Message{Meta: meta, Data: []byte("a")}
+}
+
+// newTestLimiter limits output with clock moved by returned function
+func newTestLimiter(t *testing.T, options string) (*Limiter, *testOutput, func(time.Duration)) {
+	out := new(testOutput)
+	plugin, err := NewLimiter(out, options)
+	assert.Nil(t, err)
+
+	l := plugin.(*Limiter)
+	now := time.Unix(1000, 0)
+	l.now = func() time.Time { return now }
+	l.bucket.last = now
+	l.swept = now
+
+	return l, out, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestLimiterRate(t *testing.T) {
+	type step struct {
+		advance time.Duration
+		writes  int
+		allowed int
+	}
+
+	for _, c := range []struct {
+		options string
+		steps   []step
+	}{
+		// Bucket holds one second worth of tokens by default
+		{"10", []step{{0, 15, 10}, {100 * time.Millisecond, 5, 1}, {250 * time.Millisecond, 5, 2}, {10 * time.Second, 15, 10}}},
+		{"5,burst=2", []step{{0, 3, 2}, {200 * time.Millisecond, 3, 1}, {10 * time.Second, 3, 2}}},
+		{"0.5", []step{{0, 2, 1}, {time.Second, 1, 0}, {time.Second, 1, 1}}},
+		{"0", []step{{0, 5, 0}, {time.Minute, 5, 0}}},
+	} {
+		l, out, advance := newTestLimiter(t, c.options)
+
+		total, dropped := 0, 0
+		for i, s := range c.steps {
+			advance(s.advance)
+			for j := 0; j < s.writes; j++ {
+				l.PluginWrite(sourceMessage("10.0.0.1", 1024))
+			}
+
+			total += s.allowed
+			dropped += s.writes - s.allowed
+			assert.Equal(t, total, len(out.payloads), "%s step %d", c.options, i)
+		}
+		assert.Equal(t, uint64(dropped), l.dropped.Value(), c.options)
+	}
+}
+
+func TestLimiterPerSource(t *testing.T) {
+	l, out, advance := newTestLimiter(t, "1,burst=2,per-source")
+
+	write := func(ip string, port, n int) int {
+		before := len(out.payloads)
+		for i := 0; i < n; i++ {
+			l.PluginWrite(sourceMessage(ip, port))
+		}
+		return len(out.payloads) - before
+	}
+
+	// Busy source doesn't use up tokens of the others, clients on one IP are told apart by port
+	assert.Equal(t, 2, write("10.0.0.1", 1024, 5))
+	assert.Equal(t, 2, write("10.0.0.2", 1024, 5))
+	assert.Equal(t, 2, write("10.0.0.1", 1025, 5))
+	assert.Equal(t, 0, write("10.0.0.1", 1024, 1))
+
+	advance(time.Second)
+	assert.Equal(t, 1, write("10.0.0.1", 1024, 5))
+	assert.Equal(t, 1, write("10.0.0.2", 1024, 5))
+
+	// Buckets refilled while idle are swept
+	advance(2 * time.Minute)
+	assert.Equal(t, 2, write("10.0.0.3", 1024, 5))
+	assert.Equal(t, 1, len(l.sources))
+}
+
+func TestLimiterPercent(t *testing.T) {
+	for _, percent := range []float64{0, 10, 25, 50, 100} {
+		l, out, _ := newTestLimiter(t, strconv.FormatFloat(percent, 'f', -1, 64)+"%")
+
+		for round := 0; round < 2; round++ {
+			for i := 0; i < 10000; i++ {
+				msg := sourceMessage("10.0."+strconv.Itoa(i/250)+"."+strconv.Itoa(i%250), 1024+i)
+				msg.Data = []byte(strconv.Itoa(i))
+				l.PluginWrite(msg)
+			}
+		}
+
+		// Each flow is sampled as a whole, so both its datagrams are kept or dropped
+		kept := make(map[string]int)
+		for _, data := range out.payloads {
+			kept[data]++
+		}
+		for flow, n := range kept {
+			assert.Equal(t, 2, n, flow)
+		}
+		assert.InDelta(t, percent, float64(len(kept))/100, 2, "%v%%", percent)
+	}
+
+	// Without addresses request and its response are sampled together by UUID
+	for i := 0; i < 100; i++ {
+		uuid := []byte(strconv.Itoa(i))
+		assert.Equal(t, sampled(proto.PayloadHeader(proto.RequestPayload, uuid, 1, nil), 50),
+			sampled(proto.PayloadHeader(proto.ResponsePayload, uuid, 2, nil), 50))
+	}
+}
+
+// speedPlugin replays at speed set by limiter
+type speedPlugin struct {
+	testOutput
+	speed float64
+}
+
+func (p *speedPlugin) Speed() float64         { return p.speed }
+func (p *speedPlugin) SetSpeed(speed float64) { p.speed = speed }
+func (p *speedPlugin) String() string         { return "speed plugin" }
+
+func TestLimiterSetLimit(t *testing.T) {
+	plugin := &speedPlugin{speed: 1}
+	l, err := NewLimiter(plugin, "50%")
+	assert.Nil(t, err)
+	assert.Equal(t, 0.5, plugin.speed)
+
+	// Speed set apart from limiter is kept by absolute limit
+	plugin.SetSpeed(2)
+	assert.Nil(t, l.(*Limiter).SetLimit("10"))
+	assert.Equal(t, 2.0, plugin.speed)
+
+	assert.Nil(t, l.(*Limiter).SetLimit("20%"))
+	assert.Equal(t, 0.2, plugin.speed)
+	assert.Equal(t, "20%", l.(*Limiter).Limit())
+
+	// Name doesn't change with limit
+	assert.Equal(t, "Limiting speed plugin", l.(*Limiter).String())
+}
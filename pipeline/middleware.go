@@ -0,0 +1,231 @@
+package pipeline
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/myzhan/goreplay-udp/output"
+	"github.com/myzhan/goreplay-udp/proto"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Encodings of messages passed to middleware, one message per line
+const (
+	MiddlewareHex    = "hex"
+	MiddlewareBase64 = "base64"
+)
+
+// Middleware represents external process which transforms or filters messages.
+// Each message (meta header followed by payload) is written to its stdin as single encoded line,
+// and messages written back to its stdout are passed to outputs. Not echoed messages are dropped.
+type Middleware struct {
+	command  string
+	encoding string
+	data     chan *proto.Message
+	Stdin    io.Writer
+	Stdout   io.Reader
+
+	commandCancel context.CancelFunc
+	stop          chan bool
+	closed        bool
+	mu            sync.Mutex
+
+	// Writes to stdin may block on busy process, they are guarded separately so Close can kill it
+	writeMu sync.Mutex
+}
+
+// NewMiddleware starts middleware process, accepts command with arguments and encoding of messages
+func NewMiddleware(command string, encoding string) (*Middleware, error) {
+	m := new(Middleware)
+	m.command = command
+	m.encoding = encoding
+	m.data = make(chan *proto.Message, 1000)
+	m.stop = make(chan bool)
+
+	if m.encoding != MiddlewareHex && m.encoding != MiddlewareBase64 {
+		return nil, fmt.Errorf("[MIDDLEWARE] unknown encoding: %s", m.encoding)
+	}
+
+	commands := strings.Fields(command)
+	if len(commands) == 0 {
+		return nil, fmt.Errorf("[MIDDLEWARE] empty command")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	m.commandCancel = cancel
+	cmd := exec.CommandContext(ctx, commands[0], commands[1:]...)
+
+	m.Stdout, _ = cmd.StdoutPipe()
+	m.Stdin, _ = cmd.StdinPipe()
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Start(); err != nil {
+		cancel()
+		return nil, fmt.Errorf("[MIDDLEWARE] command[%q] error: %v", command, err)
+	}
+
+	go func() {
+		m.read(m.Stdout)
+
+		// Wait closes stdout, so it is called once the output is read
+		if err := cmd.Wait(); err != nil {
+			if e, ok := err.(*exec.ExitError); ok {
+				status := e.Sys().(syscall.WaitStatus)
+				// killed on Close
+				if status.Signal() == syscall.SIGKILL {
+					return
+				}
+			}
+			log.Println(fmt.Sprintf("[MIDDLEWARE] command[%q] error: %q", command, err.Error()))
+		}
+	}()
+
+	return m, nil
+}
+
+// ReadFrom starts passing messages of the plugin to middleware
+func (m *Middleware) ReadFrom(plugin PluginReader) {
+	go m.copy(m.Stdin, plugin, nil)
+}
+
+// CloseInput closes stdin of middleware process once there are no more messages for it.
+// PluginRead returns io.EOF when the process closes its stdout in turn.
+func (m *Middleware) CloseInput() error {
+	if c, ok := m.Stdin.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func (m *Middleware) encode(msg *proto.Message) []byte {
+	buf := make([]byte, 0, len(msg.Meta)+len(msg.Data))
+	buf = append(buf, msg.Meta...)
+	buf = append(buf, msg.Data...)
+
+	var dst []byte
+	if m.encoding == MiddlewareBase64 {
+		dst = make([]byte, base64.StdEncoding.EncodedLen(len(buf))+1)
+		base64.StdEncoding.Encode(dst, buf)
+	} else {
+		dst = make([]byte, hex.EncodedLen(len(buf))+1)
+		hex.Encode(dst, buf)
+	}
+	dst[len(dst)-1] = '\n'
+
+	return dst
+}
+
+func (m *Middleware) decode(line []byte) (buf []byte, err error) {
+	if m.encoding == MiddlewareBase64 {
+		buf = make([]byte, base64.StdEncoding.DecodedLen(len(line)))
+		n, err := base64.StdEncoding.Decode(buf, line)
+		return buf[:n], err
+	}
+
+	buf = make([]byte, hex.DecodedLen(len(line)))
+	_, err = hex.Decode(buf, line)
+	return buf, err
+}
+
+// copy passes messages of the plugin to middleware, waiting while gate is paused
+func (m *Middleware) copy(to io.Writer, from PluginReader, gate *pauseGate) {
+	for {
+		gate.wait()
+
+		msg, err := from.PluginRead()
+		if err != nil {
+			return
+		}
+		if msg == nil || len(msg.Data) == 0 {
+			continue
+		}
+
+		dst := m.encode(msg)
+
+		m.writeMu.Lock()
+		_, err = to.Write(dst)
+		m.writeMu.Unlock()
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (m *Middleware) read(from io.Reader) {
+	defer close(m.data)
+
+	reader := bufio.NewReader(from)
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			break
+		}
+
+		line = line[:len(line)-1]
+		if len(line) == 0 {
+			continue
+		}
+
+		buf, err := m.decode(line)
+		if err != nil {
+			log.Println(fmt.Sprintf("[MIDDLEWARE] failed to decode err: %q", err))
+			continue
+		}
+
+		var msg proto.Message
+		msg.Meta, msg.Data = proto.PayloadMetaWithBody(buf)
+		if len(msg.Meta) == 0 {
+			log.Println(fmt.Sprintf("[MIDDLEWARE] message without meta header is dropped: %q", line))
+			continue
+		}
+
+		select {
+		case <-m.stop:
+			return
+		case m.data <- &msg:
+		}
+	}
+}
+
+// PluginRead reads message from this plugin
+func (m *Middleware) PluginRead() (msg *proto.Message, err error) {
+	var ok bool
+	select {
+	case <-m.stop:
+		return nil, output.ErrorStopped
+	case msg, ok = <-m.data:
+	}
+
+	if !ok {
+		return nil, io.EOF
+	}
+	return
+}
+
+func (m *Middleware) String() string {
+	return fmt.Sprintf("Modifying traffic using %q command", m.command)
+}
+
+// Close stops middleware process
+func (m *Middleware) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+
+	m.commandCancel()
+	close(m.stop)
+	return nil
+}
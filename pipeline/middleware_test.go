@@ -0,0 +1,103 @@
+package pipeline
+
+import (
+	"context"
+	"github.com/myzhan/goreplay-udp/proto"
+	"github.com/stretchr/testify/assert"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMiddlewareRoundTrip(t *testing.T) {
+	if _, err := exec.LookPath("cat"); err != nil {
+		t.Skip("cat is not available")
+	}
+
+	for _, encoding := range []string{MiddlewareHex, MiddlewareBase64} {
+		m, err := NewMiddleware("cat", encoding)
+		assert.Nil(t, err)
+
+		meta := proto.PayloadHeader(proto.RequestPayload, []byte("uuid"), 1, nil)
+		m.ReadFrom(newTestInput(true, "a\nb"))
+
+		select {
+		case msg := <-m.data:
+			assert.Equal(t, meta, msg.Meta)
+			assert.Equal(t, "a\nb", string(msg.Data))
+		case <-time.After(time.Second):
+			t.Fatal("message is not echoed by", encoding, "middleware")
+		}
+
+		assert.Nil(t, m.Close())
+		assert.Nil(t, m.Close())
+	}
+}
+
+func TestMiddlewareMalformed(t *testing.T) {
+	m := &Middleware{encoding: MiddlewareHex, data: make(chan *proto.Message, 10), stop: make(chan bool)}
+
+	valid := m.encode(&proto.Message{Meta: proto.PayloadHeader(proto.RequestPayload, []byte("uuid"), 1, nil), Data: []byte("data")})
+	m.read(strings.NewReader("zz\n\n" + string(m.encode(&proto.Message{Data: []byte("no meta")})) + string(valid)))
+
+	// Lines not decoded or without meta header are dropped
+	assert.Equal(t, 1, len(m.data))
+	msg := <-m.data
+	assert.Equal(t, "data", string(msg.Data))
+	assert.True(t, proto.IsRequestPayload(msg.Meta))
+}
+
+func TestMiddlewareCloseBlockedWrite(t *testing.T) {
+	if _, err := exec.LookPath("sleep"); err != nil {
+		t.Skip("sleep is not available")
+	}
+
+	// Process never reads its stdin, so writes block once pipe is full
+	m, err := NewMiddleware("sleep 3", MiddlewareHex)
+	assert.Nil(t, err)
+
+	payloads := make([]string, 100)
+	for i := range payloads {
+		payloads[i] = strings.Repeat("a", 4096)
+	}
+	m.ReadFrom(newTestInput(true, payloads...))
+	time.Sleep(100 * time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		m.Close()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("close is blocked by write to middleware")
+	}
+}
+
+func TestPipelineMiddlewareEnd(t *testing.T) {
+	if _, err := exec.LookPath("cat"); err != nil {
+		t.Skip("cat is not available")
+	}
+
+	out := new(testOutput)
+	p := New(Config{Middleware: "cat"})
+	assert.Nil(t, p.AddInput(newTestInput(false, "a", "b")))
+	assert.Nil(t, p.AddOutput(out, nil))
+
+	// Run ends once input is finished and middleware echoed the rest
+	done := make(chan error)
+	go func() {
+		done <- p.Run(context.Background())
+	}()
+
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("pipeline with middleware is not finished")
+	}
+	assert.Equal(t, []string{"a", "b"}, out.payloads)
+}
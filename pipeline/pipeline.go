@@ -0,0 +1,610 @@
+// Package pipeline copies messages from input plugins to output plugins. It is what goreplay-udp command runs,
+// and can be embedded to replay traffic in-process:
+//
+//	p := pipeline.New(pipeline.Config{})
+//	p.AddInput(in)
+//	p.AddOutput(out, &pipeline.ErrorPolicy{Mode: pipeline.ErrorPolicyAbort})
+//	err := p.Run(ctx)
+package pipeline
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/myzhan/goreplay-udp/dns"
+	"github.com/myzhan/goreplay-udp/modifier"
+	"github.com/myzhan/goreplay-udp/output"
+	"github.com/myzhan/goreplay-udp/proto"
+	"github.com/myzhan/goreplay-udp/stats"
+	"hash/fnv"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Ways to distribute traffic when Config.SplitOutput is set
+const (
+	SplitRoundRobin = "round-robin"
+	SplitFlowHash   = "flow-hash"
+)
+
+// ErrorStarted is returned when pipeline is run while running or plugins are added to running pipeline
+var ErrorStarted = errors.New("pipeline is already started")
+
+// Config of pipeline, zero value copies every message from each input to all outputs
+type Config struct {
+	// SplitOutput sends each message to one of outputs picked by SplitMode, round-robin by default
+	SplitOutput bool
+	SplitMode   string
+
+	// Middleware is command which transforms or filters messages, encoded as MiddlewareHex by default
+	Middleware         string
+	MiddlewareEncoding string
+
+	// Modifier and DNS filter and rewrite requests, replayed responses get their DNS IDs restored
+	Modifier *modifier.Modifier
+	DNS      *dns.Modifier
+
+	// ShutdownTimeout is how long outputs get to send queued messages on stop, 5s by default
+	ShutdownTimeout time.Duration
+
+	// Metrics gets counters of messages read and written by plugins and metrics of plugins themselves,
+	// each pipeline has its own registry by default
+	Metrics *stats.Registry
+}
+
+// Pipeline copies messages from inputs to outputs. Plugins are closed when it stops, so to run pipeline again
+// new plugins are added, which replace the stopped ones.
+type Pipeline struct {
+	config Config
+
+	mu       sync.Mutex
+	started  bool
+	stopped  bool
+	running  int32
+	inputs   []PluginReader
+	outputs  []PluginWriter
+	all      []interface{}
+	gates    map[PluginReader]*pauseGate
+	policies map[PluginWriter]*ErrorPolicy
+	read     map[interface{}]*pluginMetrics
+	written  map[interface{}]*pluginMetrics
+}
+
+// New constructor for Pipeline
+func New(config Config) *Pipeline {
+	if config.SplitMode == "" {
+		config.SplitMode = SplitRoundRobin
+	}
+	if config.MiddlewareEncoding == "" {
+		config.MiddlewareEncoding = MiddlewareHex
+	}
+	if config.ShutdownTimeout == 0 {
+		config.ShutdownTimeout = 5 * time.Second
+	}
+	if config.Metrics == nil {
+		config.Metrics = stats.NewRegistry()
+	}
+
+	config.Modifier.RegisterMetrics(config.Metrics)
+	config.DNS.RegisterMetrics(config.Metrics)
+
+	p := &Pipeline{config: config}
+	p.reset()
+	return p
+}
+
+// reset forgets plugins, must be called with p.mu held
+func (p *Pipeline) reset() {
+	p.stopped = false
+	p.inputs = nil
+	p.outputs = nil
+	p.all = nil
+	p.gates = make(map[PluginReader]*pauseGate)
+	p.policies = make(map[PluginWriter]*ErrorPolicy)
+	p.read = make(map[interface{}]*pluginMetrics)
+	p.written = make(map[interface{}]*pluginMetrics)
+}
+
+// add prepares adding plugin, plugins of the previous run are forgotten. Must be called with p.mu held.
+func (p *Pipeline) add(plugin interface{}) error {
+	if p.started {
+		return ErrorStarted
+	}
+	if p.stopped {
+		p.reset()
+	}
+
+	if m, ok := plugin.(MetricsRegisterer); ok {
+		m.RegisterMetrics(p.config.Metrics)
+	}
+
+	p.all = append(p.all, plugin)
+	return nil
+}
+
+// AddInput adds input plugin, returns ErrorStarted while pipeline is running
+func (p *Pipeline) AddInput(in PluginReader) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.add(in); err != nil {
+		return err
+	}
+
+	p.inputs = append(p.inputs, in)
+	p.gates[in] = newPauseGate()
+	p.read[in] = p.readMetrics(in)
+
+	return nil
+}
+
+// AddOutput adds output plugin with its error policy, nil policy skips messages output failed to write.
+// Outputs which are readers as well emit replayed responses, which are written to all outputs.
+func (p *Pipeline) AddOutput(out PluginWriter, policy *ErrorPolicy) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.add(out); err != nil {
+		return err
+	}
+
+	if policy == nil {
+		policy = &ErrorPolicy{Mode: ErrorPolicySkip}
+	}
+
+	p.outputs = append(p.outputs, out)
+	p.policies[out] = policy
+	p.written[out] = p.writeMetrics(out)
+	if emitsResponses(out) {
+		p.read[out] = p.readMetrics(out)
+	}
+
+	return nil
+}
+
+// Plugins returns inputs and outputs in order they were added, followed by middleware once pipeline is started
+func (p *Pipeline) Plugins() []interface{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]interface{}(nil), p.all...)
+}
+
+// Running reports if pipeline copies messages, it is false before Run and once shutdown is started
+func (p *Pipeline) Running() bool {
+	return atomic.LoadInt32(&p.running) != 0
+}
+
+// Pause stops reading from input until it is resumed
+func (p *Pipeline) Pause(in interface{}) error {
+	g := p.gateOf(in)
+	if g == nil {
+		return fmt.Errorf("%v is not input of pipeline", in)
+	}
+	g.pause()
+	return nil
+}
+
+// Resume continues reading from paused input
+func (p *Pipeline) Resume(in interface{}) error {
+	g := p.gateOf(in)
+	if g == nil {
+		return fmt.Errorf("%v is not input of pipeline", in)
+	}
+	g.resume()
+	return nil
+}
+
+// Paused reports if input is paused
+func (p *Pipeline) Paused(in interface{}) bool {
+	g := p.gateOf(in)
+	return g != nil && g.paused()
+}
+
+// Disabled reports if output is disabled by its error policy
+func (p *Pipeline) Disabled(out interface{}) bool {
+	w, ok := out.(PluginWriter)
+	if !ok {
+		return false
+	}
+
+	p.mu.Lock()
+	policy := p.policies[w]
+	p.mu.Unlock()
+
+	return policy != nil && policy.Disabled()
+}
+
+func (p *Pipeline) gateOf(plugin interface{}) *pauseGate {
+	r, ok := plugin.(PluginReader)
+	if !ok {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.gates[r]
+}
+
+// Counts of messages passed through plugin
+type Counts struct {
+	Messages uint64 `json:"messages"`
+	Bytes    uint64 `json:"bytes"`
+	Errors   uint64 `json:"errors"`
+}
+
+// PluginStats holds counters of plugin, Read is nil for outputs which don't emit responses and Written is nil for inputs
+type PluginStats struct {
+	Plugin  interface{}
+	Name    string
+	Read    *Counts
+	Written *Counts
+}
+
+// Stats returns counters of all plugins in the same order as Plugins
+func (p *Pipeline) Stats() []PluginStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	list := make([]PluginStats, 0, len(p.all))
+	for _, plugin := range p.all {
+		s := PluginStats{Plugin: plugin, Name: fmt.Sprint(plugin)}
+		if m, ok := p.read[plugin]; ok {
+			s.Read = m.counts()
+		}
+		if m, ok := p.written[plugin]; ok {
+			s.Written = m.counts()
+		}
+		list = append(list, s)
+	}
+
+	return list
+}
+
+// Run copies messages from inputs to outputs until ctx is done or all inputs are finished, then stops plugins.
+// Returns error which aborted copying. Then pipeline may be run again with new plugins,
+// stopped ones are kept for Plugins and Stats until then.
+func (p *Pipeline) Run(ctx context.Context) error {
+	p.mu.Lock()
+	if p.started {
+		p.mu.Unlock()
+		return ErrorStarted
+	}
+	// Plugins of the previous run are closed
+	if p.stopped {
+		p.reset()
+	}
+	p.started = true
+	p.mu.Unlock()
+
+	defer func() {
+		p.mu.Lock()
+		p.started, p.stopped = false, true
+		p.mu.Unlock()
+	}()
+
+	var inputs, responses sync.WaitGroup
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var abortErr error
+	var abortOnce sync.Once
+
+	copyTo := func(wg *sync.WaitGroup, src PluginReader, gate *pauseGate) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := p.copyMulty(src, gate); err != nil && err != output.ErrorStopped {
+				log.Println(src, "stopped:", err)
+				abortOnce.Do(func() {
+					abortErr = err
+					cancel()
+				})
+			}
+		}()
+	}
+
+	if p.config.Middleware != "" {
+		middleware, err := NewMiddleware(p.config.Middleware, p.config.MiddlewareEncoding)
+		if err != nil {
+			p.shutdown(&inputs, &responses)
+			return err
+		}
+
+		// Middleware input ends with the last of pipeline inputs
+		var fed sync.WaitGroup
+		for _, in := range p.inputs {
+			fed.Add(1)
+			go func(in PluginReader) {
+				defer fed.Done()
+				middleware.copy(middleware.Stdin, in, p.gates[in])
+			}(in)
+		}
+		go func() {
+			fed.Wait()
+			middleware.CloseInput()
+		}()
+
+		// Middleware gets replayed responses as well
+		for _, out := range p.outputs {
+			if emitsResponses(out) {
+				middleware.ReadFrom(out.(PluginReader))
+			}
+		}
+
+		p.mu.Lock()
+		p.all = append(p.all, middleware)
+		p.read[middleware] = p.readMetrics(middleware)
+		p.mu.Unlock()
+
+		copyTo(&inputs, middleware, nil)
+	} else {
+		for _, in := range p.inputs {
+			copyTo(&inputs, in, p.gates[in])
+		}
+
+		// Outputs which are readers as well emit replayed responses
+		for _, out := range p.outputs {
+			if emitsResponses(out) {
+				copyTo(&responses, out.(PluginReader), nil)
+			}
+		}
+	}
+
+	atomic.StoreInt32(&p.running, 1)
+
+	finished := make(chan struct{})
+	go func() {
+		inputs.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-ctx.Done():
+	case <-finished:
+		log.Println("All inputs are finished")
+	}
+
+	p.shutdown(&inputs, &responses)
+
+	return abortErr
+}
+
+// shutdown stops inputs first, then lets outputs send what they have queued until shutdown timeout,
+// and closes outputs once replayed responses are written
+func (p *Pipeline) shutdown(inputs, responses *sync.WaitGroup) {
+	atomic.StoreInt32(&p.running, 0)
+
+	timeout := p.config.ShutdownTimeout
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	closed := make(map[interface{}]bool)
+	closePlugin := func(plugin interface{}) {
+		if closed[plugin] {
+			return
+		}
+		closed[plugin] = true
+
+		if c, ok := plugin.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				log.Println("Error closing", plugin, ":", err)
+			}
+		}
+	}
+
+	all := p.Plugins()
+
+	for _, in := range p.inputs {
+		closePlugin(in)
+		// Paused inputs have to read the error telling they are closed
+		p.gates[in].resume()
+	}
+	for _, plugin := range all {
+		if m, ok := plugin.(*Middleware); ok {
+			closePlugin(m)
+		}
+	}
+	if !wait(ctx, inputs) {
+		log.Println("Inputs are not stopped in", timeout)
+	}
+
+	for _, out := range p.outputs {
+		d, ok := out.(PluginDrainer)
+		if !ok {
+			continue
+		}
+		if n := d.Drain(ctx); n > 0 {
+			log.Printf("%s dropped %d messages on shutdown\n", out, n)
+			p.config.Metrics.Counter("goreplay_udp_messages_dropped_total", "Number of messages dropped", "plugin", fmt.Sprint(out), "reason", "shutdown").Add(n)
+		}
+	}
+
+	// Outputs which replay requests are closed first, so their responses are written to the rest
+	for _, out := range p.outputs {
+		if emitsResponses(out) {
+			closePlugin(out)
+		}
+	}
+	if !wait(ctx, responses) {
+		log.Println("Responses are not written in", timeout)
+	}
+
+	for _, out := range p.outputs {
+		closePlugin(out)
+	}
+	for _, plugin := range all {
+		closePlugin(plugin)
+	}
+}
+
+// wait waits for wg until ctx is done, returns false if ctx is done first
+func wait(ctx context.Context, wg *sync.WaitGroup) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// pluginMetrics counts messages passing through plugin
+type pluginMetrics struct {
+	messages *stats.Counter
+	bytes    *stats.Counter
+	errors   *stats.Counter
+
+	// Plugin of the previous run with the same name shares counters, its counts are not reported in Stats
+	base Counts
+}
+
+func (p *Pipeline) readMetrics(plugin interface{}) *pluginMetrics {
+	name := fmt.Sprint(plugin)
+	m := &pluginMetrics{
+		messages: p.config.Metrics.Counter("goreplay_udp_messages_read_total", "Number of messages read from plugin", "plugin", name),
+		bytes:    p.config.Metrics.Counter("goreplay_udp_read_bytes_total", "Payload bytes read from plugin", "plugin", name),
+		errors:   p.config.Metrics.Counter("goreplay_udp_read_errors_total", "Number of plugin read errors", "plugin", name),
+	}
+	m.base = *m.counts()
+	return m
+}
+
+func (p *Pipeline) writeMetrics(plugin interface{}) *pluginMetrics {
+	name := fmt.Sprint(plugin)
+	m := &pluginMetrics{
+		messages: p.config.Metrics.Counter("goreplay_udp_messages_written_total", "Number of messages written to plugin", "plugin", name),
+		bytes:    p.config.Metrics.Counter("goreplay_udp_written_bytes_total", "Payload bytes written to plugin", "plugin", name),
+		errors:   p.config.Metrics.Counter("goreplay_udp_write_errors_total", "Number of plugin write errors", "plugin", name),
+	}
+	m.base = *m.counts()
+	return m
+}
+
+func (m *pluginMetrics) count(msg *proto.Message, err error) {
+	if err != nil {
+		m.errors.Inc()
+		return
+	}
+	m.messages.Inc()
+	m.bytes.Add(len(msg.Data))
+}
+
+func (m *pluginMetrics) counts() *Counts {
+	return &Counts{
+		Messages: m.messages.Value() - m.base.Messages,
+		Bytes:    m.bytes.Value() - m.base.Bytes,
+		Errors:   m.errors.Value() - m.base.Errors,
+	}
+}
+
+// copyMulty copies from 1 reader to all outputs, waiting while gate is paused
+func (p *Pipeline) copyMulty(src PluginReader, gate *pauseGate) (err error) {
+	wIndex := 0
+	writers := p.outputs
+
+	srcMetrics := p.read[src]
+	dstMetrics := make([]*pluginMetrics, len(writers))
+	policies := make([]*ErrorPolicy, len(writers))
+	enabled := make([]int, 0, len(writers))
+	for i, dst := range writers {
+		dstMetrics[i] = p.written[dst]
+		policies[i] = p.policies[dst]
+	}
+
+	for {
+		gate.wait()
+
+		msg, err := src.PluginRead()
+		if err != nil {
+			if err == output.ErrorStopped || err == io.EOF {
+				return nil
+			}
+			srcMetrics.errors.Inc()
+			return err
+		}
+		// Messages without meta header can't be told apart, so they are skipped
+		if msg == nil || len(msg.Meta) == 0 {
+			continue
+		}
+		srcMetrics.count(msg, nil)
+
+		if proto.IsRequestPayload(msg.Meta) {
+			var ok bool
+			if msg.Data, ok = p.config.Modifier.Rewrite(msg.Meta, msg.Data); !ok {
+				continue
+			}
+			if msg.Data, ok = p.config.DNS.Rewrite(msg.Meta, msg.Data); !ok {
+				continue
+			}
+		} else if msg.Meta[0] == proto.ReplayedResponsePayload {
+			msg.Data = p.config.DNS.RestoreID(msg.Meta, msg.Data)
+		}
+
+		if p.config.SplitOutput {
+			// Outputs disabled by error policy are not picked, so their share goes to the rest
+			enabled = enabled[:0]
+			for i, policy := range policies {
+				if !policy.Disabled() {
+					enabled = append(enabled, i)
+				}
+			}
+			if len(enabled) == 0 {
+				return output.ErrorStopped
+			}
+
+			var i int
+			if p.config.SplitMode == SplitFlowHash {
+				i = enabled[flowHash(msg.Meta)%uint32(len(enabled))]
+			} else {
+				i = enabled[wIndex%len(enabled)]
+				wIndex++
+			}
+
+			if err := policies[i].write(writers[i], msg, dstMetrics[i]); err != nil {
+				return err
+			}
+			continue
+		}
+
+		stopped := len(writers) > 0
+		for i, dst := range writers {
+			if err := policies[i].write(dst, msg, dstMetrics[i]); err != nil {
+				return err
+			}
+			stopped = stopped && policies[i].Disabled()
+		}
+		// Copying ends once none of outputs is left
+		if stopped {
+			return output.ErrorStopped
+		}
+	}
+}
+
+// flowHash hashes client address of the message, so datagrams of one client always go to the same output.
+// Client of captured response is its destination, so responses follow their requests.
+func flowHash(meta []byte) uint32 {
+	h := fnv.New32a()
+	m := proto.ParseMeta(meta)
+
+	if m.Type == proto.ResponsePayload && m.DstIP != nil {
+		h.Write(m.DstIP)
+		binary.Write(h, binary.BigEndian, m.DstPort)
+	} else {
+		h.Write(m.SrcIP)
+		binary.Write(h, binary.BigEndian, m.SrcPort)
+	}
+
+	return h.Sum32()
+}
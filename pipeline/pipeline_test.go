@@ -0,0 +1,358 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"github.com/myzhan/goreplay-udp/output"
+	"github.com/myzhan/goreplay-udp/proto"
+	"github.com/myzhan/goreplay-udp/stats"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testInput emits given payloads, then blocks until closed if it is endless
+type testInput struct {
+	payloads []string
+	endless  bool
+	stop     chan struct{}
+	closed   bool
+}
+
+func newTestInput(endless bool, payloads ...string) *testInput {
+	return &testInput{payloads: payloads, endless: endless, stop: make(chan struct{})}
+}
+
+func (i *testInput) PluginRead() (*proto.Message, error) {
+	if len(i.payloads) > 0 {
+		data := i.payloads[0]
+		i.payloads = i.payloads[1:]
+		return &proto.Message{Meta: proto.PayloadHeader(proto.RequestPayload, []byte("uuid"), 1, nil), Data: []byte(data)}, nil
+	}
+	if i.endless {
+		<-i.stop
+		return nil, output.ErrorStopped
+	}
+	return nil, io.EOF
+}
+
+func (i *testInput) Close() error {
+	i.closed = true
+	close(i.stop)
+	return nil
+}
+
+type testOutput struct {
+	mu       sync.Mutex
+	payloads []string
+	err      error
+	closed   bool
+}
+
+func (o *testOutput) PluginWrite(msg *proto.Message) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed {
+		return 0, output.ErrorStopped
+	}
+	if o.err != nil {
+		return 0, o.err
+	}
+	o.payloads = append(o.payloads, string(msg.Data))
+	return len(msg.Data), nil
+}
+
+func (o *testOutput) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.closed = true
+	return nil
+}
+
+func TestPipelineRun(t *testing.T) {
+	in := newTestInput(false, "a", "bc")
+	out := new(testOutput)
+
+	p := New(Config{})
+	assert.Nil(t, p.AddInput(in))
+	assert.Nil(t, p.AddOutput(out, nil))
+
+	assert.Nil(t, p.Run(context.Background()))
+	assert.Equal(t, []string{"a", "bc"}, out.payloads)
+	assert.True(t, in.closed)
+	assert.True(t, out.closed)
+	assert.False(t, p.Running())
+
+	list := p.Stats()
+	assert.Equal(t, 2, len(list))
+	assert.Equal(t, &Counts{Messages: 2, Bytes: 3}, list[0].Read)
+	assert.Nil(t, list[0].Written)
+	assert.Equal(t, &Counts{Messages: 2, Bytes: 3}, list[1].Written)
+}
+
+func TestPipelineStop(t *testing.T) {
+	p := New(Config{ShutdownTimeout: time.Second})
+
+	// Stopped pipeline runs again with new plugins
+	for run := 0; run < 2; run++ {
+		in := newTestInput(true, "a")
+		out := new(testOutput)
+
+		assert.Nil(t, p.AddInput(in))
+		assert.Nil(t, p.AddOutput(out, nil))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() {
+			done <- p.Run(ctx)
+		}()
+
+		assert.Eventually(t, p.Running, time.Second, time.Millisecond)
+		assert.Equal(t, ErrorStarted, p.Run(ctx))
+		assert.Equal(t, ErrorStarted, p.AddInput(newTestInput(false)))
+		cancel()
+
+		select {
+		case err := <-done:
+			assert.Nil(t, err)
+		case <-time.After(2 * time.Second):
+			t.Fatal("pipeline is not stopped")
+		}
+		assert.Equal(t, 2, len(p.Plugins()))
+		assert.Equal(t, uint64(1), p.Stats()[1].Written.Messages)
+	}
+}
+
+// metricsOutput has its own counter of written messages
+// replayOutput emits response to each written request, the last ones once it is closed
+type replayOutput struct {
+	responses chan *proto.Message
+}
+
+func (o *replayOutput) PluginWrite(msg *proto.Message) (int, error) {
+	if !proto.IsRequestPayload(msg.Meta) {
+		return 0, nil
+	}
+	o.responses <- &proto.Message{Meta: proto.PayloadHeader(proto.ReplayedResponsePayload, []byte("uuid"), 1, nil), Data: msg.Data}
+	return len(msg.Data), nil
+}
+
+func (o *replayOutput) PluginRead() (*proto.Message, error) {
+	msg, ok := <-o.responses
+	if !ok {
+		return nil, output.ErrorStopped
+	}
+	return msg, nil
+}
+
+func (o *replayOutput) Close() error {
+	close(o.responses)
+	return nil
+}
+
+func TestPipelineShutdownLimitedOutput(t *testing.T) {
+	replay := &replayOutput{responses: make(chan *proto.Message, 10)}
+	out := new(testOutput)
+	limited, err := NewLimiter(out, "100")
+	assert.Nil(t, err)
+
+	p := New(Config{ShutdownTimeout: time.Second})
+	assert.Nil(t, p.AddInput(newTestInput(false, "a", "b")))
+	assert.Nil(t, p.AddOutput(replay, nil))
+	assert.Nil(t, p.AddOutput(limited, nil))
+
+	// Limited output is closed after responses of replaying output are written to it
+	assert.Nil(t, p.Run(context.Background()))
+	assert.ElementsMatch(t, []string{"a", "b", "a", "b"}, out.payloads)
+	assert.True(t, out.closed)
+
+	stats := p.Stats()
+	assert.NotNil(t, stats[1].Read)
+	assert.Nil(t, stats[2].Read)
+}
+
+type metricsOutput struct {
+	testOutput
+	written *stats.Counter
+}
+
+func (o *metricsOutput) RegisterMetrics(r *stats.Registry) {
+	o.written = r.Counter("test_written_total", "")
+}
+
+func (o *metricsOutput) PluginWrite(msg *proto.Message) (int, error) {
+	o.written.Inc()
+	return o.testOutput.PluginWrite(msg)
+}
+
+func TestPipelineMetrics(t *testing.T) {
+	registry := stats.NewRegistry()
+	out := new(metricsOutput)
+
+	p := New(Config{Metrics: registry})
+	assert.Nil(t, p.AddInput(newTestInput(false, "a", "b")))
+	assert.Nil(t, p.AddOutput(out, nil))
+	assert.Nil(t, p.Run(context.Background()))
+
+	// Plugin metrics go to registry of pipeline
+	assert.Equal(t, uint64(2), out.written.Value())
+	assert.Equal(t, out.written, registry.Counter("test_written_total", ""))
+	assert.NotEqual(t, out.written, stats.Metrics.Counter("test_written_total", ""))
+}
+
+func TestPipelineErrorPolicy(t *testing.T) {
+	failed := &testOutput{err: errors.New("write failed")}
+	out := new(testOutput)
+
+	p := New(Config{})
+	assert.Nil(t, p.AddInput(newTestInput(false, "a", "b")))
+	assert.Nil(t, p.AddOutput(failed, &ErrorPolicy{Mode: ErrorPolicyDisable}))
+	assert.Nil(t, p.AddOutput(out, nil))
+
+	assert.Nil(t, p.Run(context.Background()))
+	assert.True(t, p.Disabled(failed))
+	assert.Equal(t, []string{"a", "b"}, out.payloads)
+	assert.Equal(t, uint64(1), p.Stats()[1].Written.Errors)
+
+	failed = &testOutput{err: errors.New("write failed")}
+	p = New(Config{})
+	assert.Nil(t, p.AddInput(newTestInput(true, "a", "b")))
+	assert.Nil(t, p.AddOutput(failed, &ErrorPolicy{Mode: ErrorPolicyAbort}))
+
+	err := p.Run(context.Background())
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "write failed")
+}
+
+func TestPipelineStoppedOutput(t *testing.T) {
+	stopped := &testOutput{closed: true}
+	queued := &testOutput{err: &output.SendError{Err: errors.New("send failed")}}
+	out := new(testOutput)
+
+	p := New(Config{})
+	assert.Nil(t, p.AddInput(newTestInput(false, "a", "b")))
+	assert.Nil(t, p.AddOutput(stopped, &ErrorPolicy{Mode: ErrorPolicyAbort}))
+	// Message already queued by output is not retried
+	assert.Nil(t, p.AddOutput(queued, &ErrorPolicy{Mode: ErrorPolicyRetry, Retries: 1, Delay: time.Hour}))
+	assert.Nil(t, p.AddOutput(out, nil))
+
+	// Stopped output is disabled, the rest keep getting messages
+	assert.Nil(t, p.Run(context.Background()))
+	assert.True(t, p.Disabled(stopped))
+	assert.False(t, p.Disabled(queued))
+	assert.Equal(t, []string{"a", "b"}, out.payloads)
+}
+
+func TestPipelineSplitDisabled(t *testing.T) {
+	for _, mode := range []string{SplitRoundRobin, SplitFlowHash} {
+		disabled := new(testOutput)
+		out := new(testOutput)
+
+		p := New(Config{SplitOutput: true, SplitMode: mode})
+		assert.Nil(t, p.AddInput(newTestInput(false, "a", "b", "c", "d")))
+		assert.Nil(t, p.AddOutput(disabled, &ErrorPolicy{Mode: ErrorPolicyDisable, disabled: 1}))
+		assert.Nil(t, p.AddOutput(out, nil))
+
+		// Disabled output is not picked, so nothing is lost
+		assert.Nil(t, p.Run(context.Background()))
+		assert.Nil(t, disabled.payloads, mode)
+		assert.Equal(t, []string{"a", "b", "c", "d"}, out.payloads, mode)
+	}
+}
+
+// messagesInput emits given messages
+type messagesInput struct {
+	messages []*proto.Message
+}
+
+func (i *messagesInput) PluginRead() (*proto.Message, error) {
+	if len(i.messages) == 0 {
+		return nil, io.EOF
+	}
+	msg := i.messages[0]
+	i.messages = i.messages[1:]
+	return msg, nil
+}
+
+func TestPipelineMessageWithoutMeta(t *testing.T) {
+	in := &messagesInput{messages: []*proto.Message{{Data: []byte("a")}, sourceMessage("10.0.0.1", 1024)}}
+	out := new(testOutput)
+
+	p := New(Config{})
+	assert.Nil(t, p.AddInput(in))
+	assert.Nil(t, p.AddOutput(out, nil))
+
+	// Message without meta is skipped instead of breaking the copy
+	assert.Nil(t, p.Run(context.Background()))
+	assert.Equal(t, 1, len(out.payloads))
+}
+
+func TestPipelineSplitRoundRobin(t *testing.T) {
+	in := new(messagesInput)
+	for i := 0; i < 30; i++ {
+		msg := sourceMessage("10.0.0.1", 1024)
+		msg.Data = []byte(strconv.Itoa(i))
+		in.messages = append(in.messages, msg)
+	}
+	outputs := []*testOutput{new(testOutput), new(testOutput), new(testOutput)}
+
+	p := New(Config{SplitOutput: true})
+	assert.Nil(t, p.AddInput(in))
+	for _, out := range outputs {
+		assert.Nil(t, p.AddOutput(out, nil))
+	}
+	assert.Nil(t, p.Run(context.Background()))
+
+	// Messages go to outputs in turn
+	for i, out := range outputs {
+		assert.Equal(t, 10, len(out.payloads))
+		assert.Equal(t, strconv.Itoa(i), out.payloads[0])
+		assert.Equal(t, strconv.Itoa(i+3), out.payloads[1])
+	}
+}
+
+func TestPipelineSplitFlowHash(t *testing.T) {
+	in := new(messagesInput)
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 100; i++ {
+			msg := sourceMessage("10.0.0."+strconv.Itoa(i), 1024+i)
+			msg.Data = []byte(strconv.Itoa(i))
+			in.messages = append(in.messages, msg)
+		}
+	}
+	outputs := []*testOutput{new(testOutput), new(testOutput), new(testOutput)}
+
+	p := New(Config{SplitOutput: true, SplitMode: SplitFlowHash})
+	assert.Nil(t, p.AddInput(in))
+	for _, out := range outputs {
+		assert.Nil(t, p.AddOutput(out, nil))
+	}
+	assert.Nil(t, p.Run(context.Background()))
+
+	// All datagrams of a source go to the same output, sources are spread between all of them
+	owner := make(map[string]int)
+	for i, out := range outputs {
+		assert.True(t, len(out.payloads) > 0, i)
+		for _, source := range out.payloads {
+			if o, ok := owner[source]; ok {
+				assert.Equal(t, o, i, source)
+			}
+			owner[source] = i
+		}
+	}
+	assert.Equal(t, 100, len(owner))
+
+	// Captured response goes where its request went
+	request := sourceMessage("10.0.0.1", 1024)
+	response := proto.PayloadHeader(proto.ResponsePayload, []byte("uuid"), 1, net.ParseIP("10.0.0.53").To4())
+	response = proto.AppendMetaField(response, proto.SrcPortField, "53")
+	response = proto.AppendMetaField(response, proto.DstField, "10.0.0.1")
+	response = proto.AppendMetaField(response, proto.DstPortField, "1024")
+	assert.Equal(t, flowHash(request.Meta), flowHash(response))
+}
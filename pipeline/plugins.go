@@ -0,0 +1,52 @@
+package pipeline
+
+import (
+	"context"
+	"github.com/myzhan/goreplay-udp/proto"
+	"github.com/myzhan/goreplay-udp/stats"
+)
+
+// PluginReader is an interface for input plugins, PluginRead returns io.EOF or output.ErrorStopped
+// once there is nothing more to read
+type PluginReader interface {
+	PluginRead() (msg *proto.Message, err error)
+}
+
+// PluginWriter is an interface for output plugins
+type PluginWriter interface {
+	PluginWrite(msg *proto.Message) (n int, err error)
+}
+
+// PluginReadWriter is an interface for plugins that support reading and writing
+type PluginReadWriter interface {
+	PluginReader
+	PluginWriter
+}
+
+// PluginDrainer is an interface for output plugins which queue messages,
+// Drain waits until queue is sent and returns number of messages left when ctx is done
+type PluginDrainer interface {
+	Drain(ctx context.Context) int
+}
+
+// SpeedController is an interface for inputs which replay recorded traffic at adjustable speed
+type SpeedController interface {
+	Speed() float64
+	SetSpeed(speed float64)
+}
+
+// MetricsRegisterer is an interface for plugins with their own metrics, which are registered in Config.Metrics
+// when plugin is added to pipeline
+type MetricsRegisterer interface {
+	RegisterMetrics(r *stats.Registry)
+}
+
+// emitsResponses reports if output reads replayed responses. Limiter implements PluginReader whatever
+// it wraps, so the wrapped plugin is checked.
+func emitsResponses(out interface{}) bool {
+	if l, ok := out.(*Limiter); ok {
+		out = l.Plugin()
+	}
+	_, ok := out.(PluginReader)
+	return ok
+}
@@ -1,42 +1,16 @@
 package main
 
 import (
+	"github.com/myzhan/goreplay-udp/dns"
 	"github.com/myzhan/goreplay-udp/input"
+	"github.com/myzhan/goreplay-udp/modifier"
 	"github.com/myzhan/goreplay-udp/output"
-	"github.com/myzhan/goreplay-udp/proto"
+	"github.com/myzhan/goreplay-udp/pipeline"
+	"github.com/myzhan/goreplay-udp/stats"
 	"reflect"
 	"strings"
-	"sync"
 )
 
-// PluginReader is an interface for input plugins
-type PluginReader interface {
-	PluginRead() (msg *proto.Message, err error)
-}
-
-// PluginWriter is an interface for output plugins
-type PluginWriter interface {
-	PluginWrite(msg *proto.Message) (n int, err error)
-}
-
-// PluginReadWriter is an interface for plugins that support reading and writing
-type PluginReadWriter interface {
-	PluginReader
-	PluginWriter
-}
-
-// InOutPlugins struct for holding references to plugins
-type InOutPlugins struct {
-	Inputs  []PluginReader
-	Outputs []PluginWriter
-	All     []interface{}
-}
-
-var pluginMu sync.Mutex
-
-// Plugins holds all the plugin objects
-var Plugins = new(InOutPlugins)
-
 // extractLimitOptions detects if plugin get called with limiter support
 // Returns address and limit
 func extractLimitOptions(options string) (string, string) {
@@ -49,10 +23,11 @@ func extractLimitOptions(options string) (string, string) {
 	return split[0], ""
 }
 
-// Automatically detects type of plugin and initialize it
+// Automatically detects type of plugin, initialize it and add it to pipeline, constructor may return error as second value.
+// Outputs get given error policy.
 //
 // See this article if curious about reflect stuff below: http://blog.burntsushi.net/type-parametric-functions-golang
-func registerPlugin(constructor interface{}, options ...interface{}) {
+func registerPlugin(p *pipeline.Pipeline, policy *pipeline.ErrorPolicy, constructor interface{}, options ...interface{}) error {
 	var path, limit string
 	vc := reflect.ValueOf(constructor)
 
@@ -71,61 +46,132 @@ func registerPlugin(constructor interface{}, options ...interface{}) {
 	}
 
 	// Calling our constructor with list of given options
-	plugin := vc.Call(vo)[0].Interface()
-
-	if limit != "" {
-		plugin = NewLimiter(plugin, limit)
+	results := vc.Call(vo)
+	if len(results) > 1 && !results[1].IsNil() {
+		return results[1].Interface().(error)
 	}
+	plugin := results[0].Interface()
 
-	_, isR := plugin.(PluginReader)
-	_, isW := plugin.(PluginWriter)
+	// Limiter is both reader and writer, so kind of plugin is detected before wrapping it
+	_, isR := plugin.(pipeline.PluginReader)
+	_, isW := plugin.(pipeline.PluginWriter)
 
-	// Some of the output can be Readers as well because return responses
-	if isR && !isW {
-		Plugins.Inputs = append(Plugins.Inputs, plugin.(PluginReader))
+	if limit != "" {
+		var err error
+		if plugin, err = pipeline.NewLimiter(plugin, limit); err != nil {
+			return err
+		}
 	}
 
+	// Some of the output can be Readers as well because return responses
 	if isW {
-		Plugins.Outputs = append(Plugins.Outputs, plugin.(PluginWriter))
+		return p.AddOutput(plugin.(pipeline.PluginWriter), policy)
+	}
+	if isR {
+		return p.AddInput(plugin.(pipeline.PluginReader))
 	}
 
-	Plugins.All = append(Plugins.All, plugin)
+	return nil
+}
+
+// registerOutput registers output plugin with error policy configured for its name
+func registerOutput(p *pipeline.Pipeline, policies map[string]string, name string, constructor interface{}, options ...interface{}) error {
+	return registerPlugin(p, newErrorPolicy(policies, name), constructor, options...)
 }
 
-// InitPlugins specify and initialize all available plugins
-func InitPlugins() {
-	pluginMu.Lock()
-	defer pluginMu.Unlock()
+// registerInput registers input plugin
+func registerInput(p *pipeline.Pipeline, constructor interface{}, options ...interface{}) error {
+	return registerPlugin(p, nil, constructor, options...)
+}
+
+// InitPlugins creates pipeline with all plugins given in settings, returns error of the first plugin which can't be created
+func InitPlugins() (p *pipeline.Pipeline, err error) {
+	payloadModifier, err := modifier.NewModifier(&Settings.modifierConfig)
+	if err != nil {
+		return nil, err
+	}
+	dnsModifier, err := dns.NewModifier(&Settings.dnsConfig)
+	if err != nil {
+		return nil, err
+	}
 
+	p = pipeline.New(pipeline.Config{
+		SplitOutput:        Settings.splitOutput,
+		SplitMode:          Settings.splitOutputMode,
+		Middleware:         Settings.middleware,
+		MiddlewareEncoding: Settings.middlewareEncoding,
+		Modifier:           payloadModifier,
+		DNS:                dnsModifier,
+		ShutdownTimeout:    Settings.shutdownTimeout,
+		Metrics:            stats.Metrics,
+	})
+
+	policies, err := parseErrorPolicies(Settings.outputErrorPolicy)
+	if err != nil {
+		return nil, err
+	}
 	if Settings.outputStdout {
-		registerPlugin(output.NewStdOutput)
+		if err = registerOutput(p, policies, "stdout", output.NewStdOutput, Settings.outputStdoutFormat); err != nil {
+			return nil, err
+		}
 	}
 
 	if Settings.outputNull {
-		registerPlugin(output.NewNullOutput)
+		if err = registerOutput(p, policies, "null", output.NewNullOutput); err != nil {
+			return nil, err
+		}
 	}
 
 	for _, options := range Settings.inputUDP {
-		registerPlugin(input.NewUDPInput, options, Settings.inputUDPTrackResponse)
+		if err = registerInput(p, input.NewUDPInput, options, &Settings.inputUDPConfig); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, options := range Settings.inputPcap {
+		// Response pairing settings are shared with --input-udp
+		config := Settings.inputUDPConfig
+		config.TrackResponse = Settings.inputPcapTrackResponse
+		if err = registerInput(p, input.NewPcapInput, options, Settings.inputPcapAddr, &config); err != nil {
+			return nil, err
+		}
 	}
 
 	for _, options := range Settings.inputFile {
-		registerPlugin(input.NewFileInput, options, Settings.inputFileLoop)
+		if err = registerInput(p, input.NewFileInput, options, Settings.inputFileLoop, Settings.inputFileOffset); err != nil {
+			return nil, err
+		}
 	}
 
 	for _, options := range Settings.outputFile {
-		registerPlugin(output.NewFileOutput, options, &Settings.outputFileConfig)
+		if err = registerOutput(p, policies, "file", output.NewFileOutput, options, &Settings.outputFileConfig); err != nil {
+			return nil, err
+		}
 	}
 
 	for _, options := range Settings.outputUDP {
-		registerPlugin(output.NewUDPOutput, options, &Settings.outputUDPConfig)
+		if err = registerOutput(p, policies, "udp", output.NewUDPOutput, options, &Settings.outputUDPConfig); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, options := range Settings.outputDiff {
+		if err = registerOutput(p, policies, "diff", output.NewDiffOutput, options, &Settings.outputDiffConfig); err != nil {
+			return nil, err
+		}
 	}
 
 	for _, options := range Settings.inputHttp {
-		registerPlugin(input.NewHTTPInput, options)
+		if err = registerInput(p, input.NewHTTPInput, options); err != nil {
+			return nil, err
+		}
 	}
 
 	for _, options := range Settings.outputHttp {
-		registerPlugin(output.NewHTTPOutput, options, &Settings.outputHttpConfig)
+		if err = registerOutput(p, policies, "http", output.NewHTTPOutput, options, &Settings.outputHttpConfig); err != nil {
+			return nil, err
+		}
 	}
+
+	return p, nil
 }
@@ -0,0 +1,273 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+)
+
+// Binary capture file starts with magic followed by format version.
+// Each record is prefixed by its length, so payloads may contain any bytes, including PayloadSeparator.
+var (
+	BinaryMagic = []byte("GORUDP")
+	IndexMagic  = []byte("GORIDX")
+)
+
+const BinaryVersion = 1
+
+// BinaryHeaderSize is length of magic and version
+const BinaryHeaderSize = 8
+
+// Limit protects from allocating huge buffers when reading corrupted file
+const maxRecordSize = 16 * 1024 * 1024
+
+var ErrBadRecord = errors.New("corrupted binary record")
+
+// Record is single message of binary capture file
+type Record struct {
+	Type      byte
+	Timestamp int64
+	SrcIP     []byte
+	SrcPort   uint16
+	DstIP     []byte
+	DstPort   uint16
+	Meta      []byte // original meta header, including optional fields
+	Data      []byte
+}
+
+// NewRecord fills record fields from message meta header
+func NewRecord(msg *Message) *Record {
+	meta := ParseMeta(msg.Meta)
+
+	return &Record{
+		Type:      meta.Type,
+		Timestamp: meta.Timestamp,
+		SrcIP:     ipBytes(meta.SrcIP),
+		SrcPort:   meta.SrcPort,
+		DstIP:     ipBytes(meta.DstIP),
+		DstPort:   meta.DstPort,
+		Meta:      msg.Meta,
+		Data:      msg.Data,
+	}
+}
+
+func ipBytes(ip net.IP) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+func parsePort(s []byte) uint16 {
+	port, _ := strconv.ParseUint(string(s), 10, 16)
+	return uint16(port)
+}
+
+// Message converts record back to message passed between plugins
+func (r *Record) Message() *Message {
+	return &Message{Meta: r.Meta, Data: r.Data}
+}
+
+// WriteBinaryHeader writes magic and version, must be called once at the start of file
+func WriteBinaryHeader(w io.Writer) (int, error) {
+	header := make([]byte, BinaryHeaderSize)
+	copy(header, BinaryMagic)
+	binary.BigEndian.PutUint16(header[len(BinaryMagic):], BinaryVersion)
+
+	return w.Write(header)
+}
+
+// IsBinary checks if file starting with given bytes is in binary format
+func IsBinary(head []byte) bool {
+	return len(head) >= len(BinaryMagic) && bytes.Equal(head[:len(BinaryMagic)], BinaryMagic)
+}
+
+// ReadBinaryHeader reads magic and returns format version
+func ReadBinaryHeader(r io.Reader) (version uint16, err error) {
+	header := make([]byte, BinaryHeaderSize)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return 0, err
+	}
+	if !IsBinary(header) {
+		return 0, errors.New("not a binary capture file")
+	}
+
+	version = binary.BigEndian.Uint16(header[len(BinaryMagic):])
+	if version > BinaryVersion {
+		return version, errors.New("unsupported binary capture version " + strconv.Itoa(int(version)))
+	}
+
+	return version, nil
+}
+
+// MarshalBinary encodes record with its length prefix:
+//
+//	length uint32 | type uint8 | timestamp int64 | src ip len uint8 | src ip | src port uint16 |
+//	dst ip len uint8 | dst ip | dst port uint16 | meta len uint16 | meta | data
+func (r *Record) MarshalBinary() ([]byte, error) {
+	if len(r.SrcIP) > 255 || len(r.DstIP) > 255 || len(r.Meta) > 65535 {
+		return nil, ErrBadRecord
+	}
+
+	size := 1 + 8 + 1 + len(r.SrcIP) + 2 + 1 + len(r.DstIP) + 2 + 2 + len(r.Meta) + len(r.Data)
+	buf := make([]byte, 0, 4+size)
+
+	buf = binary.BigEndian.AppendUint32(buf, uint32(size))
+	buf = append(buf, r.Type)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(r.Timestamp))
+	buf = append(buf, byte(len(r.SrcIP)))
+	buf = append(buf, r.SrcIP...)
+	buf = binary.BigEndian.AppendUint16(buf, r.SrcPort)
+	buf = append(buf, byte(len(r.DstIP)))
+	buf = append(buf, r.DstIP...)
+	buf = binary.BigEndian.AppendUint16(buf, r.DstPort)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(r.Meta)))
+	buf = append(buf, r.Meta...)
+	buf = append(buf, r.Data...)
+
+	return buf, nil
+}
+
+// UnmarshalBinary decodes record without length prefix
+func (r *Record) UnmarshalBinary(buf []byte) error {
+	next := func(n int) ([]byte, error) {
+		if len(buf) < n {
+			return nil, ErrBadRecord
+		}
+		b := buf[:n]
+		buf = buf[n:]
+		return b, nil
+	}
+
+	fixed, err := next(1 + 8 + 1)
+	if err != nil {
+		return err
+	}
+	r.Type = fixed[0]
+	r.Timestamp = int64(binary.BigEndian.Uint64(fixed[1:9]))
+
+	if r.SrcIP, err = next(int(fixed[9])); err != nil {
+		return err
+	}
+
+	port, err := next(2 + 1)
+	if err != nil {
+		return err
+	}
+	r.SrcPort = binary.BigEndian.Uint16(port)
+
+	if r.DstIP, err = next(int(port[2])); err != nil {
+		return err
+	}
+
+	port, err = next(2 + 2)
+	if err != nil {
+		return err
+	}
+	r.DstPort = binary.BigEndian.Uint16(port)
+
+	if r.Meta, err = next(int(binary.BigEndian.Uint16(port[2:]))); err != nil {
+		return err
+	}
+	r.Data = buf
+
+	return nil
+}
+
+// ReadRecord reads next length prefixed record
+func ReadRecord(rd io.Reader) (*Record, error) {
+	var prefix [4]byte
+	if _, err := io.ReadFull(rd, prefix[:]); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(prefix[:])
+	if size > maxRecordSize {
+		return nil, ErrBadRecord
+	}
+
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(rd, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	r := new(Record)
+	if err := r.UnmarshalBinary(buf); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// IndexEntry points to record in binary capture file, written to sidecar index file
+type IndexEntry struct {
+	Timestamp int64
+	Offset    int64
+}
+
+// IndexEntrySize is length of encoded IndexEntry
+const IndexEntrySize = 16
+
+// WriteIndexHeader writes magic and version, must be called once at the start of index file
+func WriteIndexHeader(w io.Writer) (int, error) {
+	header := make([]byte, BinaryHeaderSize)
+	copy(header, IndexMagic)
+	binary.BigEndian.PutUint16(header[len(IndexMagic):], BinaryVersion)
+
+	return w.Write(header)
+}
+
+// WriteIndexEntry appends entry to index file
+func WriteIndexEntry(w io.Writer, e IndexEntry) (int, error) {
+	var buf [IndexEntrySize]byte
+	binary.BigEndian.PutUint64(buf[:8], uint64(e.Timestamp))
+	binary.BigEndian.PutUint64(buf[8:], uint64(e.Offset))
+
+	return w.Write(buf[:])
+}
+
+// ReadIndex reads all entries of index file
+func ReadIndex(r io.Reader) ([]IndexEntry, error) {
+	header := make([]byte, BinaryHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:len(IndexMagic)], IndexMagic) {
+		return nil, errors.New("not an index file")
+	}
+
+	var entries []IndexEntry
+	var buf [IndexEntrySize]byte
+	for {
+		if _, err := io.ReadFull(r, buf[:]); err != nil {
+			// Partially written entry at the end is ignored
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return entries, nil
+			}
+			return entries, err
+		}
+
+		entries = append(entries, IndexEntry{
+			Timestamp: int64(binary.BigEndian.Uint64(buf[:8])),
+			Offset:    int64(binary.BigEndian.Uint64(buf[8:])),
+		})
+	}
+}
+
+// SeekIndex returns offset of the last indexed record captured not later than timestamp
+func SeekIndex(entries []IndexEntry, timestamp int64) (offset int64, ok bool) {
+	for _, e := range entries {
+		if e.Timestamp > timestamp {
+			break
+		}
+		offset, ok = e.Offset, true
+	}
+
+	return
+}
@@ -0,0 +1,64 @@
+package proto
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestBinaryRecord(t *testing.T) {
+	var buf bytes.Buffer
+
+	meta := PayloadHeader(RequestPayload, []byte("f45590522cd1838b4a0d5c5aab80b77929dea3b3"), 1231, net.ParseIP("192.168.1.102"))
+	meta = AppendMetaField(meta, SrcPortField, "5353")
+	// Payload containing separator breaks text format
+	data := []byte("binary" + PayloadSeparator + "\x00\xff")
+
+	WriteBinaryHeader(&buf)
+	rec := NewRecord(&Message{Meta: meta, Data: data})
+	b, err := rec.MarshalBinary()
+	assert.Nil(t, err)
+	buf.Write(b)
+
+	assert.True(t, IsBinary(buf.Bytes()))
+
+	version, err := ReadBinaryHeader(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(BinaryVersion), version)
+
+	r, err := ReadRecord(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, byte(RequestPayload), r.Type)
+	assert.Equal(t, int64(1231), r.Timestamp)
+	assert.Equal(t, "192.168.1.102", net.IP(r.SrcIP).String())
+	assert.Equal(t, uint16(5353), r.SrcPort)
+	assert.Equal(t, meta, r.Meta)
+	assert.Equal(t, data, r.Data)
+
+	_, err = ReadRecord(&buf)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestBinaryIndex(t *testing.T) {
+	var buf bytes.Buffer
+
+	WriteIndexHeader(&buf)
+	WriteIndexEntry(&buf, IndexEntry{Timestamp: 100, Offset: 8})
+	WriteIndexEntry(&buf, IndexEntry{Timestamp: 200, Offset: 1024})
+
+	entries, err := ReadIndex(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(entries))
+
+	_, ok := SeekIndex(entries, 50)
+	assert.False(t, ok)
+
+	offset, ok := SeekIndex(entries, 150)
+	assert.True(t, ok)
+	assert.Equal(t, int64(8), offset)
+
+	offset, _ = SeekIndex(entries, 300)
+	assert.Equal(t, int64(1024), offset)
+}
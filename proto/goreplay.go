@@ -14,16 +14,25 @@ const (
 
 var PayloadSeparator = "\n🐵🙈🙉\n"
 
+// Optional meta fields, written as key=value after the positional ones
+const (
+	LatencyField   = "lat"
+	SrcPortField   = "sport"
+	DstField       = "dst"
+	DstPortField   = "dport"
+	InterfaceField = "if"
+	// Listened port, tells which of --input-udp ports captured the datagram
+	PortField = "port"
+	// UUID of the message amplified copy is made of, replayed responses of copies carry it as well
+	OriginField = "orig"
+)
+
 func PayloadHeader(payloadType byte, uuid []byte, timing int64, srcIp []byte) (header []byte) {
 	var sTime string
 	var sIp string
 
 	sTime = strconv.FormatInt(timing, 10)
-	if len(srcIp) == 4 {
-		sIp = net.IPv4(srcIp[0], srcIp[1], srcIp[2], srcIp[3]).String()
-	} else if len(srcIp) > 0 {
-		sIp = net.IP(srcIp).String()
-	}
+	sIp = FormatIP(srcIp)
 
 	//Example:
 	// 3 f45590522cd1838b4a0d5c5aab80b77929dea3b3 1231 192.168.1.102\n
@@ -44,6 +53,127 @@ func PayloadHeader(payloadType byte, uuid []byte, timing int64, srcIp []byte) (h
 	return header
 }
 
+// AppendMetaField adds key=value field to the end of payload header.
+// Parsers which only know about positional fields just ignore it.
+func AppendMetaField(header []byte, key string, value string) []byte {
+	if len(header) > 0 && header[len(header)-1] == '\n' {
+		header = header[:len(header)-1]
+	}
+
+	field := make([]byte, 0, len(header)+len(key)+len(value)+3)
+	field = append(field, header...)
+	field = append(field, ' ')
+	field = append(field, key...)
+	field = append(field, '=')
+	field = append(field, value...)
+	field = append(field, '\n')
+
+	return field
+}
+
+// SetMetaField replaces value of key=value field, adding it if header has none
+func SetMetaField(header []byte, key string, value string) []byte {
+	line := bytes.TrimSuffix(header, []byte("\n"))
+	prefix := []byte(key + "=")
+
+	var fields [][]byte
+	for i, f := range bytes.Split(line, []byte(" ")) {
+		if i >= 4 && bytes.HasPrefix(f, prefix) {
+			continue
+		}
+		fields = append(fields, f)
+	}
+
+	return AppendMetaField(bytes.Join(fields, []byte(" ")), key, value)
+}
+
+// MetaField returns value of key=value field added by AppendMetaField
+func MetaField(payload []byte, key string) ([]byte, bool) {
+	meta := PayloadMeta(payload)
+	if len(meta) < 4 {
+		return nil, false
+	}
+
+	for _, f := range meta[4:] {
+		if len(f) > len(key) && f[len(key)] == '=' && string(f[:len(key)]) == key {
+			return f[len(key)+1:], true
+		}
+	}
+
+	return nil, false
+}
+
+// Meta is parsed payload header, fields missing in the header are left empty
+type Meta struct {
+	Type      byte
+	UUID      []byte
+	Timestamp int64
+	SrcIP     net.IP
+	SrcPort   uint16
+	DstIP     net.IP
+	DstPort   uint16
+	Port      uint16
+	Interface string
+	Latency   int64
+}
+
+// ParseMeta parses both positional and optional key=value fields of payload header
+func ParseMeta(payload []byte) *Meta {
+	m := new(Meta)
+	meta := PayloadMeta(payload)
+
+	if len(meta) > 0 && len(meta[0]) > 0 {
+		m.Type = meta[0][0]
+	}
+	if len(meta) > 1 {
+		m.UUID = meta[1]
+	}
+	if len(meta) > 2 {
+		m.Timestamp, _ = strconv.ParseInt(string(meta[2]), 10, 64)
+	}
+	if len(meta) > 3 {
+		m.SrcIP = net.ParseIP(string(meta[3]))
+	}
+	if len(meta) <= 4 {
+		return m
+	}
+
+	for _, f := range meta[4:] {
+		i := bytes.IndexByte(f, '=')
+		if i < 0 {
+			continue
+		}
+
+		value := string(f[i+1:])
+		switch string(f[:i]) {
+		case SrcPortField:
+			m.SrcPort = parsePort([]byte(value))
+		case DstField:
+			m.DstIP = net.ParseIP(value)
+		case DstPortField:
+			m.DstPort = parsePort([]byte(value))
+		case PortField:
+			m.Port = parsePort([]byte(value))
+		case InterfaceField:
+			m.Interface = value
+		case LatencyField:
+			m.Latency, _ = strconv.ParseInt(value, 10, 64)
+		}
+	}
+
+	return m
+}
+
+// FormatIP renders raw 4 or 16 byte IP address as written to payload header. IPv4-mapped IPv6 addresses
+// are written as IPv4 ones, other lengths are not valid addresses and give empty string.
+func FormatIP(ip []byte) string {
+	switch len(ip) {
+	case net.IPv4len, net.IPv6len:
+		return net.IP(ip).String()
+	}
+	return ""
+}
+
 func PayloadBody(payload []byte) []byte {
 	headerSize := bytes.IndexByte(payload, '\n')
 	return payload[headerSize+1:]
@@ -24,3 +24,81 @@ func TestPayload(t *testing.T) {
 	assert.Equal(t, strconv.Itoa(int(st)), string(es[2]))
 	assert.Equal(t, sIp, string(es[3]))
 }
+
+func TestPayloadMetaField(t *testing.T) {
+	uid := uuid.New()
+	meta := PayloadHeader(ReplayedResponsePayload, []byte(uid.String()), 1, nil)
+	meta = AppendMetaField(meta, LatencyField, "1500")
+
+	es := PayloadMeta(meta)
+	assert.Equal(t, byte(ReplayedResponsePayload), es[0][0])
+	assert.Equal(t, uid.String(), string(es[1]))
+	assert.Equal(t, "1", string(es[2]))
+	assert.Equal(t, "", string(es[3]))
+
+	lat, ok := MetaField(meta, LatencyField)
+	assert.True(t, ok)
+	assert.Equal(t, "1500", string(lat))
+
+	_, ok = MetaField(meta, "unknown")
+	assert.False(t, ok)
+}
+
+func TestParseMeta(t *testing.T) {
+	meta := PayloadHeader(ResponsePayload, []byte("f45590522cd1838b4a0d5c5aab80b77929dea3b3"), 1231, net.ParseIP("10.0.0.5").To4())
+	meta = AppendMetaField(meta, SrcPortField, "53")
+	meta = AppendMetaField(meta, DstField, "192.168.1.102")
+	meta = AppendMetaField(meta, DstPortField, "5353")
+	meta = AppendMetaField(meta, PortField, "53")
+	meta = AppendMetaField(meta, InterfaceField, "eth0")
+	meta = AppendMetaField(meta, LatencyField, "1500")
+
+	// Old parsers still get the same positional fields
+	es := PayloadMeta(meta)
+	assert.Equal(t, "10.0.0.5", string(es[3]))
+
+	m := ParseMeta(meta)
+	assert.Equal(t, byte(ResponsePayload), m.Type)
+	assert.Equal(t, "f45590522cd1838b4a0d5c5aab80b77929dea3b3", string(m.UUID))
+	assert.Equal(t, int64(1231), m.Timestamp)
+	assert.Equal(t, "10.0.0.5", m.SrcIP.String())
+	assert.Equal(t, uint16(53), m.SrcPort)
+	assert.Equal(t, "192.168.1.102", m.DstIP.String())
+	assert.Equal(t, uint16(5353), m.DstPort)
+	assert.Equal(t, uint16(53), m.Port)
+	assert.Equal(t, "eth0", m.Interface)
+	assert.Equal(t, int64(1500), m.Latency)
+
+	m = ParseMeta(PayloadHeader(RequestPayload, []byte("uuid"), 1, nil))
+	assert.Nil(t, m.SrcIP)
+	assert.Equal(t, uint16(0), m.DstPort)
+}
+
+func TestParseMetaIPv6(t *testing.T) {
+	meta := PayloadHeader(RequestPayload, []byte("uuid"), 1, net.ParseIP("fe80::1"))
+	meta = AppendMetaField(meta, SrcPortField, "5353")
+	meta = AppendMetaField(meta, DstField, FormatIP(net.ParseIP("2001:db8::53")))
+	meta = AppendMetaField(meta, DstPortField, "53")
+	assert.Equal(t, "1 uuid 1 fe80::1 sport=5353 dst=2001:db8::53 dport=53\n", string(meta))
+
+	m := ParseMeta(meta)
+	assert.True(t, m.SrcIP.Equal(net.ParseIP("fe80::1")))
+	assert.True(t, m.DstIP.Equal(net.ParseIP("2001:db8::53")))
+	assert.Equal(t, uint16(53), m.DstPort)
+
+	// IPv4-mapped addresses are written as IPv4 ones
+	assert.Equal(t, "10.0.0.5", FormatIP(net.ParseIP("10.0.0.5")))
+	assert.Equal(t, "", FormatIP([]byte{1, 2, 3}))
+}
+
+func TestSetMetaField(t *testing.T) {
+	meta := PayloadHeader(RequestPayload, []byte("uuid"), 1, net.ParseIP("10.0.0.5").To4())
+	meta = AppendMetaField(meta, SrcPortField, "53")
+	meta = AppendMetaField(meta, LatencyField, "10")
+
+	meta = SetMetaField(meta, SrcPortField, "5353")
+	assert.Equal(t, "1 uuid 1 10.0.0.5 lat=10 sport=5353\n", string(meta))
+
+	meta = SetMetaField(meta, InterfaceField, "eth0")
+	assert.Equal(t, "1 uuid 1 10.0.0.5 lat=10 sport=5353 if=eth0\n", string(meta))
+}
@@ -6,11 +6,14 @@ import (
 	"fmt"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
+	"github.com/myzhan/goreplay-udp/stats"
 	"log"
 	"strconv"
 	"time"
 )
 
+var decodeErrors = stats.Metrics.Counter("goreplay_udp_decode_errors_total", "Number of captured datagrams which failed to decode")
+
 // Message represents data across plugins
 type Message struct {
 	Meta []byte // metadata
@@ -22,18 +25,24 @@ type Response struct {
 	Uuid          []byte
 	RoundTripTime int64
 	StartedAt     int64
+	// UUID of original request when response is to its amplified copy
+	Origin []byte
 }
 
 type UDPMessage struct {
 	IsIncoming bool
 	Start      time.Time
+	Latency    time.Duration // time passed since paired request, responses only
 	SrcIp      []byte
 	DstIp      []byte
 	SrcPort    uint16
 	DstPort    uint16
+	Port       uint16 // listened port, destination of requests and source of responses
+	Interface  string // capturing network interface, empty for capture files
 	length     uint16
 	checksum   uint16
 	data       []byte
+	uuid       []byte
 }
 
 func NewUDPMessage(data []byte, srcIp, dstIp []byte, isIncoming bool) (m *UDPMessage) {
@@ -42,6 +51,7 @@ func NewUDPMessage(data []byte, srcIp, dstIp []byte, isIncoming bool) (m *UDPMes
 	err := udp.DecodeFromBytes(data, gopacket.NilDecodeFeedback)
 	if err != nil {
 		log.Printf("Error decode udp message, %v\n", err)
+		decodeErrors.Inc()
 	}
 	m.SrcIp = make([]byte, len(srcIp))
 	copy(m.SrcIp, srcIp)
@@ -57,7 +67,16 @@ func NewUDPMessage(data []byte, srcIp, dstIp []byte, isIncoming bool) (m *UDPMes
 	return
 }
 
+// SetUUID overrides generated UUID, e.g. to give response the same UUID as its request
+func (m *UDPMessage) SetUUID(uuid []byte) {
+	m.uuid = uuid
+}
+
 func (m *UDPMessage) UUID() []byte {
+	if m.uuid != nil {
+		return m.uuid
+	}
+
 	var key []byte
 
 	key = strconv.AppendInt(key, m.Start.UnixNano(), 10)
@@ -68,6 +87,7 @@ func (m *UDPMessage) UUID() []byte {
 	uuid := make([]byte, 40)
 	sha := sha1.Sum(key)
 	hex.Encode(uuid, sha[:20])
+	m.uuid = uuid
 
 	return uuid
 }
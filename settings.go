@@ -3,7 +3,13 @@ package main
 import (
 	"flag"
 	"fmt"
+	"github.com/myzhan/goreplay-udp/dns"
+	"github.com/myzhan/goreplay-udp/listener"
+	"github.com/myzhan/goreplay-udp/modifier"
 	"github.com/myzhan/goreplay-udp/output"
+	"github.com/myzhan/goreplay-udp/pipeline"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -20,23 +26,63 @@ func (h *MultiOption) Set(value string) error {
 	return nil
 }
 
+// AmplifyOption is number of times each datagram is sent, given as N or xN
+type AmplifyOption int
+
+func (a *AmplifyOption) String() string {
+	return strconv.Itoa(int(*a))
+}
+
+func (a *AmplifyOption) Set(value string) error {
+	n, err := strconv.Atoi(strings.TrimPrefix(value, "x"))
+	if err != nil || n < 1 {
+		return fmt.Errorf("invalid amplify factor %q, expected N or xN", value)
+	}
+	*a = AmplifyOption(n)
+	return nil
+}
+
 // AppSettings is the struct of main configuration
 type AppSettings struct {
-	exitAfter time.Duration
+	config          string
+	exitAfter       time.Duration
+	shutdownTimeout time.Duration
+	metricsAddress  string
+	adminAddress    string
+
+	outputErrorPolicy     MultiOption
+	outputErrorRetries    int
+	outputErrorRetryDelay time.Duration
 
-	splitOutput  bool
-	outputStdout bool
-	outputNull   bool
+	splitOutput        bool
+	splitOutputMode    string
+	outputStdout       bool
+	outputStdoutFormat string
+	outputNull         bool
+
+	middleware         string
+	middlewareEncoding string
+
+	modifierConfig modifier.Config
+	dnsConfig      dns.Config
 
 	inputFile        MultiOption
 	inputFileLoop    bool
+	inputFileOffset  time.Duration
 	outputFile       MultiOption
 	outputFileConfig output.FileOutputConfig
 
-	inputUDP              MultiOption
-	inputUDPTrackResponse bool
-	outputUDP             MultiOption
-	outputUDPConfig       output.UDPOutputConfig
+	inputPcap              MultiOption
+	inputPcapAddr          string
+	inputPcapTrackResponse bool
+
+	inputUDP        MultiOption
+	inputUDPConfig  listener.Config
+	outputUDP       MultiOption
+	outputUDPConfig output.UDPOutputConfig
+
+	outputDiff       MultiOption
+	outputDiffConfig output.DiffOutputConfig
 
 	inputHttp        MultiOption
 	outputHttp       MultiOption
@@ -47,32 +93,95 @@ type AppSettings struct {
 var Settings AppSettings
 
 func init() {
+	registerFlags()
+}
+
+// registerFlags binds command line flags to Settings
+func registerFlags() {
+	flag.StringVar(&Settings.config, "config", "", "Read settings from yaml or json file, keys are flag names. Flags given on command line override file values:\n\tgoreplay-udp --config replay.yaml --output-udp-workers 20")
 	flag.DurationVar(&Settings.exitAfter, "exit-after", 0, "exit after specified duration")
+	flag.DurationVar(&Settings.shutdownTimeout, "shutdown-timeout", 5*time.Second, "On exit outputs get this long to send queued messages, the rest is dropped. Second interrupt exits immediately")
+	flag.Var(&Settings.outputErrorPolicy, "output-error-policy", "What to do when output fails to write message: retry, skip, disable output or abort, as [<output>=]<policy>, output is one of stdout, null, file, diff, udp, http:\n\tgoreplay-udp --input-udp :53 --output-udp staging:53 --output-file dns.req --output-error-policy skip --output-error-policy file=abort")
+	flag.IntVar(&Settings.outputErrorRetries, "output-error-retries", 3, "Attempts to write message again with retry error policy, message is dropped after that")
+	flag.DurationVar(&Settings.outputErrorRetryDelay, "output-error-retry-delay", 100*time.Millisecond, "Delay before the first retry, doubled after each attempt")
+	flag.StringVar(&Settings.adminAddress, "admin-address", "", "Serve admin API on http://<address>: list plugins, pause and resume inputs, change speed and limits, flush and rotate files, health checks. Example: --admin-address 127.0.0.1:9101")
+	flag.StringVar(&Settings.metricsAddress, "metrics-address", "", "Serve Prometheus metrics of all plugins on http://<address>/metrics. Example: --metrics-address :9100")
 
 	flag.BoolVar(&Settings.splitOutput, "split-output", false, "By default each output gets same traffic. If set to `true` it splits traffic equally among all outputs")
+	flag.StringVar(&Settings.splitOutputMode, "split-output-mode", pipeline.SplitRoundRobin, "How --split-output distributes traffic: round-robin or flow-hash, which keeps datagrams from one client on the same output")
 	flag.BoolVar(&Settings.outputStdout, "output-stdout", false, "Used for testing inputs. Just prints to console data coming from inputs")
+	flag.StringVar(&Settings.outputStdoutFormat, "output-stdout-format", output.FormatText, "Format of --output-stdout: text prints payloads as is, dns prints decoded summary of DNS messages")
 	flag.BoolVar(&Settings.outputNull, "output-null", false, "Used for testing inputs. Drops all requests")
 
 	flag.Var(&Settings.inputFile, "input-file", "Read requests from file: \n\tgoreplay-udp --input-file ./requests.gor --output-stdout")
 	flag.BoolVar(&Settings.inputFileLoop, "input-file-loop", false, "Loop input files, useful for performance testing")
+	flag.DurationVar(&Settings.inputFileOffset, "input-file-offset", 0, "Start replay from given offset of the capture, e.g. 10m. Indexed binary files are seeked without reading skipped payloads")
 
 	flag.Var(&Settings.outputFile, "output-file", "Write incoming requests to file: \n\tgoreplay-udp --input-udp :80 --output-file ./requests.gor")
 	flag.DurationVar(&Settings.outputFileConfig.FlushInterval, "output-file-flush-interval", time.Second, "Interval for forcing buffer flush to the file, default: 1s")
 	flag.BoolVar(&Settings.outputFileConfig.Append, "output-file-append", false, "The flushed chunk is appended to existence file or not")
+	flag.StringVar(&Settings.outputFileConfig.Format, "output-file-format", output.FormatText, "Format of written file: text or binary. Binary format is length prefixed, so any payload is safe, and gets sidecar .idx file for seeking. Input file format is detected automatically")
 
 	// Set default
 	Settings.outputFileConfig.SizeLimit.Set("32mb")
 	flag.Var(&Settings.outputFileConfig.SizeLimit, "output-file-size-limit", "Size of each chunk. Default: 32mb")
 	flag.IntVar(&Settings.outputFileConfig.QueueLimit, "output-file-queue-limit", 25600, "The length of the chunk queue. Default: 25600")
 
-	flag.Var(&Settings.inputUDP, "input-udp", "Capture traffic from given port (use RAW sockets and require *sudo* access):\n\t# Capture traffic from 8080 port\n\tgoreplay-udp --input-raw :8080 --output-stdout")
-	flag.BoolVar(&Settings.inputUDPTrackResponse, "input-udp-track-response", false, "If turned on gorepaly-udp will track responses in addition to requests")
+	flag.StringVar(&Settings.middleware, "middleware", "", "Used for modifying traffic using external command. Each message is written to its stdin as encoded line, messages written back to stdout are passed to outputs:\n\tgoreplay-udp --input-udp :53 --middleware \"python anonymize.py\" --output-file dns.req")
+	flag.StringVar(&Settings.middlewareEncoding, "middleware-encoding", pipeline.MiddlewareHex, "Encoding of messages passed to middleware: hex or base64")
+
+	flag.Var((*MultiOption)(&Settings.modifierConfig.AllowPayload), "udp-allow-payload", "Pass only requests with payload matching any of given patterns, regexp or hex bytes:\n\tgoreplay-udp --input-udp :53 --output-stdout --udp-allow-payload hex:00010000")
+	flag.Var((*MultiOption)(&Settings.modifierConfig.DenyPayload), "udp-deny-payload", "Drop requests with payload matching any of given patterns, regexp or hex bytes:\n\tgoreplay-udp --input-udp :8125 --output-stdout --udp-deny-payload '^debug\\.'")
+	flag.Var((*MultiOption)(&Settings.modifierConfig.AllowSource), "udp-allow-source", "Pass only requests from given IP or CIDR network, optionally with port, or just :port:\n\tgoreplay-udp --input-udp :53 --output-stdout --udp-allow-source 10.0.0.0/8")
+	flag.Var((*MultiOption)(&Settings.modifierConfig.DenySource), "udp-deny-source", "Drop requests from given IP or CIDR network, optionally with port, or just :port:\n\tgoreplay-udp --input-udp :53 --output-stdout --udp-deny-source 10.0.0.1")
+	flag.Var((*MultiOption)(&Settings.modifierConfig.Rewrite), "udp-rewrite-payload", "Replace payload parts matching regexp, in pattern:replacement format, ':' in pattern is escaped as '\\:', replacement may refer to groups as $1:\n\tgoreplay-udp --input-udp :8125 --output-stdout --udp-rewrite-payload 'prod\\.(\\w+):staging.$1'")
+	flag.Var((*MultiOption)(&Settings.modifierConfig.Patch), "udp-patch-payload", "Overwrite payload bytes at fixed offset, in offset:hexbytes format, negative offset counts from the end:\n\tgoreplay-udp --input-udp :53 --output-stdout --udp-patch-payload 2:0100")
+
+	flag.Var((*MultiOption)(&Settings.dnsConfig.AllowName), "dns-allow-name", "Pass only DNS queries for names in given zone:\n\tgoreplay-udp --input-udp :53 --output-stdout --dns-allow-name example.com")
+	flag.Var((*MultiOption)(&Settings.dnsConfig.DenyName), "dns-deny-name", "Drop DNS queries for names in given zone:\n\tgoreplay-udp --input-udp :53 --output-stdout --dns-deny-name internal.example.com")
+	flag.Var((*MultiOption)(&Settings.dnsConfig.AllowType), "dns-allow-type", "Pass only DNS queries of given types, like A,AAAA or TYPE65")
+	flag.Var((*MultiOption)(&Settings.dnsConfig.DenyType), "dns-deny-type", "Drop DNS queries of given types, like ANY or TYPE255")
+	flag.Var((*MultiOption)(&Settings.dnsConfig.RewriteZone), "dns-rewrite-zone", "Rename zone in DNS query names, in from:to format:\n\tgoreplay-udp --input-file dns.req --output-udp 10.1.0.5:53 --dns-rewrite-zone example.com:staging.example.com")
+	flag.BoolVar(&Settings.dnsConfig.RandomizeID, "dns-randomize-id", false, "Replace transaction ID of DNS queries with random one, replayed responses get the original ID back")
+
+	flag.Var(&Settings.inputPcap, "input-pcap", "Replay traffic from pcap or pcapng file, keeping original timing:\n\tgoreplay-udp --input-pcap ./dns.pcap --input-pcap-addr :53 --output-stdout")
+	flag.StringVar(&Settings.inputPcapAddr, "input-pcap-addr", "", "Address used to filter datagrams read by --input-pcap, in the same format as --input-udp. Example: --input-pcap-addr :53")
+	flag.BoolVar(&Settings.inputPcapTrackResponse, "input-pcap-track-response", false, "If turned on goreplay-udp will read responses from pcap file in addition to requests")
+
+	flag.Var(&Settings.inputUDP, "input-udp", "Capture traffic from given ports, comma separated list of ports and ranges (use RAW sockets and require *sudo* access):\n\t# Capture traffic from 8080 port\n\tgoreplay-udp --input-raw :8080 --output-stdout\n\t# Capture SIP and DNS traffic\n\tgoreplay-udp --input-udp :5060-5080,53,5353 --output-stdout")
+	flag.BoolVar(&Settings.inputUDPConfig.TrackResponse, "input-udp-track-response", false, "If turned on gorepaly-udp will track responses in addition to requests")
+	flag.StringVar(&Settings.inputUDPConfig.ResponseMatch, "input-udp-response-match", "none", "Protocol key used along with addresses to pair tracked responses with requests, for both --input-udp and --input-pcap. Available: "+strings.Join(listener.CorrelationKeys(), ", "))
+	flag.DurationVar(&Settings.inputUDPConfig.ResponseWindow, "input-udp-response-window", 2*time.Second, "Responses captured later than this after the request are not paired with it. Default: 2s")
+	flag.DurationVar(&Settings.inputUDPConfig.DefragTimeout, "input-udp-defrag-timeout", 30*time.Second, "Fragmented datagrams which are not complete after this timeout are dropped. Default: 30s")
+	flag.IntVar(&Settings.inputUDPConfig.DefragMaxBytes, "input-udp-defrag-max-bytes", 4*1024*1024, "Memory limit for fragments waiting for reassembly, oldest datagrams are dropped first. Default: 4mb")
+	flag.StringVar(&Settings.inputUDPConfig.BPF, "input-udp-bpf", "", "Extra BPF expression ANDed into filter built from --input-udp or --input-pcap-addr address and ports, fragments have to match it as well:\n\tgoreplay-udp --input-udp :53 --input-udp-bpf 'not src net 10.1.0.0/16' --output-stdout")
 
 	flag.Var(&Settings.outputUDP, "output-udp", "Forwards incoming requests to given udp address.\n\t# Redirect all incoming requests to staging.com address \n\tgoreplay-udp --input-raw :80 --output-udp staging.com")
 	flag.IntVar(&Settings.outputUDPConfig.Workers, "output-udp-workers", 0, "Goreplay-udp uses dynamic worker scaling by default.  Enter a number to run a set number of workers.")
 	flag.DurationVar(&Settings.outputUDPConfig.Timeout, "output-udp-timeout", 5*time.Second, "Specify UDP request/response timeout. By default 5s. Example: --output-udp-timeout 30s")
 	flag.BoolVar(&Settings.outputUDPConfig.Stats, "output-udp-stats", false, "Report udp output queue stats to console every 5 seconds")
 	flag.BoolVar(&Settings.outputUDPConfig.IgnoreResponse, "output-udp-ignore-response", false, "Ignore UDP Response")
+	flag.BoolVar(&Settings.outputUDPConfig.FlowAffinity, "output-udp-flow-affinity", false, "Replay datagrams of each original client IP:port from its own socket, keeping their order. Useful for stateful protocols")
+	flag.DurationVar(&Settings.outputUDPConfig.FlowIdleTimeout, "output-udp-flow-idle-timeout", time.Minute, "Close socket of the flow if there are no datagrams for it during this time. Default: 1m")
+	flag.IntVar(&Settings.outputUDPConfig.MaxFlows, "output-udp-max-flows", 10000, "Maximum number of flows with their own socket, datagrams of new flows are dropped above it. Default: 10000")
+	flag.BoolVar(&Settings.outputUDPConfig.OriginalDestination, "output-udp-original-destination", false, "Send each datagram to its captured destination IP:port, --output-udp address is used for datagrams recorded without one")
+	flag.Var((*MultiOption)(&Settings.outputUDPConfig.DestinationMap), "output-udp-destination-map", "Translate captured destination address when using --output-udp-original-destination, as IP, IP:port or CIDR network:\n\tgoreplay-udp --input-file dns.req --output-udp 10.1.0.5:53 --output-udp-original-destination --output-udp-destination-map 10.0.0.5:53=10.1.0.5:5353")
+	flag.BoolVar(&Settings.outputUDPConfig.Timing, "output-udp-timing", false, "Send each datagram at its captured time relative to the first one, keeping original inter-arrival timing for both live and file inputs")
+	flag.Float64Var(&Settings.outputUDPConfig.TimingSpeed, "output-udp-timing-speed", 1, "Speed factor for --output-udp-timing, 2 replays twice faster. Default: 1")
+	Settings.outputUDPConfig.Amplify = 1
+	flag.Var((*AmplifyOption)(&Settings.outputUDPConfig.Amplify), "output-udp-amplify", "Multiply traffic by sending each datagram given number of times, e.g. 5 or x5. Copies get their own UUIDs, with UUID of original datagram in orig field. Default: 1")
+	flag.DurationVar(&Settings.outputUDPConfig.AmplifyJitter, "output-udp-amplify-jitter", 0, "Delay copies of amplified datagrams randomly up to this duration, e.g. 10ms")
+	flag.Var((*MultiOption)(&Settings.outputUDPConfig.AmplifyMutate), "output-udp-amplify-mutate", "Identifiers changed in each copy of amplified datagram: sport (seen with --output-udp-raw and --output-udp-flow-affinity), dns-id:\n\tgoreplay-udp --input-file dns.req --output-udp staging:53 --output-udp-amplify 5 --output-udp-amplify-mutate sport,dns-id")
+	flag.StringVar(&Settings.outputUDPConfig.Ramp, "output-udp-ramp", "", "Ramp-up profile which increases replay speed from --output-udp-ramp-from to --output-udp-timing-speed during --output-udp-ramp-duration: linear or step. Enables --output-udp-timing")
+	flag.Float64Var(&Settings.outputUDPConfig.RampFrom, "output-udp-ramp-from", 0.1, "Speed factor at the start of ramp-up. Default: 0.1")
+	flag.DurationVar(&Settings.outputUDPConfig.RampDuration, "output-udp-ramp-duration", 10*time.Minute, "Duration of ramp-up. Default: 10m")
+	flag.IntVar(&Settings.outputUDPConfig.RampSteps, "output-udp-ramp-steps", 5, "Number of speed steps of step ramp-up profile. Default: 5")
+	flag.BoolVar(&Settings.outputUDPConfig.RawSocket, "output-udp-raw", false, "Send datagrams from their captured source IP and port using raw socket (linux only, requires *sudo* access). Responses are not tracked")
+	flag.Var((*MultiOption)(&Settings.outputUDPConfig.SourceMap), "output-udp-source-map", "Translate captured source address when using --output-udp-raw, as IP, IP:port or CIDR network:\n\tgoreplay-udp --input-file dns.req --output-udp 10.1.0.5:53 --output-udp-raw --output-udp-source-map 10.0.0.0/16=172.16.0.0/16")
+
+	flag.Var(&Settings.outputDiff, "output-diff", "Compare replayed responses with captured ones and write mismatches and summary to given report file. Requires responses tracked by input and replayed by output:\n\tgoreplay-udp --input-file dns.req --output-udp staging:53 --output-diff diff.txt --output-diff-protocol dns")
+	flag.DurationVar(&Settings.outputDiffConfig.Timeout, "output-diff-timeout", 10*time.Second, "Response without its pair for this long is reported as missing. Should be longer than --output-udp-timeout. Default: 10s")
+	flag.StringVar(&Settings.outputDiffConfig.Protocol, "output-diff-protocol", output.DiffBytes, "How responses are compared: bytes, or dns which ignores transaction ID, TTLs and order of records")
 
 	flag.Var(&Settings.inputHttp, "input-http", "Capture traffic from given port (use RAW sockets and require *sudo* access):\n\t# Capture traffic from 8080 port\n\tgoreplay-udp --input-http :8080 --output-stdout")
 	flag.Var(&Settings.outputHttp, "output-http", "Forwards incoming requests to given http address.\n\t# Redirect all incoming requests to staging.com address \n\tgor --input-raw :80 --output-http http://staging.com")
@@ -0,0 +1,235 @@
+package stats
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Counter is metric which only goes up, e.g. number of messages read
+type Counter struct {
+	v uint64
+}
+
+// Inc increments counter by 1
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.v, 1)
+}
+
+// Add increments counter by n
+func (c *Counter) Add(n int) {
+	atomic.AddUint64(&c.v, uint64(n))
+}
+
+// Value returns current counter value
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.v)
+}
+
+// DefaultLatencyBuckets are upper bounds in seconds used for replay latency histograms
+var DefaultLatencyBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+// Histogram counts observations in configurable buckets
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+// NewHistogram creates histogram with given bucket upper bounds, not registered in any registry
+func NewHistogram(buckets []float64) *Histogram {
+	return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+// Observe adds single observation, e.g. latency in seconds
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+type series struct {
+	labels    string
+	counter   *Counter
+	histogram *Histogram
+	fn        func() float64
+}
+
+type family struct {
+	name   string
+	help   string
+	kind   string
+	series map[string]*series
+}
+
+// Registry holds metrics and exposes them in Prometheus text format
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+// Metrics is registry served by --metrics-address, plugins register in it through the pipeline
+var Metrics = NewRegistry()
+
+// NewRegistry constructor for Registry
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+// formatLabels renders label pairs, e.g. ("plugin", "UDP output") as {plugin="UDP output"}
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1])
+		pairs = append(pairs, labels[i]+`="`+value+`"`)
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// series returns existing series with the same labels or registers new one, update is called with the lock held
+func (r *Registry) series(name, help, kind string, labels []string, update func(s *series)) *series {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	f, ok := r.families[name]
+	if !ok {
+		f = &family{name: name, help: help, kind: kind, series: make(map[string]*series)}
+		r.families[name] = f
+	}
+
+	key := formatLabels(labels)
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labels: key}
+		f.series[key] = s
+	}
+	update(s)
+
+	return s
+}
+
+// Counter returns counter with given name and label pairs
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	return r.series(name, help, "counter", labels, func(s *series) {
+		if s.counter == nil {
+			s.counter = new(Counter)
+		}
+	}).counter
+}
+
+// Histogram returns histogram with given name, bucket upper bounds and label pairs
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return r.series(name, help, "histogram", labels, func(s *series) {
+		if s.histogram == nil {
+			s.histogram = NewHistogram(buckets)
+		}
+	}).histogram
+}
+
+// GaugeFunc registers gauge which value is read on each scrape, e.g. queue length.
+// Function of already registered gauge is replaced.
+func (r *Registry) GaugeFunc(name, help string, fn func() float64, labels ...string) {
+	r.series(name, help, "gauge", labels, func(s *series) {
+		s.fn = fn
+	})
+}
+
+// CounterFunc registers counter maintained elsewhere, read on each scrape
+func (r *Registry) CounterFunc(name, help string, fn func() float64, labels ...string) {
+	r.series(name, help, "counter", labels, func(s *series) {
+		s.fn = fn
+	})
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// withLabel adds one more label to rendered labels
+func withLabel(labels, name, value string) string {
+	if labels == "" {
+		return "{" + name + `="` + value + `"}`
+	}
+	return labels[:len(labels)-1] + "," + name + `="` + value + `"}`
+}
+
+// WriteTo writes all metrics in Prometheus text exposition format
+func (r *Registry) WriteTo(w io.Writer) (n int64, err error) {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	r.mu.Unlock()
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		r.mu.Lock()
+		f := r.families[name]
+		keys := make([]string, 0, len(f.series))
+		for key := range f.series {
+			keys = append(keys, key)
+		}
+		r.mu.Unlock()
+		sort.Strings(keys)
+
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+
+		for _, key := range keys {
+			r.mu.Lock()
+			s := f.series[key]
+			fn := s.fn
+			r.mu.Unlock()
+
+			switch {
+			case fn != nil:
+				fmt.Fprintf(&b, "%s%s %s\n", f.name, s.labels, formatFloat(fn()))
+			case s.counter != nil:
+				fmt.Fprintf(&b, "%s%s %d\n", f.name, s.labels, s.counter.Value())
+			case s.histogram != nil:
+				h := s.histogram
+				h.mu.Lock()
+				for i, bound := range h.buckets {
+					fmt.Fprintf(&b, "%s_bucket%s %d\n", f.name, withLabel(s.labels, "le", formatFloat(bound)), h.counts[i])
+				}
+				fmt.Fprintf(&b, "%s_bucket%s %d\n", f.name, withLabel(s.labels, "le", "+Inf"), h.count)
+				fmt.Fprintf(&b, "%s_sum%s %s\n", f.name, s.labels, formatFloat(h.sum))
+				fmt.Fprintf(&b, "%s_count%s %d\n", f.name, s.labels, h.count)
+				h.mu.Unlock()
+			}
+		}
+	}
+
+	written, err := io.WriteString(w, b.String())
+	return int64(written), err
+}
+
+// ServeHTTP serves metrics for Prometheus scraper
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
@@ -0,0 +1,57 @@
+package stats
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	r := NewRegistry()
+
+	r.Counter("messages_read_total", "Messages read", "plugin", "UDP input").Add(3)
+	r.Counter("messages_read_total", "Messages read", "plugin", "UDP input").Inc()
+	r.GaugeFunc("queue_length", "Queue length", func() float64 { return 7 }, "plugin", `say "hi"`)
+
+	h := r.Histogram("latency_seconds", "Latency", []float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(2)
+
+	var buf bytes.Buffer
+	r.WriteTo(&buf)
+	out := buf.String()
+
+	assert.Contains(t, out, "# TYPE messages_read_total counter\n")
+	assert.Contains(t, out, `messages_read_total{plugin="UDP input"} 4`)
+	assert.Contains(t, out, `queue_length{plugin="say \"hi\""} 7`)
+	assert.Contains(t, out, `latency_seconds_bucket{le="0.1"} 1`)
+	assert.Contains(t, out, `latency_seconds_bucket{le="1"} 2`)
+	assert.Contains(t, out, `latency_seconds_bucket{le="+Inf"} 3`)
+	assert.Contains(t, out, `latency_seconds_count 3`)
+}
+
+func TestMetricsFuncReplaced(t *testing.T) {
+	r := NewRegistry()
+
+	// Registering while scraping is safe, the last function is used
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			r.WriteTo(ioutil.Discard)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		v := float64(i)
+		r.GaugeFunc("queue_length", "Queue length", func() float64 { return v })
+		r.CounterFunc("dropped_total", "Dropped", func() float64 { return v })
+	}
+	<-done
+
+	var buf bytes.Buffer
+	r.WriteTo(&buf)
+	assert.Contains(t, buf.String(), "queue_length 99\n")
+	assert.Contains(t, buf.String(), "dropped_total 99\n")
+}